@@ -19,6 +19,7 @@ package container
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
 	"github.com/GoogleCloudPlatform/kubernetes/pkg/types"
@@ -68,6 +69,8 @@ type Pod struct {
 	// The name and namespace of the pod, which is readable by human.
 	Name      string
 	Namespace string
+	// The labels of the pod, if the runtime knows them.
+	Labels map[string]string
 	// List of containers that belongs to this pod. It may contain only
 	// running containers, or mixed with dead ones (when GetPods(true)).
 	Containers []*Container
@@ -95,8 +98,41 @@ type Container struct {
 	// The timestamp of the creation time of the container.
 	// TODO(yifan): Consider to move it to api.ContainerStatus.
 	Created int64
+	// The state of the container, if known.
+	State ContainerState
 }
 
+// PodStatus summarizes the states of the containers of a pod, as listed by the
+// runtime.
+type PodStatus struct {
+	// Number of running containers.
+	RunningContainers int
+	// Number of exited containers.
+	ExitedContainers int
+	// Number of exited containers by container name, i.e. how many times
+	// each container was restarted.
+	RestartCounts map[string]int
+	// PodRunning if any container is running, PodUnknown otherwise since
+	// the exit codes of the containers are not known.
+	Phase api.PodPhase
+	// When each container was first seen in its current state, indexed by
+	// container ID.
+	StateSince map[types.UID]time.Time
+}
+
+// ContainerState is the coarse state of a container as listed by the runtime.
+type ContainerState string
+
+const (
+	ContainerStateRunning ContainerState = "running"
+	ContainerStateExited  ContainerState = "exited"
+	ContainerStateUnknown ContainerState = "unknown"
+)
+
+// ImageID identifies a container image, by the name the containers using it
+// were created with.
+type ImageID string
+
 // RunContainerOptions specify the options which are necessary for running containers
 type RunContainerOptions struct {
 	// The environment variables, they are in the form of 'key=value'.
@@ -168,6 +204,54 @@ func (p *Pod) FindContainerByName(containerName string) *Container {
 	return nil
 }
 
+// DeepCopy returns a copy of the pod which shares no memory with the original,
+// so that either can be modified without affecting the other.
+func (p *Pod) DeepCopy() *Pod {
+	copied := *p
+	if p.Labels != nil {
+		copied.Labels = make(map[string]string, len(p.Labels))
+		for k, v := range p.Labels {
+			copied.Labels[k] = v
+		}
+	}
+	if p.Containers != nil {
+		copied.Containers = make([]*Container, len(p.Containers))
+		for i, c := range p.Containers {
+			container := *c
+			copied.Containers[i] = &container
+		}
+	}
+	if p.Status.Conditions != nil {
+		copied.Status.Conditions = make([]api.PodCondition, len(p.Status.Conditions))
+		copy(copied.Status.Conditions, p.Status.Conditions)
+	}
+	if p.Status.ContainerStatuses != nil {
+		copied.Status.ContainerStatuses = make([]api.ContainerStatus, len(p.Status.ContainerStatuses))
+		for i, status := range p.Status.ContainerStatuses {
+			status.State = copyContainerState(status.State)
+			status.LastTerminationState = copyContainerState(status.LastTerminationState)
+			copied.Status.ContainerStatuses[i] = status
+		}
+	}
+	return &copied
+}
+
+func copyContainerState(state api.ContainerState) api.ContainerState {
+	if state.Waiting != nil {
+		waiting := *state.Waiting
+		state.Waiting = &waiting
+	}
+	if state.Running != nil {
+		running := *state.Running
+		state.Running = &running
+	}
+	if state.Termination != nil {
+		termination := *state.Termination
+		state.Termination = &termination
+	}
+	return state
+}
+
 // GetPodFullName returns a name that uniquely identifies a pod.
 func GetPodFullName(pod *api.Pod) string {
 	// Use underscore as the delimiter because it is not allowed in pod name
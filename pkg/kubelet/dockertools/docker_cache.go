@@ -17,99 +17,3650 @@ limitations under the License.
 package dockertools
 
 import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
 	kubecontainer "github.com/GoogleCloudPlatform/kubernetes/pkg/kubelet/container"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/labels"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/types"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/util"
+	"github.com/golang/glog"
+	"github.com/golang/groupcache/lru"
+	"golang.org/x/net/context"
 )
 
+// DockerCache is a kubecontainer.RuntimeCache, so that its users do not depend
+// on docker.
 type DockerCache interface {
+	kubecontainer.RuntimeCache
+	// AssertUpToDate is ForceUpdateIfOlder with the current time of the
+	// clock of the cache: it refreshes the cache unless it was refreshed
+	// since the call started, e.g. after a mutation of the containers, and
+	// returns the error of the refresh.
+	AssertUpToDate() error
+	// GetPodsWithContext is like GetPods, but gives up on a synchronous
+	// refresh and returns ctx.Err() once ctx is done.
+	GetPodsWithContext(ctx context.Context) ([]*kubecontainer.Pod, error)
+	// GetPodsSnapshot is like GetPods, and also returns the time the pods
+	// were listed at, consistently with the pods, unlike a separate call to
+	// LastUpdated which may see a later refresh.
+	GetPodsSnapshot() ([]*kubecontainer.Pod, time.Time, error)
+	// GetPodsTimed is like GetPods, and also returns whether the call waited
+	// for a synchronous listing of docker, started by it or shared with
+	// another caller, and how long it waited for it, zero if the pods were
+	// served from the cache.
+	GetPodsTimed() (pods []*kubecontainer.Pod, refreshed bool, dur time.Duration, err error)
+	// GetPodsStrict is like GetPods, but returns ErrCacheUninitialized
+	// instead of empty pods if they were never loaded, even after listing
+	// docker synchronously, so that callers can't mistake a cold cache for
+	// a node without pods.
+	GetPodsStrict() ([]*kubecontainer.Pod, error)
+	// Range calls fn for every cached pod until it returns false, refreshing
+	// the cache first under the same rules as GetPods. Unlike GetPods, the
+	// pods are not copied: fn must neither modify them nor keep any
+	// reference to them after it returns. The cache is locked while fn
+	// runs, so fn must not call the cache.
+	Range(fn func(pod *kubecontainer.Pod) bool) error
+	// GetPodsWithFreshness is like GetPods, and also reports whether the
+	// returned pods are within the sync staleness threshold, as opposed to
+	// being served stale because they could not be refreshed.
+	GetPodsWithFreshness() ([]*kubecontainer.Pod, bool, error)
+	// GetPodsOnce is like GetPods, but neither starts nor keeps running the
+	// background thread, for short-lived callers.
+	GetPodsOnce() ([]*kubecontainer.Pod, error)
+	// GetPodsMaxStale is like GetPods, but the cache is refreshed if it is
+	// older than maxStale, whatever the sync staleness threshold, so that
+	// callers pick the freshness they need. Concurrent callers share a
+	// single refresh.
+	GetPodsMaxStale(maxStale time.Duration) ([]*kubecontainer.Pod, error)
+	// GetAllPods is like GetPods, but the pods also include the containers
+	// which are not running.
+	GetAllPods() ([]*kubecontainer.Pod, error)
+	// ForceUpdate re-lists docker regardless of how fresh the cache is,
+	// unless it was already forced within the configured debounce window.
+	ForceUpdate() error
+	// ForceUpdateWithContext is like ForceUpdate, but gives up and returns
+	// ctx.Err() once ctx is done.
+	ForceUpdateWithContext(ctx context.Context) error
+	// ForceUpdatePod refreshes the pod with the given UID, e.g. after
+	// mutating its containers, by looking it up with the SinglePodGetter and
+	// merging it into, or removing it from, the cache. The other pods and
+	// the time of the cache are untouched. Without a SinglePodGetter, or if
+	// the cache was never loaded, it is a ForceUpdate.
+	ForceUpdatePod(uid types.UID) error
+	// GetPodByUID returns the cached pod with the given UID and whether it
+	// was found. The cache is refreshed under the same rules as GetPods.
+	GetPodByUID(uid types.UID) (*kubecontainer.Pod, bool, error)
+	// GetPodSandbox returns the infra container of the cached pod with the
+	// given UID, which holds the network namespace of the pod, and whether
+	// it was found: it isn't when the pod isn't cached or its infra
+	// container isn't running. The cache is refreshed under the same rules
+	// as GetPods.
+	GetPodSandbox(uid types.UID) (*kubecontainer.Container, bool, error)
+	// AppContainers returns the containers of the cached pod with the given
+	// UID but its infra container, and whether the pod was found. The cache
+	// is refreshed under the same rules as GetPods.
+	AppContainers(uid types.UID) ([]*kubecontainer.Container, bool, error)
+	// GetPodsFiltered is like GetAllPods, but only returns the pods for
+	// which pred returns true. pred is called with the cached pods while
+	// the cache is locked, so it must not block, call the cache, modify the
+	// pods or keep any reference to them.
+	GetPodsFiltered(pred func(pod *kubecontainer.Pod) bool) ([]*kubecontainer.Pod, error)
+	// GetPodStatus returns the status of the pod with the given UID, derived
+	// from all its containers including the non-running ones, and whether
+	// the pod was found. The cache is refreshed under the same rules as
+	// GetAllPods.
+	GetPodStatus(uid types.UID) (*kubecontainer.PodStatus, bool, error)
+	// GetRestartCount returns how many times the cache saw the container
+	// of the given name of a pod replaced by one with another ID, and
+	// whether the pod has such a running container. The count is reset
+	// when the pod leaves the cache, so it misses the restarts of pods all
+	// of whose containers were down during a refresh. The cache is
+	// refreshed under the same rules as GetPods.
+	GetRestartCount(uid types.UID, containerName string) (int, bool, error)
+	// GetPodAndStatus returns the pod with the given UID, including its
+	// non-running containers, its status as GetPodStatus does, both from
+	// the same listing, and whether the pod was found. The cache is
+	// refreshed under the same rules as GetAllPods.
+	GetPodAndStatus(uid types.UID) (*kubecontainer.Pod, *kubecontainer.PodStatus, bool, error)
+	// GetContainerStateAge returns for how long the container with the given
+	// ID has been in its current state, as far as the cache has observed,
+	// and whether the container was found. The cache is refreshed under the
+	// same rules as GetAllPods.
+	GetContainerStateAge(id types.UID) (time.Duration, bool, error)
+	// GetPodsModifiedSince returns the cached pods added or modified after
+	// the given generation of the cache, and the current generation, which
+	// callers pass back on their next call to only see the pods changed
+	// since. Removed pods are not returned. Passing zero, or a generation
+	// the cache never reached, returns all the pods. The cache is refreshed
+	// under the same rules as GetPods.
+	GetPodsModifiedSince(generation uint64) ([]*kubecontainer.Pod, uint64, error)
+	// NewDeltaReader returns a reader of the changes of the cached pods
+	// between its calls, which keeps track of the generations itself.
+	NewDeltaReader() *DeltaReader
+	// GetPodCount returns the number of cached pods, refreshing them under
+	// the same rules as GetPods, without copying them.
+	GetPodCount() (int, error)
+	// GetPodIDs returns the sorted UIDs of the cached pods, refreshing them
+	// under the same rules as GetPods, without copying the pods.
+	GetPodIDs() ([]types.UID, error)
+	// GetPodContainerCount returns the number of containers of the cached
+	// pod with the given UID and whether the pod was found, without copying
+	// it. The cache is refreshed under the same rules as GetPods, but
+	// pods missing from the cache are not looked up.
+	GetPodContainerCount(uid types.UID) (int, bool, error)
+	// Contains returns whether a pod with the given UID is cached, without
+	// copying it. The cache is refreshed under the same rules as GetPods,
+	// but pods missing from the cache are not looked up.
+	Contains(uid types.UID) (bool, error)
+	// GetPodsInNamespace is like GetPods, but only returns the pods in the
+	// given namespace.
+	GetPodsInNamespace(namespace string) ([]*kubecontainer.Pod, error)
+	// GetRecentlyRemovedPod returns the last cached state of the pod with
+	// the given UID, if it was removed from the cache recently, e.g. for
+	// cleaning up after it. It doesn't refresh the cache.
+	GetRecentlyRemovedPod(uid types.UID) (*kubecontainer.Pod, bool)
+	// GetPodsByUIDs returns the cached pods with the given UIDs, indexed by
+	// UID. UIDs of pods which are not cached are left out. The cache is
+	// refreshed at most once, under the same rules as GetPods.
+	GetPodsByUIDs(uids []types.UID) (map[types.UID]*kubecontainer.Pod, error)
+	// GetImagesInUse returns the sorted images of the cached containers.
+	// The cache is refreshed under the same rules as GetPods.
+	GetImagesInUse() ([]kubecontainer.ImageID, error)
+	// GetContainersForImage returns the cached containers, across all pods,
+	// running the given image. The cache is refreshed under the same rules
+	// as GetPods.
+	GetContainersForImage(image string) ([]*kubecontainer.Container, error)
+	// GetContainerByID returns the cached container with the given ID, the
+	// pod owning it and whether it was found. The cache is refreshed under
+	// the same rules as GetPods.
+	GetContainerByID(id types.UID) (*kubecontainer.Pod, *kubecontainer.Container, bool, error)
+	// LastUpdated returns the time of the most recent successful refresh.
+	LastUpdated() time.Time
+	// CacheStatus reports the outcome of the recent refreshes.
+	CacheStatus() DockerCacheStatus
+	// Stats describes the content of the cache as of the most recent
+	// successful refresh.
+	Stats() DockerCacheStats
+	// DumpJSON serializes the cache content as a DockerCacheDump, for
+	// debugging. It doesn't refresh the cache.
+	DumpJSON() ([]byte, error)
+	// Subscribe returns a channel receiving the new cached pods every time
+	// they change, and a function cancelling the subscription. A subscriber
+	// which falls behind only misses the oldest snapshots, counted in the
+	// docker_cache_subscriber_dropped_total metric under the given name,
+	// which should identify the subscribing component.
+	Subscribe(name string) (<-chan []*kubecontainer.Pod, func())
+	// OnRefresh registers fn to be called with the new cached pods and the
+	// time they were listed at every time they change, and returns a
+	// function unregistering it. The hooks are called one at a time, in
+	// registration order, without the cache locked, so they may use it,
+	// possibly after the refresh returned. A hook which panics is skipped.
+	// The pods are shared by all the hooks, which must not modify them.
+	//
+	// Deprecated. Please use Subscribe for the changes of the cached pods,
+	// or an observer for the docker listings.
+	OnRefresh(fn func(pods []*kubecontainer.Pod, asOf time.Time)) func()
+	// SubscribeEvents is like Subscribe, but the channel receives the pods
+	// added, removed or modified by every change of the cached pods, as
+	// found by comparing the pods and their container states by UID. A
+	// subscriber which falls behind misses the oldest events, and should
+	// resynchronize with GetPods when that matters.
+	SubscribeEvents(name string) (<-chan PodCacheEvent, func())
+	// Prime seeds the cache with pods listed at asOf, e.g. by another cache,
+	// without listing docker. The pods are ignored if asOf is in the future,
+	// older than the sync staleness threshold, or older than the cached pods.
+	Prime(pods []*kubecontainer.Pod, asOf time.Time)
+	// WaitForInitialSync blocks until the cache has been successfully
+	// refreshed at least once, retrying failed refreshes, and returns an
+	// error if this did not happen within timeout.
+	WaitForInitialSync(timeout time.Duration) error
+	// RecentErrors returns the errors of the most recent failed refreshes,
+	// oldest first. They are cleared once refreshes have succeeded for
+	// longer than the unhealthy threshold.
+	RecentErrors() []TimestampedError
+	// Healthy returns nil unless the refreshes of the cache have kept
+	// failing for longer than the unhealthy threshold, in which case it
+	// returns an error describing the failures. It doesn't list docker, so
+	// it is cheap enough for a health check endpoint.
+	Healthy() error
+	// SetGetter replaces the getter listing the pods, e.g. to point the cache
+	// at another docker daemon, keeping the cached pods. A refresh in flight
+	// completes with the previous getter, the next ones use the new getter.
+	SetGetter(getter podsGetter) error
+	// Reset drops all the cached pods, e.g. after the docker daemon was
+	// restarted and the cached container IDs are meaningless, and stops
+	// the background thread. Unlike ForceUpdate it doesn't list docker: the
+	// next read loads the pods synchronously, as on a new cache.
+	Reset()
+	// DebugGoroutineCount returns the number of background threads and
+	// docker listings currently running. There is never more than one
+	// background thread unless the cache is broken, but a listing outlives
+	// Stop until docker answers. It doesn't take the cache lock.
+	DebugGoroutineCount() int
+	// DebugTopMissedPods returns the n pods which were looked up the most
+	// by GetPodByUID or Contains while the cache didn't hold them, most
+	// missed first, among the recently missed ones. Frequent misses of a
+	// pod usually mean that a caller keeps asking for a deleted pod.
+	DebugTopMissedPods(n int) []MissedPod
+	// Name returns the name labelling the metrics and log lines of the
+	// cache.
+	Name() string
+	// EvictPod drops the pod with the given UID from the cache right away,
+	// e.g. once its containers were deleted, without listing docker. The
+	// next refresh adds the pod back if docker still lists it, and logs a
+	// warning.
+	EvictPod(uid types.UID)
+	// Pause stops the background thread and makes reads serve the cached
+	// pods without ever listing docker, reporting them stale with
+	// ErrCachePaused once they are, e.g. while the docker daemon is being
+	// restarted. Explicit refreshes, like ForceUpdate, still list docker.
+	Pause()
+	// Resume undoes Pause, refreshing the cache right away, and returns the
+	// error of that refresh.
+	Resume() error
+	// ReadOnlyView returns a view of the cache for passive observers, such
+	// as metrics exporters, which must never list docker themselves.
+	ReadOnlyView() DockerCacheView
+	// Stop terminates the background updater and waits for it to exit, at
+	// most StopTimeout if set, then saves the cached pods to the
+	// SnapshotStore, if any. The listings in flight are not waited for,
+	// and their results are dropped: the cached pods never change once Stop
+	// returns. Once stopped, the cache returns ErrCacheStopped from all
+	// further calls.
+	Stop()
+}
+
+// DockerCacheView serves the pods of a DockerCache as they are, without ever
+// refreshing them, extending the idle timeout of the background thread or
+// starting it. The pods may be stale, or empty, unless other callers keep the
+// cache warm: LastUpdated tells how old they are.
+type DockerCacheView interface {
+	// GetPods returns the cached pods, or ErrCacheStopped once the cache is
+	// stopped.
 	GetPods() ([]*kubecontainer.Pod, error)
-	ForceUpdateIfOlder(time.Time) error
+	// LastUpdated returns the time the pods were listed at, zero if they
+	// never were.
+	LastUpdated() time.Time
+}
+
+// PodCacheEventType is the kind of change of a cached pod.
+type PodCacheEventType string
+
+const (
+	// PodAdded is the type of events for pods which were not cached.
+	PodAdded PodCacheEventType = "added"
+	// PodRemoved is the type of events for pods which are no longer cached.
+	PodRemoved PodCacheEventType = "removed"
+	// PodModified is the type of events for cached pods whose containers
+	// changed.
+	PodModified PodCacheEventType = "modified"
+)
+
+// PodCacheEvent is a change of a cached pod. Pod is the new pod, or the last
+// cached one if it was removed.
+type PodCacheEvent struct {
+	Type PodCacheEventType
+	Pod  *kubecontainer.Pod
+}
+
+// ErrCacheStopped is returned by a DockerCache that has been stopped.
+var ErrCacheStopped = errors.New("docker cache is stopped")
+
+// ErrCacheTooStale is returned instead of the cached pods when they could not
+// be refreshed and are older than the configured MaxCacheAge.
+var ErrCacheTooStale = errors.New("docker cache is too stale")
+
+// ErrCachePaused is the error of the stale pods served by a paused DockerCache
+// instead of refreshing them.
+var ErrCachePaused = errors.New("docker cache is paused")
+
+// ErrCircuitOpen is the error of the refreshes skipped while the circuit
+// breaker of a DockerCache is open.
+var ErrCircuitOpen = errors.New("docker cache circuit breaker is open")
+
+// ErrCacheWarming is the error of the empty pods served while a DockerCache
+// configured with NonBlockingFirstRead loads its pods.
+var ErrCacheWarming = errors.New("docker cache is still warming up")
+
+// IsCacheWarming returns true if err reports that the pods were not loaded
+// yet.
+func IsCacheWarming(err error) bool {
+	var staleErr *StaleCacheError
+	return errors.As(err, &staleErr) && errors.Is(staleErr.Err, ErrCacheWarming)
+}
+
+// ErrCacheUninitialized is returned by GetPodsStrict when the pods of a
+// DockerCache were never loaded, rather than empty pods.
+var ErrCacheUninitialized = errors.New("docker cache was never loaded")
+
+// ErrSyncRefreshTimeout is the error of a synchronous refresh which docker did
+// not answer within the configured SyncRefreshTimeout.
+var ErrSyncRefreshTimeout = errors.New("docker cache refresh timed out")
+
+// ErrDaemonRestartDetected is handed to the OnError callback when a refresh
+// finds none of the previously cached containers, which happens when the
+// docker daemon restarted. Callers holding per-container state should drop
+// it, as the old container IDs are meaningless.
+var ErrDaemonRestartDetected = errors.New("docker daemon restart detected: all container IDs changed")
+
+// withholdsPods returns true if err means that the cached pods must not be
+// returned.
+func withholdsPods(err error) bool {
+	return err == ErrCacheStopped || err == ErrCacheTooStale
+}
+
+// StaleCacheError is returned together with the last successfully listed pods
+// when the cache could not be refreshed.
+type StaleCacheError struct {
+	// The error which made the refresh fail.
+	Err error
+}
+
+func (e *StaleCacheError) Error() string {
+	return fmt.Sprintf("serving stale pods, failed to refresh docker cache: %v", e.Err)
+}
+
+// Unwrap returns the error which made the refresh fail.
+func (e *StaleCacheError) Unwrap() error {
+	return e.Err
+}
+
+// RefreshError is the error of a docker listing which failed to refresh the
+// cache.
+type RefreshError struct {
+	// The error returned by the listing.
+	Err error
+	// Age of the cached pods when the listing failed, zero if they were
+	// never listed.
+	CacheAge time.Duration
+}
+
+func (e *RefreshError) Error() string {
+	return fmt.Sprintf("listing pods failed with cached pods %v old: %v", e.CacheAge, e.Err)
+}
+
+// Unwrap returns the error returned by the listing.
+func (e *RefreshError) Unwrap() error {
+	return e.Err
+}
+
+// IsStaleCacheError returns true if err reports that stale pods were served.
+func IsStaleCacheError(err error) bool {
+	var staleErr *StaleCacheError
+	return errors.As(err, &staleErr)
+}
+
+// CircuitState is the state of the circuit breaker of a DockerCache.
+type CircuitState string
+
+const (
+	// CircuitClosed lets refreshes list docker.
+	CircuitClosed CircuitState = "closed"
+	// CircuitOpen skips refreshes, which fail with ErrCircuitOpen, until
+	// the cooldown elapses.
+	CircuitOpen CircuitState = "open"
+	// CircuitHalfOpen lets the next refresh probe docker: the circuit closes
+	// if it succeeds, and opens again if it fails.
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+// ChangeDetection is the granularity at which a DockerCache compares the pods
+// listed by a refresh with the cached ones. When they are equal, only the time
+// of the cached pods is bumped: they and their indexes are kept, and neither
+// subscribers nor refresh hooks are notified. A coarser granularity saves
+// rebuilding the indexes and notifying on every container transition, but the
+// cached pods keep the containers they had when they last changed at that
+// granularity.
+type ChangeDetection string
+
+const (
+	// ChangeDetectPodSet only detects the pods added or removed.
+	ChangeDetectPodSet ChangeDetection = "pod-set"
+	// ChangeDetectContainerIDs also detects the containers added to or
+	// removed from a pod, e.g. when one restarts.
+	ChangeDetectContainerIDs ChangeDetection = "container-ids"
+	// ChangeDetectContainerState also detects the state changes of the
+	// containers, e.g. when one exits.
+	ChangeDetectContainerState ChangeDetection = "container-state"
+)
+
+// DockerCacheStatus reports the outcome of the recent refreshes of a
+// DockerCache.
+type DockerCacheStatus struct {
+	// Time of the most recent successful refresh.
+	LastUpdated time.Time
+	// Error of the most recent refresh, nil if it succeeded.
+	LastError error
+	// Number of refreshes which failed since the last successful one.
+	ConsecutiveFailures int
+	// State of the circuit breaker, CircuitClosed if it is disabled.
+	CircuitState CircuitState
+}
+
+// TimestampedError is the error of a failed refresh and when it was recorded.
+type TimestampedError struct {
+	Time time.Time
+	Err  error
+}
+
+// MissedPod counts the lookups of a pod which a DockerCache didn't hold.
+type MissedPod struct {
+	UID types.UID
+	// Number of lookups since the pod was first missed.
+	Misses int
+	// Time of the most recent lookup.
+	LastMiss time.Time
+}
+
+// DockerCacheStats describes the content of a DockerCache.
+type DockerCacheStats struct {
+	// Number of cached pods.
+	PodCount int
+	// Number of containers in the cached pods.
+	ContainerCount int
+	// How long the most recent successful refresh took.
+	LastRefreshDuration time.Duration
+	// Time of the most recent successful refresh.
+	LastRefreshTime time.Time
 }
 
+// podsGetter is the narrowed interface the cache is refreshed from. Any
+// kubecontainer.Runtime satisfies it, so the cache is not tied to docker.
 type podsGetter interface {
 	GetPods(bool) ([]*kubecontainer.Pod, error)
 }
 
-func NewDockerCache(getter podsGetter) (DockerCache, error) {
-	return &dockerCache{
-		getter:        getter,
-		updatingCache: false,
-	}, nil
+var _ podsGetter = kubecontainer.Runtime(nil)
+
+const (
+	// defaultDockerCacheName names the caches configured without a name.
+	defaultDockerCacheName = "default"
+	// defaultSyncStalenessThreshold is how long cached pods are served
+	// before GetPods refreshes them synchronously.
+	defaultSyncStalenessThreshold = 2 * time.Second
+	// defaultRefreshInterval is the pause between two consecutive docker
+	// listings done by the background thread.
+	defaultRefreshInterval = 100 * time.Millisecond
+	// minRefreshInterval is the shortest pause the background thread takes
+	// between two listings, so that it never busy loops on docker.
+	minRefreshInterval = 10 * time.Millisecond
+	// defaultMinBackgroundInterval is the shortest pause the background
+	// thread takes between two listings unless configured otherwise.
+	defaultMinBackgroundInterval = 100 * time.Millisecond
+	// defaultIdleShutdownTimeout is how long the background thread keeps
+	// running after the last request.
+	defaultIdleShutdownTimeout = 2 * time.Second
+	// subscriberBufferSize is the number of snapshots buffered for each
+	// subscriber.
+	subscriberBufferSize = 4
+	// eventSubscriberBufferSize is the number of events buffered for each
+	// event subscriber.
+	eventSubscriberBufferSize = 64
+	// slowSubscriberWarningInterval is the minimum time between two
+	// warnings about the updates dropped for the same subscriber.
+	slowSubscriberWarningInterval = time.Minute
+	// defaultMaxRefreshBackoff caps the delay between two background
+	// refreshes while docker keeps failing.
+	defaultMaxRefreshBackoff = 30 * time.Second
+	// failureWarningThreshold is the number of consecutive failed refreshes
+	// after which a warning is logged.
+	failureWarningThreshold = 5
+	// failureWarningInterval is the minimum time between two such warnings.
+	failureWarningInterval = time.Minute
+	// missWarningThreshold is the number of lookups of a pod the cache
+	// doesn't hold within missWarningWindow after which a warning is
+	// logged, at most once per window and pod.
+	missWarningThreshold = 10
+	missWarningWindow    = time.Minute
+	// maxTrackedMisses is the number of missed pods whose lookups are
+	// counted, the least recently missed ones being forgotten.
+	maxTrackedMisses = 100
+	// defaultUnhealthyThreshold is how long refreshes may keep failing
+	// before the cache reports itself unhealthy, when MaxCacheAge is unset.
+	defaultUnhealthyThreshold = time.Minute
+	// defaultRemovedPodsCacheSize is how many removed pods are kept for
+	// GetRecentlyRemovedPod.
+	defaultRemovedPodsCacheSize = 50
+	// defaultRemovedPodTTL is how long removed pods are kept for
+	// GetRecentlyRemovedPod.
+	defaultRemovedPodTTL = time.Minute
+	// defaultCircuitBreakerCooldown is how long the circuit breaker stays
+	// open before probing docker.
+	defaultCircuitBreakerCooldown = 30 * time.Second
+	// defaultSnapshotInterval is the minimum time between two snapshots of
+	// the cached pods.
+	defaultSnapshotInterval = 30 * time.Second
+	// defaultSnapshotMaxAge is the age above which a snapshot is not loaded.
+	defaultSnapshotMaxAge = time.Minute
+	// defaultRecentErrorsSize is the number of refresh errors kept for
+	// RecentErrors.
+	defaultRecentErrorsSize = 16
+	// defaultSyncRefreshTimeout is how long reads wait for a synchronous
+	// refresh.
+	defaultSyncRefreshTimeout = 10 * time.Second
+)
+
+// DockerCacheConfig holds the tunables of a DockerCache. Fields left at their
+// zero value are replaced with the defaults.
+type DockerCacheConfig struct {
+	// Age of the cached pods above which a read refreshes them
+	// synchronously before returning them. It bounds how stale the pods
+	// returned to callers can be, while RefreshInterval sets how fresh the
+	// background thread keeps them. Setting it to several times the
+	// RefreshInterval, e.g. 5s with a 500ms interval, means that callers
+	// polling more often than IdleShutdownTimeout never wait for docker
+	// unless a background refresh is slow or failing.
+	SyncStalenessThreshold time.Duration
+	// How often the background thread refreshes the cache. Must be smaller
+	// than SyncStalenessThreshold and at least 10ms.
+	RefreshInterval time.Duration
+	// Shortest pause the background thread takes between two listings,
+	// even when the jitter shortens the RefreshInterval. Raising it, e.g.
+	// to 1s, bounds how often docker is listed however often the cache is
+	// read, at the cost of serving pods up to that old. Must be at least
+	// 10ms and smaller than SyncStalenessThreshold. Defaults to 100ms, or
+	// 10ms if SyncStalenessThreshold is not longer than that.
+	MinBackgroundInterval time.Duration
+	// How long the background thread keeps refreshing the cache after the
+	// last request. Callers polling less often than that find the thread
+	// stopped and pay for a synchronous refresh whenever the cache is older
+	// than SyncStalenessThreshold, so it should be larger than the poll
+	// period of the slowest regular caller.
+	IdleShutdownTimeout time.Duration
+	// Upper bound of the exponentially growing delay between background
+	// refreshes while they keep failing.
+	MaxRefreshBackoff time.Duration
+	// How old the cached pods may get while docker keeps failing before
+	// they are no longer served, and ErrCacheTooStale is returned instead.
+	// Zero disables the limit. A minute is a reasonable value in production,
+	// so that callers don't act on pods which have long changed.
+	MaxCacheAge time.Duration
+	// How long a read waits for a synchronous refresh before serving the
+	// cached pods with ErrSyncRefreshTimeout. The listing keeps running
+	// without the cache locked, and its result is stored whenever docker
+	// answers. Defaults to 10 seconds.
+	SyncRefreshTimeout time.Duration
+	// How long Stop waits for the refreshes in flight to return. Their
+	// listings are dropped either way, but a refresh may be blocked in a
+	// callback, such as OnError. Defaults to waiting indefinitely.
+	StopTimeout time.Duration
+	// How long refreshes may keep failing before Healthy returns an error.
+	// Defaults to MaxCacheAge if set, and to a minute otherwise.
+	UnhealthyThreshold time.Duration
+	// Maximum number of pods no longer listed by docker which are kept for
+	// GetRecentlyRemovedPod. Defaults to 50.
+	RemovedPodsCacheSize int
+	// How long pods no longer listed by docker are kept for
+	// GetRecentlyRemovedPod. Defaults to a minute.
+	RemovedPodTTL time.Duration
+	// Number of consecutive failed refreshes after which the circuit
+	// breaker opens: refreshes then fail right away with ErrCircuitOpen,
+	// the cached pods being served, until CircuitBreakerCooldown elapses and
+	// a single refresh probes docker. Zero disables the circuit breaker.
+	CircuitBreakerThreshold int
+	// How long the circuit breaker stays open before probing docker.
+	// Defaults to 30 seconds.
+	CircuitBreakerCooldown time.Duration
+	// Number of the most recent refresh errors kept for RecentErrors.
+	// Defaults to 16.
+	RecentErrorsSize int
+	// Granularity at which the pods listed by a refresh are compared with
+	// the cached ones, both to skip the refreshes which didn't change them
+	// and to find the modified pods of the events. Defaults to
+	// ChangeDetectContainerState.
+	ChangeDetection ChangeDetection
+	// Reports whether a refresh listed the same pods as the cache already
+	// holds, in which case the cached pods and their indexes are kept and
+	// the subscribers are not notified. Overrides ChangeDetection for that
+	// purpose if set.
+	EqualsFn func(old, pods []*kubecontainer.Pod) bool
+	// Fraction of the delay between two background refreshes by which it
+	// is randomly shortened or lengthened, so that caches started together
+	// don't all list docker at the same time. Must be in [0, 1). Defaults
+	// to no jitter.
+	JitterFactor float64
+	// Minimum delay between two background refreshes as a multiple of how
+	// long the last one took, so that a slow docker daemon is not listed
+	// back to back. E.g. with a factor of 2, refreshes taking 300ms are
+	// spaced by at least 600ms whatever the RefreshInterval. Defaults to
+	// no adaptation.
+	LatencyFactor float64
+	// Never start the background thread, so that the cache only refreshes
+	// synchronously when its pods are older than SyncStalenessThreshold or
+	// when forced.
+	DisableBackgroundRefresh bool
+	// Start listing docker when the cache is created, so that the first
+	// read likely finds the pods loaded, or shares the listing in flight.
+	WarmOnStart bool
+	// Make the reads of a cache which never loaded its pods, or was reset,
+	// return right away instead of waiting for docker: the pods are then
+	// empty, and the error a *StaleCacheError for ErrCacheWarming, while
+	// they are loaded in the background.
+	NonBlockingFirstRead bool
+	// Persists the cached pods, if set: the cache saves them at most every
+	// SnapshotInterval, and when stopped, and starts with the pods of the
+	// snapshot unless they are older than SnapshotMaxAge. Reads still list
+	// docker once these pods are older than SyncStalenessThreshold, but
+	// those tolerating older pods, like GetPodsMaxStale or a read-only
+	// view, are served right away.
+	SnapshotStore SnapshotStore
+	// Minimum time between two snapshots of the cached pods. Defaults to 30
+	// seconds.
+	SnapshotInterval time.Duration
+	// Age above which a snapshot is discarded instead of loaded. Defaults
+	// to a minute.
+	SnapshotMaxAge time.Duration
+	// Window after a ForceUpdate during which further ForceUpdate calls
+	// don't list docker again, but return the outcome of that refresh, so
+	// that bursts of forced refreshes collapse. Defaults to no debouncing.
+	ForceUpdateDebounce time.Duration
+	// Maximum number of cached pods. When more pods are listed, only the
+	// most recently created ones are kept. The kubelet normally runs far
+	// fewer pods, so reaching it means that the node is misconfigured.
+	// Defaults to no limit.
+	MaxPods int
+	// Deduplicate the namespaces and images of the pods listed by every
+	// refresh, which are shared by many containers on dense nodes, so that
+	// the cache holds a single copy of each.
+	InternStrings bool
+	// Called with the error of every failed refresh, and with
+	// ErrDaemonRestartDetected, if set. It is called without holding any
+	// lock of the cache, so it may use the cache.
+	//
+	// Deprecated. Please use Observers, whose RefreshFailed is called with
+	// the error of every failed docker listing.
+	OnError func(err error)
+	// Called, if set, with the raw result of every docker listing and how
+	// long it took, e.g. for auditing. It is notified as an observer, after
+	// the Observers: the pods of a failed listing are dropped, and must not
+	// be modified.
+	Tap func(pods []*kubecontainer.Pod, err error, duration time.Duration)
+	// Notified, in order, of every docker listing and eviction.
+	Observers []CacheObserver
+	// Looks up a single pod in docker, if set. GetPodByUID calls it when the
+	// pod is not cached and merges the pod it returns into the cache, so
+	// that cold misses don't list all the pods, and so does ForceUpdatePod.
+	// It must return a nil pod if there is no such pod. It is called
+	// without the cache locked, so reads don't wait for it.
+	SinglePodGetter func(uid types.UID) (*kubecontainer.Pod, error)
+	// Source of the current time. Defaults to the real clock.
+	Clock util.Clock
+	// Name of the cache, labelling its metrics and log lines so that several
+	// caches in a process can be told apart. Defaults to "default".
+	Name string
+}
+
+// DefaultDockerCacheConfig returns the configuration of a cache with all the
+// defaults, which callers and tests can adjust with the With methods.
+func DefaultDockerCacheConfig() DockerCacheConfig {
+	return DockerCacheConfig{
+		SyncStalenessThreshold: defaultSyncStalenessThreshold,
+		RefreshInterval:        defaultRefreshInterval,
+		IdleShutdownTimeout:    defaultIdleShutdownTimeout,
+		MaxRefreshBackoff:      defaultMaxRefreshBackoff,
+		Clock:                  util.RealClock{},
+	}
+}
+
+// WithSyncStalenessThreshold returns a copy of c with SyncStalenessThreshold set.
+func (c DockerCacheConfig) WithSyncStalenessThreshold(d time.Duration) DockerCacheConfig {
+	c.SyncStalenessThreshold = d
+	return c
+}
+
+// WithRefreshInterval returns a copy of c with RefreshInterval set.
+func (c DockerCacheConfig) WithRefreshInterval(d time.Duration) DockerCacheConfig {
+	c.RefreshInterval = d
+	return c
+}
+
+// WithMinBackgroundInterval returns a copy of c with MinBackgroundInterval
+// set.
+func (c DockerCacheConfig) WithMinBackgroundInterval(d time.Duration) DockerCacheConfig {
+	c.MinBackgroundInterval = d
+	return c
+}
+
+// WithIdleShutdownTimeout returns a copy of c with IdleShutdownTimeout set.
+func (c DockerCacheConfig) WithIdleShutdownTimeout(d time.Duration) DockerCacheConfig {
+	c.IdleShutdownTimeout = d
+	return c
+}
+
+// WithMaxRefreshBackoff returns a copy of c with MaxRefreshBackoff set.
+func (c DockerCacheConfig) WithMaxRefreshBackoff(d time.Duration) DockerCacheConfig {
+	c.MaxRefreshBackoff = d
+	return c
+}
+
+// WithMaxCacheAge returns a copy of c with MaxCacheAge set.
+func (c DockerCacheConfig) WithMaxCacheAge(d time.Duration) DockerCacheConfig {
+	c.MaxCacheAge = d
+	return c
+}
+
+// WithSyncRefreshTimeout returns a copy of c with SyncRefreshTimeout set.
+func (c DockerCacheConfig) WithSyncRefreshTimeout(d time.Duration) DockerCacheConfig {
+	c.SyncRefreshTimeout = d
+	return c
+}
+
+// WithStopTimeout returns a copy of c with StopTimeout set.
+func (c DockerCacheConfig) WithStopTimeout(d time.Duration) DockerCacheConfig {
+	c.StopTimeout = d
+	return c
+}
+
+// WithUnhealthyThreshold returns a copy of c with UnhealthyThreshold set.
+func (c DockerCacheConfig) WithUnhealthyThreshold(d time.Duration) DockerCacheConfig {
+	c.UnhealthyThreshold = d
+	return c
+}
+
+// WithRemovedPodsCacheSize returns a copy of c with RemovedPodsCacheSize set.
+func (c DockerCacheConfig) WithRemovedPodsCacheSize(size int) DockerCacheConfig {
+	c.RemovedPodsCacheSize = size
+	return c
+}
+
+// WithRemovedPodTTL returns a copy of c with RemovedPodTTL set.
+func (c DockerCacheConfig) WithRemovedPodTTL(d time.Duration) DockerCacheConfig {
+	c.RemovedPodTTL = d
+	return c
+}
+
+// WithCircuitBreakerThreshold returns a copy of c with CircuitBreakerThreshold
+// set.
+func (c DockerCacheConfig) WithCircuitBreakerThreshold(failures int) DockerCacheConfig {
+	c.CircuitBreakerThreshold = failures
+	return c
+}
+
+// WithCircuitBreakerCooldown returns a copy of c with CircuitBreakerCooldown
+// set.
+func (c DockerCacheConfig) WithCircuitBreakerCooldown(d time.Duration) DockerCacheConfig {
+	c.CircuitBreakerCooldown = d
+	return c
+}
+
+// WithRecentErrorsSize returns a copy of c with RecentErrorsSize set.
+func (c DockerCacheConfig) WithRecentErrorsSize(size int) DockerCacheConfig {
+	c.RecentErrorsSize = size
+	return c
+}
+
+// WithChangeDetection returns a copy of c with ChangeDetection set.
+func (c DockerCacheConfig) WithChangeDetection(level ChangeDetection) DockerCacheConfig {
+	c.ChangeDetection = level
+	return c
+}
+
+// WithEqualsFn returns a copy of c with EqualsFn set.
+func (c DockerCacheConfig) WithEqualsFn(fn func(old, pods []*kubecontainer.Pod) bool) DockerCacheConfig {
+	c.EqualsFn = fn
+	return c
+}
+
+// WithJitterFactor returns a copy of c with JitterFactor set.
+func (c DockerCacheConfig) WithJitterFactor(factor float64) DockerCacheConfig {
+	c.JitterFactor = factor
+	return c
+}
+
+// WithLatencyFactor returns a copy of c with LatencyFactor set.
+func (c DockerCacheConfig) WithLatencyFactor(factor float64) DockerCacheConfig {
+	c.LatencyFactor = factor
+	return c
+}
+
+// WithDisableBackgroundRefresh returns a copy of c with DisableBackgroundRefresh set.
+func (c DockerCacheConfig) WithDisableBackgroundRefresh(disable bool) DockerCacheConfig {
+	c.DisableBackgroundRefresh = disable
+	return c
+}
+
+// WithWarmOnStart returns a copy of c with WarmOnStart set.
+func (c DockerCacheConfig) WithWarmOnStart(warm bool) DockerCacheConfig {
+	c.WarmOnStart = warm
+	return c
+}
+
+// WithNonBlockingFirstRead returns a copy of c with NonBlockingFirstRead set.
+func (c DockerCacheConfig) WithNonBlockingFirstRead(nonBlocking bool) DockerCacheConfig {
+	c.NonBlockingFirstRead = nonBlocking
+	return c
+}
+
+// WithSnapshotStore returns a copy of c with SnapshotStore set.
+func (c DockerCacheConfig) WithSnapshotStore(store SnapshotStore) DockerCacheConfig {
+	c.SnapshotStore = store
+	return c
+}
+
+// WithSnapshotInterval returns a copy of c with SnapshotInterval set.
+func (c DockerCacheConfig) WithSnapshotInterval(d time.Duration) DockerCacheConfig {
+	c.SnapshotInterval = d
+	return c
+}
+
+// WithSnapshotMaxAge returns a copy of c with SnapshotMaxAge set.
+func (c DockerCacheConfig) WithSnapshotMaxAge(d time.Duration) DockerCacheConfig {
+	c.SnapshotMaxAge = d
+	return c
+}
+
+// WithForceUpdateDebounce returns a copy of c with ForceUpdateDebounce set.
+func (c DockerCacheConfig) WithForceUpdateDebounce(d time.Duration) DockerCacheConfig {
+	c.ForceUpdateDebounce = d
+	return c
+}
+
+// WithMaxPods returns a copy of c with MaxPods set.
+func (c DockerCacheConfig) WithMaxPods(max int) DockerCacheConfig {
+	c.MaxPods = max
+	return c
+}
+
+// WithInternStrings returns a copy of c with InternStrings set.
+func (c DockerCacheConfig) WithInternStrings(intern bool) DockerCacheConfig {
+	c.InternStrings = intern
+	return c
+}
+
+// WithTap returns a copy of c with Tap set.
+func (c DockerCacheConfig) WithTap(fn func(pods []*kubecontainer.Pod, err error, duration time.Duration)) DockerCacheConfig {
+	c.Tap = fn
+	return c
+}
+
+// WithObservers returns a copy of c with Observers set.
+func (c DockerCacheConfig) WithObservers(observers ...CacheObserver) DockerCacheConfig {
+	c.Observers = observers
+	return c
+}
+
+// WithOnError returns a copy of c with OnError set.
+func (c DockerCacheConfig) WithOnError(fn func(err error)) DockerCacheConfig {
+	c.OnError = fn
+	return c
+}
+
+// WithSinglePodGetter returns a copy of c with SinglePodGetter set.
+func (c DockerCacheConfig) WithSinglePodGetter(fn func(uid types.UID) (*kubecontainer.Pod, error)) DockerCacheConfig {
+	c.SinglePodGetter = fn
+	return c
+}
+
+// WithClock returns a copy of c with Clock set.
+func (c DockerCacheConfig) WithClock(clock util.Clock) DockerCacheConfig {
+	c.Clock = clock
+	return c
+}
+
+// WithName returns a copy of c with Name set.
+func (c DockerCacheConfig) WithName(name string) DockerCacheConfig {
+	c.Name = name
+	return c
+}
+
+// NewDockerCacheDefault returns a cache with the default configuration.
+func NewDockerCacheDefault(getter podsGetter) (DockerCache, error) {
+	return NewDockerCache(getter, DefaultDockerCacheConfig())
+}
+
+func NewDockerCache(getter podsGetter, config DockerCacheConfig) (DockerCache, error) {
+	if getter == nil {
+		return nil, errors.New("dockerCache: getter must not be nil")
+	}
+	if config.SyncStalenessThreshold == 0 {
+		config.SyncStalenessThreshold = defaultSyncStalenessThreshold
+	}
+	if config.RefreshInterval == 0 {
+		config.RefreshInterval = defaultRefreshInterval
+	}
+	if config.MinBackgroundInterval == 0 {
+		config.MinBackgroundInterval = defaultMinBackgroundInterval
+		if config.SyncStalenessThreshold <= defaultMinBackgroundInterval {
+			config.MinBackgroundInterval = minRefreshInterval
+		}
+	}
+	if config.IdleShutdownTimeout == 0 {
+		config.IdleShutdownTimeout = defaultIdleShutdownTimeout
+	}
+	if config.MaxRefreshBackoff == 0 {
+		config.MaxRefreshBackoff = defaultMaxRefreshBackoff
+	}
+	if config.UnhealthyThreshold == 0 {
+		config.UnhealthyThreshold = config.MaxCacheAge
+	}
+	if config.UnhealthyThreshold == 0 {
+		config.UnhealthyThreshold = defaultUnhealthyThreshold
+	}
+	if config.RemovedPodsCacheSize == 0 {
+		config.RemovedPodsCacheSize = defaultRemovedPodsCacheSize
+	}
+	if config.RemovedPodTTL == 0 {
+		config.RemovedPodTTL = defaultRemovedPodTTL
+	}
+	if config.SyncRefreshTimeout == 0 {
+		config.SyncRefreshTimeout = defaultSyncRefreshTimeout
+	}
+	if config.CircuitBreakerCooldown == 0 {
+		config.CircuitBreakerCooldown = defaultCircuitBreakerCooldown
+	}
+	if config.SnapshotInterval == 0 {
+		config.SnapshotInterval = defaultSnapshotInterval
+	}
+	if config.SnapshotMaxAge == 0 {
+		config.SnapshotMaxAge = defaultSnapshotMaxAge
+	}
+	if config.RecentErrorsSize == 0 {
+		config.RecentErrorsSize = defaultRecentErrorsSize
+	}
+	if config.ChangeDetection == "" {
+		config.ChangeDetection = ChangeDetectContainerState
+	}
+	if config.EqualsFn == nil {
+		level := config.ChangeDetection
+		config.EqualsFn = func(old, pods []*kubecontainer.Pod) bool {
+			return podsEqualAt(level, old, pods)
+		}
+	}
+	if config.Clock == nil {
+		config.Clock = util.RealClock{}
+	}
+	if config.Name == "" {
+		config.Name = defaultDockerCacheName
+	}
+	if config.RefreshInterval < minRefreshInterval {
+		return nil, fmt.Errorf("refresh interval %v must be at least %v", config.RefreshInterval, minRefreshInterval)
+	}
+	if config.RefreshInterval >= config.SyncStalenessThreshold {
+		return nil, fmt.Errorf("refresh interval %v must be smaller than sync staleness threshold %v", config.RefreshInterval, config.SyncStalenessThreshold)
+	}
+	if config.MinBackgroundInterval < minRefreshInterval {
+		return nil, fmt.Errorf("min background interval %v must be at least %v", config.MinBackgroundInterval, minRefreshInterval)
+	}
+	if config.MinBackgroundInterval >= config.SyncStalenessThreshold {
+		return nil, fmt.Errorf("min background interval %v must be smaller than sync staleness threshold %v", config.MinBackgroundInterval, config.SyncStalenessThreshold)
+	}
+	if config.MaxRefreshBackoff < config.RefreshInterval {
+		return nil, fmt.Errorf("max refresh backoff %v must not be smaller than refresh interval %v", config.MaxRefreshBackoff, config.RefreshInterval)
+	}
+	if config.ForceUpdateDebounce < 0 {
+		return nil, fmt.Errorf("force update debounce %v must not be negative", config.ForceUpdateDebounce)
+	}
+	if config.MaxPods < 0 {
+		return nil, fmt.Errorf("max pods %d must not be negative", config.MaxPods)
+	}
+	if config.JitterFactor < 0 || config.JitterFactor >= 1 {
+		return nil, fmt.Errorf("jitter factor %v must be in [0, 1)", config.JitterFactor)
+	}
+	if config.RemovedPodsCacheSize < 0 {
+		return nil, fmt.Errorf("removed pods cache size %d must not be negative", config.RemovedPodsCacheSize)
+	}
+	if config.RemovedPodTTL < 0 {
+		return nil, fmt.Errorf("removed pod TTL %v must not be negative", config.RemovedPodTTL)
+	}
+	if config.UnhealthyThreshold < 0 {
+		return nil, fmt.Errorf("unhealthy threshold %v must not be negative", config.UnhealthyThreshold)
+	}
+	switch config.ChangeDetection {
+	case ChangeDetectPodSet, ChangeDetectContainerIDs, ChangeDetectContainerState:
+	default:
+		return nil, fmt.Errorf("unknown change detection %q", config.ChangeDetection)
+	}
+	if config.RecentErrorsSize < 0 {
+		return nil, fmt.Errorf("recent errors size %d must not be negative", config.RecentErrorsSize)
+	}
+	if config.CircuitBreakerThreshold < 0 {
+		return nil, fmt.Errorf("circuit breaker threshold %d must not be negative", config.CircuitBreakerThreshold)
+	}
+	if config.CircuitBreakerCooldown < 0 {
+		return nil, fmt.Errorf("circuit breaker cooldown %v must not be negative", config.CircuitBreakerCooldown)
+	}
+	if config.SyncRefreshTimeout < 0 {
+		return nil, fmt.Errorf("sync refresh timeout %v must not be negative", config.SyncRefreshTimeout)
+	}
+	if config.SnapshotInterval < 0 {
+		return nil, fmt.Errorf("snapshot interval %v must not be negative", config.SnapshotInterval)
+	}
+	if config.SnapshotMaxAge < 0 {
+		return nil, fmt.Errorf("snapshot max age %v must not be negative", config.SnapshotMaxAge)
+	}
+	if config.StopTimeout < 0 {
+		return nil, fmt.Errorf("stop timeout %v must not be negative", config.StopTimeout)
+	}
+	if config.LatencyFactor < 0 {
+		return nil, fmt.Errorf("latency factor %v must not be negative", config.LatencyFactor)
+	}
+	if config.MaxCacheAge != 0 && config.MaxCacheAge < config.SyncStalenessThreshold {
+		return nil, fmt.Errorf("max cache age %v must not be smaller than sync staleness threshold %v", config.MaxCacheAge, config.SyncStalenessThreshold)
+	}
+	observers := append([]CacheObserver(nil), config.Observers...)
+	if config.Tap != nil {
+		observers = append(observers, tapObserver{tap: config.Tap})
+	}
+	d := &dockerCache{
+		name:                   config.Name,
+		getter:                 getter,
+		syncStalenessThreshold: config.SyncStalenessThreshold,
+		refreshInterval:        config.RefreshInterval,
+		minBackgroundInterval:  config.MinBackgroundInterval,
+		idleTimeout:            config.IdleShutdownTimeout,
+		maxBackoff:             config.MaxRefreshBackoff,
+		maxCacheAge:            config.MaxCacheAge,
+		unhealthyThreshold:     config.UnhealthyThreshold,
+		removedPodsCacheSize:   config.RemovedPodsCacheSize,
+		removedPodTTL:          config.RemovedPodTTL,
+		circuitThreshold:       config.CircuitBreakerThreshold,
+		circuitCooldown:        config.CircuitBreakerCooldown,
+		recentErrors:           make([]TimestampedError, 0, config.RecentErrorsSize),
+		removedPods:            lru.New(config.RemovedPodsCacheSize),
+		equalsFn:               config.EqualsFn,
+		changeDetection:        config.ChangeDetection,
+		onError:                config.OnError,
+		observers:              observers,
+		singlePodGetter:        config.SinglePodGetter,
+		jitterFactor:           config.JitterFactor,
+		latencyFactor:          config.LatencyFactor,
+		maxPods:                config.MaxPods,
+		internStrings:          config.InternStrings,
+		forceUpdateDebounce:    config.ForceUpdateDebounce,
+		syncRefreshTimeout:     config.SyncRefreshTimeout,
+		stopTimeout:            config.StopTimeout,
+		disableBackground:      config.DisableBackgroundRefresh,
+		nonBlockingFirstRead:   config.NonBlockingFirstRead,
+		snapshotStore:          config.SnapshotStore,
+		snapshotInterval:       config.SnapshotInterval,
+		snapshotMaxAge:         config.SnapshotMaxAge,
+		random:                 rand.Float64,
+		clock:                  config.Clock,
+		updatingCache:          false,
+		subscribers:            make(map[int]*podsSubscriber),
+		eventSubscribers:       make(map[int]*eventSubscriber),
+		stopCh:                 make(chan struct{}),
+	}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	if d.snapshotStore != nil {
+		d.lock.Lock()
+		d.loadSnapshot()
+		d.lock.Unlock()
+	}
+	if config.WarmOnStart {
+		d.lock.Lock()
+		d.startRefresh()
+		d.lock.Unlock()
+	}
+	return d, nil
+}
+
+// readOnlyView is the DockerCacheView of a dockerCache.
+type readOnlyView struct {
+	d *dockerCache
+}
+
+func (v readOnlyView) GetPods() ([]*kubecontainer.Pod, error) {
+	v.d.lock.Lock()
+	defer v.d.lock.Unlock()
+	if v.d.stopped {
+		return nil, ErrCacheStopped
+	}
+	// The view never refreshes the pods, but doesn't serve them past the
+	// max cache age either.
+	if !v.d.cacheTime.IsZero() && v.d.tooStale(v.d.cacheTime) {
+		return nil, ErrCacheTooStale
+	}
+	return copyPods(v.d.pods), nil
+}
+
+func (v readOnlyView) LastUpdated() time.Time {
+	return v.d.LastUpdated()
+}
+
+// refreshHook is a function registered with OnRefresh.
+type refreshHook struct {
+	id int
+	fn func(pods []*kubecontainer.Pod, asOf time.Time)
+}
+
+// pendingRefresh is a change of the cached pods to hand to the refresh hooks.
+type pendingRefresh struct {
+	pods []*kubecontainer.Pod
+	asOf time.Time
 }
 
 // dockerCache is a default implementation of DockerCache interface
-// TODO(yifan): Use runtime cache to replace this.
 type dockerCache struct {
+	// Name labelling the metrics and log lines of the cache.
+	name string
 	// The narrowed interface for updating the cache.
 	getter podsGetter
+	// Age above which reads refresh the cached pods synchronously.
+	syncStalenessThreshold time.Duration
+	// Pause between two refreshes done by the background thread.
+	refreshInterval time.Duration
+	// Shortest pause between two refreshes done by the background thread.
+	minBackgroundInterval time.Duration
+	// How long the background thread keeps running after the last request.
+	idleTimeout time.Duration
+	// Upper bound of the delay between failing background refreshes.
+	maxBackoff time.Duration
+	// Age above which the cached pods are no longer served, zero if unlimited.
+	maxCacheAge time.Duration
+	// How long refreshes may keep failing before the cache is unhealthy.
+	unhealthyThreshold time.Duration
+	// How many removed pods are kept, and for how long.
+	removedPodsCacheSize int
+	removedPodTTL        time.Duration
+	// Consecutive failures opening the circuit breaker, zero if disabled,
+	// and how long it stays open.
+	circuitThreshold int
+	circuitCooldown  time.Duration
+	// Reports whether a refresh left the cached pods unchanged.
+	equalsFn func(old, pods []*kubecontainer.Pod) bool
+	// Granularity at which modified pods are detected.
+	changeDetection ChangeDetection
+	// Called with the error of every failed refresh, nil if unset.
+	onError func(err error)
+	// Notified of every docker listing and eviction.
+	observers []CacheObserver
+	// Looks up a pod missing from the cache, nil if unset.
+	singlePodGetter func(uid types.UID) (*kubecontainer.Pod, error)
+	// Fraction of the delay between background refreshes randomly added or
+	// removed.
+	jitterFactor float64
+	// Minimum delay between background refreshes as a multiple of their
+	// duration, zero if the delay doesn't depend on it.
+	latencyFactor float64
+	// Source of randomness for the jitter, returning values in [0, 1).
+	random func() float64
+	// Maximum number of cached pods, zero if unlimited.
+	maxPods int
+	// Whether the strings shared by the listed pods are deduplicated.
+	internStrings bool
+	// Window during which a ForceUpdate is not repeated.
+	forceUpdateDebounce time.Duration
+	// How long reads wait for a synchronous refresh.
+	syncRefreshTimeout time.Duration
+	// How long Stop waits for the refreshes in flight, zero if indefinitely.
+	stopTimeout time.Duration
+	// Whether the background thread is never started.
+	disableBackground bool
+	// Whether reads load an empty cache in the background, not waiting.
+	nonBlockingFirstRead bool
+	// Where the cached pods are persisted, if set, how often, and up to
+	// which age they are loaded back.
+	snapshotStore    SnapshotStore
+	snapshotInterval time.Duration
+	snapshotMaxAge   time.Duration
+	// Source of the current time.
+	clock util.Clock
+	// Context of the background thread, cancelled by Stop.
+	ctx    context.Context
+	cancel context.CancelFunc
 	// Mutex protecting all of the following fields.
 	lock sync.Mutex
 	// Last time when cache was updated.
 	cacheTime time.Time
 	// The content of the cache.
 	pods []*kubecontainer.Pod
+	// The content of the cache indexed by pod UID.
+	podsByUID map[types.UID]*kubecontainer.Pod
+	// Lookups of the pods missing from the cache, nil until the first one.
+	misses *missTracker
+	// The last seen containers of the cached pods, by pod UID and
+	// container name, and how many times they were replaced.
+	podRestarts map[types.UID]map[string]containerRestarts
+	// List time of the pods last saved to or loaded from snapshotStore.
+	lastSnapshot time.Time
+	// Number of changes of the cached pods so far.
+	generation uint64
+	// The generation at which each cached pod last changed, indexed by UID.
+	podGenerations map[types.UID]uint64
+	// The most recently removed pods, as removedPod indexed by UID.
+	removedPods *lru.Cache
+	// The content of the cache indexed by namespace.
+	podsByNamespace map[string][]*kubecontainer.Pod
+	// The location of the cached containers in pods, indexed by container ID.
+	containersByID map[types.UID]containerIndex
+	// The location of the cached containers in pods, indexed by image.
+	containersByImage map[string][]containerIndex
+	// Number of containers in the cached pods.
+	containerCount int
+	// How long the most recent successful refresh took.
+	lastRefreshDuration time.Duration
+	// Last time when the pods including non-running containers were updated.
+	allPodsTime time.Time
+	// The pods including non-running containers.
+	allPods []*kubecontainer.Pod
+	// The statuses derived from allPods so far, indexed by pod UID.
+	podStatuses map[types.UID]*kubecontainer.PodStatus
+	// The states of the containers in allPods and when they were first
+	// observed, indexed by container ID.
+	containerStates map[types.UID]containerObservation
+	// Time since GetAllPods was last called, until which the background
+	// thread also refreshes allPods.
+	allPodsIdle idleTimer
+	// UIDs of the pods evicted since the last refresh.
+	evictedPods map[types.UID]bool
+	// Error of the most recent refresh, nil if it succeeded.
+	lastError error
+	// Number of refreshes which failed since the last successful one.
+	consecutiveFailures int
+	// Time of the first of these failures.
+	firstFailureTime time.Time
+	// When the circuit breaker last opened, zero while it is closed.
+	circuitOpenedAt time.Time
+	// Ring buffer of the most recent refresh errors, filled up to its
+	// capacity, and the index of the oldest one once it is full.
+	recentErrors    []TimestampedError
+	nextRecentError int
+	// Time of the most recent failed refresh.
+	lastFailureTime time.Time
+	// Time and outcome of the most recent forced refresh.
+	lastForceUpdate      time.Time
+	lastForceUpdateError error
+	// Closed once the debounced forced refresh in flight, if any, recorded
+	// its outcome.
+	forceUpdateDone chan struct{}
+	// Failures not handed to onError yet.
+	pendingErrors []error
+	// Evicted pods not handed to the observers yet.
+	pendingEvictions []types.UID
+	// Registered refresh hooks, in registration order.
+	refreshHooks []refreshHook
+	// Latest change of the pods not handed to the refresh hooks yet.
+	pendingRefresh *pendingRefresh
+	// Whether a caller is running the refresh hooks.
+	runningHooks bool
+	// Last time a warning about the consecutive failures was logged.
+	lastFailureWarning time.Time
+	// Current delay between two background refreshes.
+	backoff time.Duration
+	// Whether docker is being listed, by the background thread or for a
+	// synchronous refresh.
+	refreshing bool
+	// Outcome of the listing in flight while refreshing, or of the last
+	// one.
+	refresh *refreshResult
+	// Like refreshing and refresh, for the listings of all the pods.
+	allRefreshing bool
+	allRefresh    *refreshResult
+	// Whether the cache was reset and not loaded since, in which case the
+	// background thread exits without listing docker.
+	reset bool
 	// Whether the background thread updating the cache is running.
 	updatingCache bool
-	// Time when the background thread should be stopped.
-	updatingThreadStopTime time.Time
+	// Number of background threads running, updated atomically. Anything
+	// above 1 means that updatingCache failed to guard their start.
+	updaterGoroutines int32
+	// Number of docker listings in flight, updated atomically, including
+	// those whose refresh was canceled, until the getter returns.
+	listingGoroutines int32
+	// Time since the pods were last read, after which the background thread
+	// is stopped.
+	podsIdle idleTimer
+	// The subscribers, keyed by subscription ID.
+	subscribers map[int]*podsSubscriber
+	// The event subscribers, keyed by subscription ID.
+	eventSubscribers map[int]*eventSubscriber
+	// ID of the next subscription.
+	nextSubscriberID int
+	// Whether the cache is paused, in which case only explicit refreshes
+	// list docker.
+	paused bool
+	// Whether Stop has been called.
+	stopped bool
+	// Closed by Stop to terminate the background thread.
+	stopCh chan struct{}
+	// Guards against closing stopCh twice.
+	stopOnce sync.Once
+	// Tracks the background thread so that Stop can wait for it.
+	updater sync.WaitGroup
 }
 
 // Ensure that dockerCache abides by the DockerCache interface.
 var _ DockerCache = new(dockerCache)
 
+// GetPods returns the cached pods, refreshing them first if they are older
+// than the sync staleness threshold. If the refresh fails, the last
+// successfully listed pods are returned along with a *StaleCacheError, and
+// whatever pods the failed listing produced are discarded. The pods are
+// sorted by UID.
 func (d *dockerCache) GetPods() ([]*kubecontainer.Pod, error) {
+	return d.GetPodsWithContext(context.Background())
+}
+
+func (d *dockerCache) GetPodsWithContext(ctx context.Context) ([]*kubecontainer.Pod, error) {
+	pods, _, err := d.getPodsSnapshot(ctx)
+	return pods, err
+}
+
+func (d *dockerCache) GetPodsSnapshot() ([]*kubecontainer.Pod, time.Time, error) {
+	return d.getPodsSnapshot(context.Background())
+}
+
+// getPodsSnapshot returns the cached pods, refreshing them first if they are
+// stale, and the time they were listed at.
+func (d *dockerCache) getPodsSnapshot(ctx context.Context) ([]*kubecontainer.Pod, time.Time, error) {
+	defer d.runCallbacks()
 	d.lock.Lock()
 	defer d.lock.Unlock()
-	if time.Since(d.cacheTime) > 2*time.Second {
-		pods, err := d.getter.GetPods(false)
-		if err != nil {
-			return pods, err
+	err := d.updateIfStale(ctx)
+	if withholdsPods(err) || (err != nil && err == ctx.Err()) {
+		return nil, time.Time{}, err
+	}
+	return copyPods(d.pods), d.cacheTime, err
+}
+
+func (d *dockerCache) GetPodsTimed() ([]*kubecontainer.Pod, bool, time.Duration, error) {
+	defer d.runCallbacks()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	start := d.clock.Now()
+	refreshed, err := d.updateIfStaleRefreshed(context.Background())
+	var dur time.Duration
+	if refreshed {
+		dur = d.clock.Since(start)
+	}
+	if withholdsPods(err) {
+		return nil, refreshed, dur, err
+	}
+	return copyPods(d.pods), refreshed, dur, err
+}
+
+func (d *dockerCache) GetPodsStrict() ([]*kubecontainer.Pod, error) {
+	defer d.runCallbacks()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	err := d.updateIfStale(context.Background())
+	// Don't serve the empty pods while the first refresh runs in the
+	// background, wait for it.
+	if IsCacheWarming(err) {
+		if updateErr := d.updateCache(context.Background()); updateErr != nil {
+			err = d.staleError(updateErr)
+		} else {
+			err = nil
 		}
-		d.pods = pods
-		d.cacheTime = time.Now()
 	}
-	// Stop refreshing thread if there were no requests within last 2 seconds.
-	d.updatingThreadStopTime = time.Now().Add(time.Duration(2) * time.Second)
-	if !d.updatingCache {
-		d.updatingCache = true
-		go d.startUpdatingCache()
+	if err == ErrCacheStopped {
+		return nil, err
+	}
+	if d.cacheTime.IsZero() {
+		return nil, ErrCacheUninitialized
+	}
+	if withholdsPods(err) {
+		return nil, err
 	}
-	return d.pods, nil
+	return copyPods(d.pods), err
 }
 
-func (d *dockerCache) ForceUpdateIfOlder(minExpectedCacheTime time.Time) error {
+func (d *dockerCache) Range(fn func(pod *kubecontainer.Pod) bool) error {
+	defer d.runCallbacks()
 	d.lock.Lock()
 	defer d.lock.Unlock()
-	if d.cacheTime.Before(minExpectedCacheTime) {
-		pods, err := d.getter.GetPods(false)
-		if err != nil {
-			return err
+	err := d.updateIfStale(context.Background())
+	if withholdsPods(err) {
+		return err
+	}
+	for _, pod := range d.pods {
+		if !fn(pod) {
+			break
 		}
-		d.pods = pods
-		d.cacheTime = time.Now()
 	}
-	return nil
+	return err
 }
 
-func (d *dockerCache) startUpdatingCache() {
-	run := true
-	for run {
-		time.Sleep(100 * time.Millisecond)
-		pods, err := d.getter.GetPods(false)
-		cacheTime := time.Now()
-		if err != nil {
-			continue
+func (d *dockerCache) GetPodsWithFreshness() ([]*kubecontainer.Pod, bool, error) {
+	defer d.runCallbacks()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	err := d.updateIfStale(context.Background())
+	if withholdsPods(err) {
+		return nil, false, err
+	}
+	fresh := d.clock.Since(d.cacheTime) <= d.syncStalenessThreshold
+	return copyPods(d.pods), fresh, err
+}
+
+func (d *dockerCache) GetPodsOnce() ([]*kubecontainer.Pod, error) {
+	defer d.runCallbacks()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	_, err := d.refreshIfStale(context.Background())
+	if withholdsPods(err) {
+		return nil, err
+	}
+	return copyPods(d.pods), err
+}
+
+func (d *dockerCache) GetAllPods() ([]*kubecontainer.Pod, error) {
+	defer d.runCallbacks()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	err := d.updateAllPodsIfStale()
+	if withholdsPods(err) {
+		return nil, err
+	}
+	return copyPods(d.allPods), err
+}
+
+func (d *dockerCache) GetPodsFiltered(pred func(pod *kubecontainer.Pod) bool) ([]*kubecontainer.Pod, error) {
+	defer d.runCallbacks()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	err := d.updateAllPodsIfStale()
+	if withholdsPods(err) {
+		return nil, err
+	}
+	var pods []*kubecontainer.Pod
+	for _, pod := range d.allPods {
+		if pred(pod) {
+			pods = append(pods, pod.DeepCopy())
 		}
+	}
+	return pods, err
+}
 
-		d.lock.Lock()
-		if time.Now().After(d.updatingThreadStopTime) {
+// ByNamespace returns a GetPodsFiltered predicate matching the pods in the
+// given namespace.
+func ByNamespace(namespace string) func(pod *kubecontainer.Pod) bool {
+	return func(pod *kubecontainer.Pod) bool {
+		return pod.Namespace == namespace
+	}
+}
+
+// WithExitedContainers returns a GetPodsFiltered predicate matching the pods
+// with at least one exited container.
+func WithExitedContainers() func(pod *kubecontainer.Pod) bool {
+	return func(pod *kubecontainer.Pod) bool {
+		for _, c := range pod.Containers {
+			if c.State == kubecontainer.ContainerStateExited {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (d *dockerCache) GetPodStatus(uid types.UID) (*kubecontainer.PodStatus, bool, error) {
+	defer d.runCallbacks()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	err := d.updateAllPodsIfStale()
+	if withholdsPods(err) {
+		return nil, false, err
+	}
+	pod, found := d.findAllPod(uid)
+	if !found {
+		return nil, false, err
+	}
+	return copyPodStatus(d.cachedPodStatus(pod)), true, err
+}
+
+func (d *dockerCache) GetRestartCount(uid types.UID, containerName string) (int, bool, error) {
+	defer d.runCallbacks()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	err := d.updateIfStale(context.Background())
+	if withholdsPods(err) {
+		return 0, false, err
+	}
+	pod, found := d.podsByUID[uid]
+	if !found {
+		return 0, false, err
+	}
+	for _, c := range pod.Containers {
+		if c.Name == containerName {
+			return d.podRestarts[uid][containerName].restarts, true, err
+		}
+	}
+	return 0, false, err
+}
+
+func (d *dockerCache) GetPodAndStatus(uid types.UID) (*kubecontainer.Pod, *kubecontainer.PodStatus, bool, error) {
+	defer d.runCallbacks()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	err := d.updateAllPodsIfStale()
+	if withholdsPods(err) {
+		return nil, nil, false, err
+	}
+	pod, found := d.findAllPod(uid)
+	if !found {
+		return nil, nil, false, err
+	}
+	return pod.DeepCopy(), copyPodStatus(d.cachedPodStatus(pod)), true, err
+}
+
+// findAllPod returns the pod with the given UID in d.allPods, and whether it
+// was found. Must be called with d.lock held.
+func (d *dockerCache) findAllPod(uid types.UID) (*kubecontainer.Pod, bool) {
+	// d.allPods is sorted by UID.
+	i := sort.Search(len(d.allPods), func(i int) bool { return d.allPods[i].ID >= uid })
+	if i == len(d.allPods) || d.allPods[i].ID != uid {
+		return nil, false
+	}
+	return d.allPods[i], true
+}
+
+// cachedPodStatus returns the status of pod, a pod of d.allPods, deriving it
+// the first time it is asked for. Must be called with d.lock held.
+func (d *dockerCache) cachedPodStatus(pod *kubecontainer.Pod) *kubecontainer.PodStatus {
+	status, found := d.podStatuses[pod.ID]
+	if !found {
+		status = podStatus(pod, d.containerStates)
+		d.podStatuses[pod.ID] = status
+	}
+	return status
+}
+
+// copyPodStatus returns a deep copy of status.
+func copyPodStatus(status *kubecontainer.PodStatus) *kubecontainer.PodStatus {
+	copied := *status
+	copied.RestartCounts = make(map[string]int, len(status.RestartCounts))
+	for name, count := range status.RestartCounts {
+		copied.RestartCounts[name] = count
+	}
+	copied.StateSince = make(map[types.UID]time.Time, len(status.StateSince))
+	for id, since := range status.StateSince {
+		copied.StateSince[id] = since
+	}
+	return &copied
+}
+
+// podStatus derives the status of pod from its containers and their observed
+// states.
+func podStatus(pod *kubecontainer.Pod, states map[types.UID]containerObservation) *kubecontainer.PodStatus {
+	status := &kubecontainer.PodStatus{
+		RestartCounts: make(map[string]int),
+		Phase:         api.PodUnknown,
+		StateSince:    make(map[types.UID]time.Time),
+	}
+	for _, c := range pod.Containers {
+		if observation, found := states[c.ID]; found {
+			status.StateSince[c.ID] = observation.since
+		}
+		switch c.State {
+		case kubecontainer.ContainerStateRunning:
+			status.RunningContainers++
+		case kubecontainer.ContainerStateExited:
+			status.ExitedContainers++
+			status.RestartCounts[c.Name]++
+		}
+	}
+	if status.RunningContainers > 0 {
+		status.Phase = api.PodRunning
+	}
+	return status
+}
+
+func (d *dockerCache) GetContainerStateAge(id types.UID) (time.Duration, bool, error) {
+	defer d.runCallbacks()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	err := d.updateAllPodsIfStale()
+	if withholdsPods(err) {
+		return 0, false, err
+	}
+	observation, found := d.containerStates[id]
+	if !found {
+		return 0, false, err
+	}
+	return d.clock.Since(observation.since), true, err
+}
+
+// containerObservation is the state of a container and when the cache first
+// saw it in that state.
+type containerObservation struct {
+	state kubecontainer.ContainerState
+	since time.Time
+}
+
+// updateAllPodsIfStale refreshes the pods including non-running containers if
+// they are older than the sync staleness threshold, and keeps the background
+// thread refreshing them. A failed refresh is reported as a *StaleCacheError,
+// or ErrCacheTooStale like GetPods. Must be called with d.lock held.
+func (d *dockerCache) updateAllPodsIfStale() error {
+	if d.stopped {
+		return ErrCacheStopped
+	}
+	var err error
+	if d.clock.Since(d.allPodsTime) > d.syncStalenessThreshold {
+		if d.paused {
+			return d.staleErrorSince(ErrCachePaused, d.allPodsTime)
+		}
+		if updateErr := d.updateAllPods(context.Background()); updateErr == ErrCacheStopped {
+			return updateErr
+		} else if updateErr != nil {
+			err = d.staleErrorSince(updateErr, d.allPodsTime)
+		}
+	}
+	d.allPodsIdle.touch(d.clock.Now(), d.idleTimeout)
+	d.keepUpdating()
+	return err
+}
+
+// updateAllPods lists all the containers from docker and stores the result,
+// sharing a listing already in flight, like updateCache. Must be called with
+// d.lock held.
+func (d *dockerCache) updateAllPods(ctx context.Context) error {
+	if d.stopped {
+		return ErrCacheStopped
+	}
+	if !d.allRefreshing {
+		if d.circuitState() == CircuitOpen {
+			return ErrCircuitOpen
+		}
+		d.allRefreshing = true
+		d.allRefresh = newRefreshResult()
+		d.updater.Add(1)
+		go d.syncRefreshAllPods(d.getter)
+	}
+	// Later listings may complete before this caller gets d.lock back:
+	// report the outcome of the one it waited for.
+	r := d.allRefresh
+	if err := d.waitForRefresh(ctx, r.done); err != nil {
+		return err
+	}
+	return r.err
+}
+
+// syncRefreshAllPods lists all the containers for updateAllPods without d.lock
+// held, and stores the result. d.allRefreshing must have been set with d.lock
+// held.
+func (d *dockerCache) syncRefreshAllPods(getter podsGetter) {
+	defer d.updater.Done()
+	pods, _, err := d.listPods(d.ctx, getter, syncRefresh, true)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.allRefreshing = false
+	d.allRefresh.finish(d.storeAllPods(pods, err))
+}
+
+// storeAllPods stores the outcome of a listing of all the containers, and
+// returns the error of the refresh. Must be called with d.lock held.
+func (d *dockerCache) storeAllPods(pods []*kubecontainer.Pod, err error) error {
+	// Stop doesn't wait for the listings in flight: drop their results.
+	if d.stopped {
+		return ErrCacheStopped
+	}
+	if err != nil {
+		err = d.refreshError(err, d.allPodsTime)
+		glog.V(2).Infof("Failed to refresh all pods in docker cache %q: %v", d.name, err)
+		d.recordFailure(err)
+		return err
+	}
+	d.setAllPods(pods, d.clock.Now())
+	return nil
+}
+
+// setAllPods replaces the pods including non-running containers. Must be
+// called with d.lock held.
+func (d *dockerCache) setAllPods(pods []*kubecontainer.Pod, cacheTime time.Time) {
+	pods = d.dedupPods(pods)
+	// Carry the observation times forward for the containers whose state did
+	// not change.
+	containerStates := make(map[types.UID]containerObservation)
+	for _, pod := range pods {
+		for _, c := range pod.Containers {
+			observation, found := d.containerStates[c.ID]
+			if !found || observation.state != c.State {
+				observation = containerObservation{state: c.State, since: cacheTime}
+			}
+			containerStates[c.ID] = observation
+		}
+	}
+	d.allPods = sortPods(pods)
+	d.allPodsTime = cacheTime
+	d.podStatuses = make(map[types.UID]*kubecontainer.PodStatus)
+	d.containerStates = containerStates
+}
+
+func (d *dockerCache) GetPodByUID(uid types.UID) (*kubecontainer.Pod, bool, error) {
+	defer d.runCallbacks()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	err := d.updateIfStale(context.Background())
+	if withholdsPods(err) {
+		return nil, false, err
+	}
+	pod, found := d.podsByUID[uid]
+	if !found && d.singlePodGetter != nil && !d.paused {
+		return d.getMissingPod(uid, err)
+	}
+	if !found {
+		d.recordMiss(uid)
+		return nil, false, err
+	}
+	return pod.DeepCopy(), true, err
+}
+
+func (d *dockerCache) GetPodSandbox(uid types.UID) (*kubecontainer.Container, bool, error) {
+	pod, found, err := d.GetPodByUID(uid)
+	if !found {
+		return nil, false, err
+	}
+	sandbox := podSandbox(pod)
+	return sandbox, sandbox != nil, err
+}
+
+func (d *dockerCache) AppContainers(uid types.UID) ([]*kubecontainer.Container, bool, error) {
+	pod, found, err := d.GetPodByUID(uid)
+	if !found {
+		return nil, false, err
+	}
+	return appContainers(pod), true, err
+}
+
+// podSandbox returns the infra container of pod, nil if it has none.
+func podSandbox(pod *kubecontainer.Pod) *kubecontainer.Container {
+	return pod.FindContainerByName(PodInfraContainerName)
+}
+
+// appContainers returns the containers of pod but its infra container.
+func appContainers(pod *kubecontainer.Pod) []*kubecontainer.Container {
+	var containers []*kubecontainer.Container
+	for _, c := range pod.Containers {
+		if c.Name != PodInfraContainerName {
+			containers = append(containers, c)
+		}
+	}
+	return containers
+}
+
+// getMissingPod looks up the pod with the given UID with the single pod
+// getter and merges it into the cache, for GetPodByUID which got cacheErr from
+// the cache. It must be called with d.lock held.
+func (d *dockerCache) getMissingPod(uid types.UID, cacheErr error) (*kubecontainer.Pod, bool, error) {
+	pod, err := d.lookUpPod(uid)
+	if err == ErrCacheStopped {
+		return nil, false, err
+	}
+	if cacheErr != nil {
+		err = cacheErr
+	}
+	// A refresh may have cached the pod during the lookup.
+	if cached, found := d.podsByUID[uid]; found {
+		return cached.DeepCopy(), true, err
+	}
+	if pod == nil {
+		if err == nil {
+			d.recordMiss(uid)
+		}
+		return nil, false, err
+	}
+	// A cache reset during the lookup stays empty.
+	if !d.reset {
+		d.replacePod(uid, pod)
+	}
+	return pod.DeepCopy(), true, err
+}
+
+// lookUpPod returns a copy of the pod with the given UID returned by the
+// single pod getter, nil if docker has no such pod. d.lock is released while
+// the getter runs, so the cache may have changed when it returns. Must be
+// called with d.lock held.
+func (d *dockerCache) lookUpPod(uid types.UID) (*kubecontainer.Pod, error) {
+	cacheTime := d.cacheTime
+	d.lock.Unlock()
+	pod, err := d.singlePodGetter(uid)
+	d.lock.Lock()
+	if d.stopped {
+		return nil, ErrCacheStopped
+	}
+	if err != nil {
+		return nil, d.refreshError(err, cacheTime)
+	}
+	if pod == nil {
+		return nil, nil
+	}
+	return pod.DeepCopy(), nil
+}
+
+func (d *dockerCache) ForceUpdatePod(uid types.UID) error {
+	d.lock.Lock()
+	fallback := d.singlePodGetter == nil || d.cacheTime.IsZero()
+	d.lock.Unlock()
+	if fallback {
+		return d.ForceUpdate()
+	}
+	defer d.runCallbacks()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.stopped {
+		return ErrCacheStopped
+	}
+	pod, err := d.lookUpPod(uid)
+	if err != nil {
+		return err
+	}
+	// A cache reset during the lookup stays empty.
+	if d.reset {
+		return nil
+	}
+	old, cached := d.podsByUID[uid]
+	switch {
+	case pod == nil && !cached:
+	case pod != nil && cached && podEqual(d.changeDetection, old, pod):
+	default:
+		d.replacePod(uid, pod)
+	}
+	return nil
+}
+
+// replacePod replaces the cached pod with the given UID by pod, adding it if
+// it's not cached or removing it if pod is nil. Must be called with d.lock
+// held.
+func (d *dockerCache) replacePod(uid types.UID, pod *kubecontainer.Pod) {
+	pods := make([]*kubecontainer.Pod, 0, len(d.pods)+1)
+	for _, cached := range d.pods {
+		if cached.ID != uid {
+			pods = append(pods, cached)
+		}
+	}
+	if pod != nil {
+		pods = append(pods, pod)
+	}
+	d.indexPods(d.limitPods(pods))
+}
+
+func (d *dockerCache) GetRecentlyRemovedPod(uid types.UID) (*kubecontainer.Pod, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	value, found := d.removedPods.Get(uid)
+	if !found {
+		return nil, false
+	}
+	removed := value.(removedPod)
+	if d.clock.Since(removed.removed) > d.removedPodTTL {
+		d.removedPods.Remove(uid)
+		return nil, false
+	}
+	return removed.pod.DeepCopy(), true
+}
+
+func (d *dockerCache) GetPodsByUIDs(uids []types.UID) (map[types.UID]*kubecontainer.Pod, error) {
+	defer d.runCallbacks()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	err := d.updateIfStale(context.Background())
+	if withholdsPods(err) {
+		return nil, err
+	}
+	pods := make(map[types.UID]*kubecontainer.Pod, len(uids))
+	for _, uid := range uids {
+		if pod, found := d.podsByUID[uid]; found {
+			pods[uid] = pod.DeepCopy()
+		}
+	}
+	return pods, err
+}
+
+func (d *dockerCache) GetPodsModifiedSince(generation uint64) ([]*kubecontainer.Pod, uint64, error) {
+	defer d.runCallbacks()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	err := d.updateIfStale(context.Background())
+	if withholdsPods(err) {
+		return nil, 0, err
+	}
+	if generation > d.generation {
+		generation = 0
+	}
+	var pods []*kubecontainer.Pod
+	for _, pod := range d.pods {
+		if d.podGenerations[pod.ID] > generation {
+			pods = append(pods, pod.DeepCopy())
+		}
+	}
+	return pods, d.generation, err
+}
+
+func (d *dockerCache) GetPodCount() (int, error) {
+	defer d.runCallbacks()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	err := d.updateIfStale(context.Background())
+	if withholdsPods(err) {
+		return 0, err
+	}
+	return len(d.pods), err
+}
+
+func (d *dockerCache) GetPodIDs() ([]types.UID, error) {
+	defer d.runCallbacks()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	err := d.updateIfStale(context.Background())
+	if withholdsPods(err) {
+		return nil, err
+	}
+	// The pods are sorted by UID.
+	ids := make([]types.UID, 0, len(d.pods))
+	for _, pod := range d.pods {
+		ids = append(ids, pod.ID)
+	}
+	return ids, err
+}
+
+func (d *dockerCache) GetPodContainerCount(uid types.UID) (int, bool, error) {
+	defer d.runCallbacks()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	err := d.updateIfStale(context.Background())
+	if withholdsPods(err) {
+		return 0, false, err
+	}
+	pod, found := d.podsByUID[uid]
+	if !found {
+		return 0, false, err
+	}
+	return len(pod.Containers), true, err
+}
+
+func (d *dockerCache) Contains(uid types.UID) (bool, error) {
+	defer d.runCallbacks()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	err := d.updateIfStale(context.Background())
+	if withholdsPods(err) {
+		return false, err
+	}
+	_, found := d.podsByUID[uid]
+	if !found {
+		d.recordMiss(uid)
+	}
+	return found, err
+}
+
+// missTracker counts the lookups of the most recently missed pods.
+type missTracker struct {
+	// The tracked pods by UID, and their UIDs from the least recently
+	// missed, which evicts them from byUID.
+	byUID  map[types.UID]*podMisses
+	recent *lru.Cache
+}
+
+// podMisses counts the lookups of a missed pod.
+type podMisses struct {
+	MissedPod
+	// Lookups within the current window, started at windowStart.
+	windowMisses int
+	windowStart  time.Time
+	// Time of the last warning about the pod.
+	lastWarning time.Time
+}
+
+func newMissTracker() *missTracker {
+	t := &missTracker{
+		byUID:  make(map[types.UID]*podMisses),
+		recent: lru.New(maxTrackedMisses),
+	}
+	t.recent.OnEvicted = func(key lru.Key, value interface{}) {
+		delete(t.byUID, key.(types.UID))
+	}
+	return t
+}
+
+// recordMiss counts a lookup of the pod with the given UID which the cache
+// doesn't hold, and logs a warning if the pod is missed too often. Must be
+// called with d.lock held.
+func (d *dockerCache) recordMiss(uid types.UID) {
+	if d.misses == nil {
+		d.misses = newMissTracker()
+	}
+	now := d.clock.Now()
+	misses, found := d.misses.byUID[uid]
+	if !found {
+		misses = &podMisses{MissedPod: MissedPod{UID: uid}}
+		d.misses.byUID[uid] = misses
+	}
+	d.misses.recent.Add(uid, nil)
+	misses.Misses++
+	misses.LastMiss = now
+	if d.clock.Since(misses.windowStart) > missWarningWindow {
+		misses.windowMisses = 0
+		misses.windowStart = now
+	}
+	misses.windowMisses++
+	if misses.windowMisses > missWarningThreshold && d.clock.Since(misses.lastWarning) > missWarningWindow {
+		glog.Warningf("Docker cache %q was asked %d times within %v for pod %q, which docker doesn't run", d.name, misses.windowMisses, d.clock.Since(misses.windowStart), uid)
+		misses.lastWarning = now
+	}
+}
+
+func (d *dockerCache) DebugTopMissedPods(n int) []MissedPod {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.misses == nil || n <= 0 {
+		return nil
+	}
+	missed := make([]MissedPod, 0, len(d.misses.byUID))
+	for _, misses := range d.misses.byUID {
+		missed = append(missed, misses.MissedPod)
+	}
+	sort.Sort(podsByMisses(missed))
+	if len(missed) > n {
+		missed = missed[:n]
+	}
+	return missed
+}
+
+// podsByMisses sorts missed pods by decreasing number of misses, then by UID.
+type podsByMisses []MissedPod
+
+func (p podsByMisses) Len() int      { return len(p) }
+func (p podsByMisses) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p podsByMisses) Less(i, j int) bool {
+	if p[i].Misses != p[j].Misses {
+		return p[i].Misses > p[j].Misses
+	}
+	return p[i].UID < p[j].UID
+}
+
+func (d *dockerCache) GetPodsInNamespace(namespace string) ([]*kubecontainer.Pod, error) {
+	defer d.runCallbacks()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	err := d.updateIfStale(context.Background())
+	if withholdsPods(err) {
+		return nil, err
+	}
+	return copyPods(d.podsByNamespace[namespace]), err
+}
+
+// selectPods is like GetPods, but only returns the pods whose labels match
+// selector. It is left out of DockerCache until DockerManager.GetPods labels
+// the pods, which docker doesn't list the labels of.
+func (d *dockerCache) selectPods(selector labels.Selector) ([]*kubecontainer.Pod, error) {
+	defer d.runCallbacks()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	err := d.updateIfStale(context.Background())
+	if withholdsPods(err) {
+		return nil, err
+	}
+	var result []*kubecontainer.Pod
+	for _, pod := range d.pods {
+		if selector.Matches(labels.Set(pod.Labels)) {
+			result = append(result, pod.DeepCopy())
+		}
+	}
+	return result, err
+}
+
+// containerIndex locates a container in the cached pods.
+type containerIndex struct {
+	pod       int
+	container int
+}
+
+func (d *dockerCache) GetContainerByID(id types.UID) (*kubecontainer.Pod, *kubecontainer.Container, bool, error) {
+	defer d.runCallbacks()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	err := d.updateIfStale(context.Background())
+	if withholdsPods(err) {
+		return nil, nil, false, err
+	}
+	index, found := d.containersByID[id]
+	if !found {
+		return nil, nil, false, err
+	}
+	pod := d.pods[index.pod].DeepCopy()
+	return pod, pod.Containers[index.container], true, err
+}
+
+func (d *dockerCache) GetImagesInUse() ([]kubecontainer.ImageID, error) {
+	defer d.runCallbacks()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	err := d.updateIfStale(context.Background())
+	if withholdsPods(err) {
+		return nil, err
+	}
+	names := make([]string, 0, len(d.containersByImage))
+	for image := range d.containersByImage {
+		names = append(names, image)
+	}
+	sort.Strings(names)
+	images := make([]kubecontainer.ImageID, len(names))
+	for i, name := range names {
+		images[i] = kubecontainer.ImageID(name)
+	}
+	return images, err
+}
+
+func (d *dockerCache) GetContainersForImage(image string) ([]*kubecontainer.Container, error) {
+	defer d.runCallbacks()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	err := d.updateIfStale(context.Background())
+	if withholdsPods(err) {
+		return nil, err
+	}
+	var containers []*kubecontainer.Container
+	for _, index := range d.containersByImage[image] {
+		container := *d.pods[index.pod].Containers[index.container]
+		containers = append(containers, &container)
+	}
+	return containers, err
+}
+
+func (d *dockerCache) LastUpdated() time.Time {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.cacheTime
+}
+
+func (d *dockerCache) CacheStatus() DockerCacheStatus {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return DockerCacheStatus{
+		LastUpdated:         d.cacheTime,
+		LastError:           d.lastError,
+		ConsecutiveFailures: d.consecutiveFailures,
+		CircuitState:        d.circuitState(),
+	}
+}
+
+func (d *dockerCache) RecentErrors() []TimestampedError {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	errs := make([]TimestampedError, 0, len(d.recentErrors))
+	errs = append(errs, d.recentErrors[d.nextRecentError:]...)
+	return append(errs, d.recentErrors[:d.nextRecentError]...)
+}
+
+func (d *dockerCache) Healthy() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.stopped {
+		return ErrCacheStopped
+	}
+	if d.consecutiveFailures == 0 {
+		return nil
+	}
+	if state := d.circuitState(); state != CircuitClosed {
+		return fmt.Errorf("docker cache circuit breaker is %s after %d failed refreshes in a row, last error: %v", state, d.consecutiveFailures, d.lastError)
+	}
+	if failing := d.clock.Since(d.firstFailureTime); failing > d.unhealthyThreshold {
+		return fmt.Errorf("docker cache failed to refresh %d times in a row for %v, last error: %v", d.consecutiveFailures, failing, d.lastError)
+	}
+	return nil
+}
+
+func (d *dockerCache) Stats() DockerCacheStats {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return DockerCacheStats{
+		PodCount:            len(d.pods),
+		ContainerCount:      d.containerCount,
+		LastRefreshDuration: d.lastRefreshDuration,
+		LastRefreshTime:     d.cacheTime,
+	}
+}
+
+// updateIfStale refreshes the cache like refreshIfStale and keeps the
+// background thread running. Must be called with d.lock held.
+func (d *dockerCache) updateIfStale(ctx context.Context) error {
+	_, err := d.updateIfStaleRefreshed(ctx)
+	return err
+}
+
+// updateIfStaleRefreshed is like updateIfStale, and also returns whether docker
+// was listed synchronously. Must be called with d.lock held.
+func (d *dockerCache) updateIfStaleRefreshed(ctx context.Context) (bool, error) {
+	refreshed, err := d.refreshIfStale(ctx)
+	if err != nil {
+		// The cache never loaded, e.g. because docker is not up yet: keep
+		// retrying in the background, so that the pods are loaded as
+		// soon as docker answers, even if nobody asks again.
+		if d.cacheTime.IsZero() && !d.stopped && err != ctx.Err() {
+			d.reset = false
+			d.keepUpdating()
+		}
+		return refreshed, err
+	}
+	// Stop refreshing thread if there were no requests within the idle
+	// timeout.
+	d.podsIdle.touch(d.clock.Now(), d.idleTimeout)
+	d.keepUpdating()
+	return refreshed, nil
+}
+
+// refreshIfStale refreshes the cache if it is older than the sync staleness
+// threshold, and returns whether it waited for docker to be listed. A failed
+// refresh is reported as a *StaleCacheError, unless ctx is done or the cached
+// pods are older than d.maxCacheAge, in which case ErrCacheTooStale is
+// returned. Must be called with d.lock held.
+func (d *dockerCache) refreshIfStale(ctx context.Context) (bool, error) {
+	if d.stopped {
+		return false, ErrCacheStopped
+	}
+	if age := d.clock.Since(d.cacheTime); age > d.syncStalenessThreshold {
+		if d.paused {
+			return false, d.staleError(ErrCachePaused)
+		}
+		if d.cacheTime.IsZero() && d.nonBlockingFirstRead && d.circuitState() != CircuitOpen {
+			d.startRefresh()
+			return false, &StaleCacheError{Err: ErrCacheWarming}
+		}
+		// Unless a background refresh is already on its way, the caller
+		// pays for listing docker.
+		if !d.refreshing {
+			if d.cacheTime.IsZero() {
+				glog.V(3).Infof("Docker cache %q is empty, loading it synchronously", d.name)
+			} else {
+				glog.V(3).Infof("Docker cache %q is %v old, refreshing it synchronously", d.name, age)
+			}
+			dockerCacheSyncRefreshes.WithLabelValues(d.name).Inc()
+		}
+		if err := d.updateCache(ctx); err != nil {
+			switch err {
+			case ctx.Err():
+				return true, err
+			case ErrCircuitOpen:
+				// Docker was not listed.
+				return false, d.staleError(err)
+			}
+			return true, d.staleError(err)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// staleError returns the error served with the cached pods when they could not
+// be refreshed because of err: a *StaleCacheError, or ErrCacheTooStale if they
+// are older than d.maxCacheAge. Must be called with d.lock held.
+func (d *dockerCache) staleError(err error) error {
+	return d.staleErrorSince(err, d.cacheTime)
+}
+
+// staleErrorSince is like staleError, for pods listed at cacheTime. Must be
+// called with d.lock held.
+func (d *dockerCache) staleErrorSince(err error, cacheTime time.Time) error {
+	if d.tooStale(cacheTime) {
+		return ErrCacheTooStale
+	}
+	return &StaleCacheError{Err: err}
+}
+
+// tooStale returns true if pods listed at cacheTime are older than
+// d.maxCacheAge.
+func (d *dockerCache) tooStale(cacheTime time.Time) bool {
+	return d.maxCacheAge > 0 && d.clock.Since(cacheTime) > d.maxCacheAge
+}
+
+// keepUpdating starts the background thread if it isn't running and isn't
+// disabled. Must be called with d.lock held.
+func (d *dockerCache) keepUpdating() {
+	if !d.updatingCache && !d.disableBackground && !d.paused {
+		d.updatingCache = true
+		d.updater.Add(1)
+		go d.startUpdatingCache()
+	}
+}
+
+// setPods stores the pods listed by a successful refresh like storePods, and
+// records the success: the failures are over and the circuit breaker closes.
+// Must be called with d.lock held.
+func (d *dockerCache) setPods(pods []*kubecontainer.Pod, cacheTime time.Time, latency time.Duration) {
+	d.lastRefreshDuration = latency
+	d.lastError = nil
+	d.consecutiveFailures = 0
+	// Once docker answers again for longer than it may fail for before the
+	// cache is unhealthy, the errors are history.
+	if len(d.recentErrors) > 0 && d.clock.Since(d.lastFailureTime) > d.unhealthyThreshold {
+		d.clearRecentErrors()
+	}
+	if !d.circuitOpenedAt.IsZero() {
+		glog.Infof("Docker cache %q refreshed again, closing the circuit breaker", d.name)
+		d.circuitOpenedAt = time.Time{}
+	}
+	for _, pod := range pods {
+		if d.evictedPods[pod.ID] {
+			glog.Warningf("Docker cache %q still lists evicted pod %q, adding it back", d.name, pod.ID)
+		}
+	}
+	d.evictedPods = nil
+	d.storePods(pods, cacheTime)
+}
+
+// storePods replaces the content of the cache with pods listed at cacheTime,
+// rebuilds its indexes and notifies the subscribers, unless d.equalsFn reports
+// that the pods did not change. The restarts are counted either way, since
+// coarser change detections ignore the replaced containers. Unlike setPods, it
+// leaves the failures alone, e.g. for pods which weren't listed by the getter.
+// Must be called with d.lock held.
+func (d *dockerCache) storePods(pods []*kubecontainer.Pod, cacheTime time.Time) {
+	pods = d.limitPods(d.dedupPods(pods))
+	d.cacheTime = cacheTime
+	d.reset = false
+	if d.equalsFn(d.pods, pods) {
+		d.updateRestartCounts(sortPods(pods))
+		return
+	}
+	if d.internStrings {
+		internPods(pods)
+	}
+	if d.containersReplaced(pods) {
+		glog.Warningf("Docker cache %q found none of the %d previously cached containers, the docker daemon probably restarted", d.name, len(d.containersByID))
+		if d.onError != nil {
+			d.pendingErrors = append(d.pendingErrors, ErrDaemonRestartDetected)
+		}
+	}
+	d.indexPods(pods)
+}
+
+// internPods makes the pods with equal namespaces and the containers with
+// equal images share a single copy of the string. Strings are immutable, so
+// the pods can't observe the sharing.
+func internPods(pods []*kubecontainer.Pod) {
+	table := make(map[string]string)
+	intern := func(s string) string {
+		if interned, found := table[s]; found {
+			return interned
+		}
+		table[s] = s
+		return s
+	}
+	for _, pod := range pods {
+		pod.Namespace = intern(pod.Namespace)
+		for _, c := range pod.Containers {
+			c.Image = intern(c.Image)
+		}
+	}
+}
+
+// containersReplaced returns true if pods and the cached pods both have
+// containers, but none in common. Must be called with d.lock held.
+func (d *dockerCache) containersReplaced(pods []*kubecontainer.Pod) bool {
+	if len(d.containersByID) == 0 {
+		return false
+	}
+	replaced := false
+	for _, pod := range pods {
+		for _, c := range pod.Containers {
+			if _, found := d.containersByID[c.ID]; found {
+				return false
+			}
+			replaced = true
+		}
+	}
+	return replaced
+}
+
+// indexPods replaces the cached pods, sorted by UID, and rebuilds their
+// indexes. It must be called with d.lock held.
+func (d *dockerCache) indexPods(pods []*kubecontainer.Pod) {
+	pods = sortPods(pods)
+	podsByUID := make(map[types.UID]*kubecontainer.Pod, len(pods))
+	podsByNamespace := make(map[string][]*kubecontainer.Pod)
+	containersByID := make(map[types.UID]containerIndex)
+	containersByImage := make(map[string][]containerIndex)
+	containerCount := 0
+	events := d.podEvents(pods)
+	d.updateGenerations(events)
+	d.updateRemovedPods(events)
+	d.updateRestartCounts(pods)
+	if len(events) > 0 && len(d.refreshHooks) > 0 {
+		d.pendingRefresh = &pendingRefresh{pods: pods, asOf: d.cacheTime}
+	}
+	for i, pod := range pods {
+		containerCount += len(pod.Containers)
+		podsByUID[pod.ID] = pod
+		podsByNamespace[pod.Namespace] = append(podsByNamespace[pod.Namespace], pod)
+		for j, container := range pod.Containers {
+			index := containerIndex{pod: i, container: j}
+			containersByID[container.ID] = index
+			containersByImage[container.Image] = append(containersByImage[container.Image], index)
+		}
+	}
+	d.pods = pods
+	d.podsByUID = podsByUID
+	d.podsByNamespace = podsByNamespace
+	d.containersByID = containersByID
+	d.containersByImage = containersByImage
+	d.containerCount = containerCount
+	d.notifySubscribers()
+	d.notifyEventSubscribers(events)
+}
+
+// updateGenerations bumps the generation of the cache if events is not empty,
+// and stamps the added and modified pods with it. Must be called with d.lock
+// held.
+func (d *dockerCache) updateGenerations(events []PodCacheEvent) {
+	if len(events) == 0 {
+		return
+	}
+	d.generation++
+	if d.podGenerations == nil {
+		d.podGenerations = make(map[types.UID]uint64)
+	}
+	for _, event := range events {
+		if event.Type == PodRemoved {
+			delete(d.podGenerations, event.Pod.ID)
+		} else {
+			d.podGenerations[event.Pod.ID] = d.generation
+		}
+	}
+}
+
+// containerRestarts is the last seen container of a name in a pod, and how
+// many containers it replaced.
+type containerRestarts struct {
+	id       types.UID
+	restarts int
+}
+
+// updateRestartCounts counts the containers of pods which replaced the last
+// seen container of the same name and pod, and forgets the restarts of the
+// pods which are no longer cached. Must be called with d.lock held.
+func (d *dockerCache) updateRestartCounts(pods []*kubecontainer.Pod) {
+	if d.podRestarts == nil {
+		d.podRestarts = make(map[types.UID]map[string]containerRestarts)
+	}
+	for _, pod := range pods {
+		containers, found := d.podRestarts[pod.ID]
+		if !found {
+			containers = make(map[string]containerRestarts, len(pod.Containers))
+			d.podRestarts[pod.ID] = containers
+		}
+		for _, c := range pod.Containers {
+			last, found := containers[c.Name]
+			if found && last.id != c.ID {
+				last.restarts++
+			}
+			last.id = c.ID
+			containers[c.Name] = last
+		}
+	}
+	for uid := range d.podRestarts {
+		if !containsPod(pods, uid) {
+			delete(d.podRestarts, uid)
+		}
+	}
+}
+
+// containsPod returns true if pods, sorted by UID, has a pod of the given UID.
+func containsPod(pods []*kubecontainer.Pod, uid types.UID) bool {
+	i := sort.Search(len(pods), func(i int) bool { return pods[i].ID >= uid })
+	return i < len(pods) && pods[i].ID == uid
+}
+
+// removedPod is a pod which was removed from the cache.
+type removedPod struct {
+	pod     *kubecontainer.Pod
+	removed time.Time
+}
+
+// updateRemovedPods remembers the pods removed by events, and forgets the
+// added ones. Must be called with d.lock held.
+func (d *dockerCache) updateRemovedPods(events []PodCacheEvent) {
+	for _, event := range events {
+		switch event.Type {
+		case PodRemoved:
+			d.removedPods.Add(event.Pod.ID, removedPod{pod: event.Pod, removed: d.clock.Now()})
+		case PodAdded:
+			d.removedPods.Remove(event.Pod.ID)
+		}
+	}
+}
+
+// podEvents returns the changes from the cached pods to pods. Must be called
+// with d.lock held.
+func (d *dockerCache) podEvents(pods []*kubecontainer.Pod) []PodCacheEvent {
+	var events []PodCacheEvent
+	found := make(map[types.UID]bool, len(pods))
+	for _, pod := range pods {
+		found[pod.ID] = true
+		old, cached := d.podsByUID[pod.ID]
+		switch {
+		case !cached:
+			events = append(events, PodCacheEvent{Type: PodAdded, Pod: pod})
+		case !podEqual(d.changeDetection, old, pod):
+			events = append(events, PodCacheEvent{Type: PodModified, Pod: pod})
+		}
+	}
+	for _, pod := range d.pods {
+		if !found[pod.ID] {
+			events = append(events, PodCacheEvent{Type: PodRemoved, Pod: pod})
+		}
+	}
+	return events
+}
+
+// dedupPods returns pods with a single pod per UID, keeping the one with the
+// most containers, or the first listed of them, where docker listed several.
+func (d *dockerCache) dedupPods(pods []*kubecontainer.Pod) []*kubecontainer.Pod {
+	indexes := make(map[types.UID]int, len(pods))
+	var result []*kubecontainer.Pod
+	for i, pod := range pods {
+		j, found := indexes[pod.ID]
+		if !found {
+			indexes[pod.ID] = len(indexes)
+			if result != nil {
+				result = append(result, pod)
+			}
+			continue
+		}
+		if result == nil {
+			// The pods before are all distinct.
+			result = make([]*kubecontainer.Pod, i, len(pods))
+			copy(result, pods[:i])
+		}
+		glog.Warningf("Docker cache %q listed pod %q twice, keeping the one with the most containers", d.name, pod.ID)
+		dockerCacheDuplicatePods.WithLabelValues(d.name).Inc()
+		if len(pod.Containers) > len(result[j].Containers) {
+			result[j] = pod
+		}
+	}
+	if result == nil {
+		return pods
+	}
+	return result
+}
+
+// limitPods returns the d.maxPods most recently created pods if there are
+// more.
+func (d *dockerCache) limitPods(pods []*kubecontainer.Pod) []*kubecontainer.Pod {
+	if d.maxPods == 0 || len(pods) <= d.maxPods {
+		return pods
+	}
+	glog.Warningf("Docker cache %q listed %d pods, only keeping the %d most recently created ones", d.name, len(pods), d.maxPods)
+	dockerCacheTruncatedRefreshes.WithLabelValues(d.name).Inc()
+	sorted := make([]*kubecontainer.Pod, len(pods))
+	copy(sorted, pods)
+	sort.Sort(podsByNewest(sorted))
+	return sorted[:d.maxPods]
+}
+
+// podsByNewest sorts pods by decreasing creation time of their most recent
+// container, then by UID.
+type podsByNewest []*kubecontainer.Pod
+
+func (p podsByNewest) Len() int      { return len(p) }
+func (p podsByNewest) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p podsByNewest) Less(i, j int) bool {
+	ci, cj := podCreated(p[i]), podCreated(p[j])
+	if ci != cj {
+		return ci > cj
+	}
+	return p[i].ID < p[j].ID
+}
+
+// podCreated returns the creation time of the most recent container of pod.
+func podCreated(pod *kubecontainer.Pod) int64 {
+	var created int64
+	for _, c := range pod.Containers {
+		if c.Created > created {
+			created = c.Created
+		}
+	}
+	return created
+}
+
+// sortPods returns a copy of pods sorted by UID, so that the cache serves
+// the same pods in the same order whatever order docker lists them in.
+func sortPods(pods []*kubecontainer.Pod) []*kubecontainer.Pod {
+	if pods == nil {
+		return nil
+	}
+	sorted := make([]*kubecontainer.Pod, len(pods))
+	copy(sorted, pods)
+	sort.Sort(podsByID(sorted))
+	return sorted
+}
+
+// podsByID sorts pods by UID.
+type podsByID []*kubecontainer.Pod
+
+func (p podsByID) Len() int           { return len(p) }
+func (p podsByID) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p podsByID) Less(i, j int) bool { return p[i].ID < p[j].ID }
+
+// podsEqualAt returns true if old and pods have the same pods, equal at the
+// given granularity.
+func podsEqualAt(level ChangeDetection, old, pods []*kubecontainer.Pod) bool {
+	if len(old) != len(pods) {
+		return false
+	}
+	oldByUID := make(map[types.UID]*kubecontainer.Pod, len(old))
+	for _, pod := range old {
+		oldByUID[pod.ID] = pod
+	}
+	for _, pod := range pods {
+		oldPod, found := oldByUID[pod.ID]
+		if !found || !podEqual(level, oldPod, pod) {
+			return false
+		}
+	}
+	return true
+}
+
+// podEqual returns true if old and pod, of the same UID, are equal at the
+// given granularity.
+func podEqual(level ChangeDetection, old, pod *kubecontainer.Pod) bool {
+	if level == ChangeDetectPodSet {
+		return true
+	}
+	if len(old.Containers) != len(pod.Containers) {
+		return false
+	}
+	containerStates := make(map[types.UID]kubecontainer.ContainerState, len(old.Containers))
+	for _, c := range old.Containers {
+		containerStates[c.ID] = c.State
+	}
+	for _, c := range pod.Containers {
+		state, found := containerStates[c.ID]
+		if !found || (level == ChangeDetectContainerState && state != c.State) {
+			return false
+		}
+	}
+	return true
+}
+
+// subscription is the state shared by both kinds of subscribers.
+type subscription struct {
+	name string
+	// Number of updates dropped so far.
+	dropped int
+	// Number of updates dropped since the last warning.
+	unreported int
+	// Last time a warning about the dropped updates was logged.
+	lastWarning time.Time
+}
+
+// podsSubscriber is a subscriber to the cached pods.
+type podsSubscriber struct {
+	subscription
+	ch chan []*kubecontainer.Pod
+}
+
+// eventSubscriber is a subscriber to the pod events.
+type eventSubscriber struct {
+	subscription
+	ch chan PodCacheEvent
+}
+
+// recordDrop counts an update dropped because the buffer of subscriber s was
+// full, warning about it at most once per slowSubscriberWarningInterval. Must
+// be called with d.lock held.
+func (d *dockerCache) recordDrop(s *subscription) {
+	s.dropped++
+	s.unreported++
+	dockerCacheSubscriberDrops.WithLabelValues(d.name, s.name).Inc()
+	if now := d.clock.Now(); s.lastWarning.IsZero() || now.Sub(s.lastWarning) >= slowSubscriberWarningInterval {
+		glog.Warningf("Docker cache %q subscriber %q is too slow: dropped %d updates (%d in total)", d.name, s.name, s.unreported, s.dropped)
+		s.lastWarning = now
+		s.unreported = 0
+	}
+}
+
+func (d *dockerCache) Subscribe(name string) (<-chan []*kubecontainer.Pod, func()) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	ch := make(chan []*kubecontainer.Pod, subscriberBufferSize)
+	if d.stopped {
+		close(ch)
+		return ch, func() {}
+	}
+	id := d.nextSubscriberID
+	d.nextSubscriberID++
+	d.subscribers[id] = &podsSubscriber{subscription: subscription{name: name}, ch: ch}
+	return ch, func() {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		if s, found := d.subscribers[id]; found {
+			delete(d.subscribers, id)
+			close(s.ch)
+		}
+	}
+}
+
+// notifySubscribers sends the cached pods to all the subscribers, dropping
+// their oldest snapshot if their buffer is full. Must be called with d.lock
+// held.
+func (d *dockerCache) notifySubscribers() {
+	for _, s := range d.subscribers {
+		pods := copyPods(d.pods)
+		for sent := false; !sent; {
+			select {
+			case s.ch <- pods:
+				sent = true
+			default:
+				select {
+				case <-s.ch:
+					d.recordDrop(&s.subscription)
+				default:
+				}
+			}
+		}
+	}
+}
+
+func (d *dockerCache) SubscribeEvents(name string) (<-chan PodCacheEvent, func()) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	ch := make(chan PodCacheEvent, eventSubscriberBufferSize)
+	if d.stopped {
+		close(ch)
+		return ch, func() {}
+	}
+	id := d.nextSubscriberID
+	d.nextSubscriberID++
+	d.eventSubscribers[id] = &eventSubscriber{subscription: subscription{name: name}, ch: ch}
+	return ch, func() {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		if s, found := d.eventSubscribers[id]; found {
+			delete(d.eventSubscribers, id)
+			close(s.ch)
+		}
+	}
+}
+
+func (d *dockerCache) OnRefresh(fn func(pods []*kubecontainer.Pod, asOf time.Time)) func() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.stopped {
+		return func() {}
+	}
+	id := d.nextSubscriberID
+	d.nextSubscriberID++
+	d.refreshHooks = append(d.refreshHooks, refreshHook{id: id, fn: fn})
+	return func() {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		for i, hook := range d.refreshHooks {
+			if hook.id == id {
+				hooks := make([]refreshHook, 0, len(d.refreshHooks)-1)
+				hooks = append(hooks, d.refreshHooks[:i]...)
+				d.refreshHooks = append(hooks, d.refreshHooks[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// notifyEventSubscribers sends the events to all the event subscribers,
+// dropping their oldest events if their buffer is full. Must be called with
+// d.lock held.
+func (d *dockerCache) notifyEventSubscribers(events []PodCacheEvent) {
+	for _, s := range d.eventSubscribers {
+		for _, event := range events {
+			event.Pod = event.Pod.DeepCopy()
+			for sent := false; !sent; {
+				select {
+				case s.ch <- event:
+					sent = true
+				default:
+					select {
+					case <-s.ch:
+						d.recordDrop(&s.subscription)
+					default:
+					}
+				}
+			}
+		}
+	}
+}
+
+// listPods lists the pods with getter, records the refresh metrics and
+// returns how long the listing took. If all is false, only the running
+// containers are listed. If ctx is done before docker answers, ctx.Err() is
+// returned and the result is dropped. The getter doesn't take a context, so
+// its goroutine keeps running until docker answers, even after Stop.
+func (d *dockerCache) listPods(ctx context.Context, getter podsGetter, refreshType string, all bool) ([]*kubecontainer.Pod, time.Duration, error) {
+	start := d.clock.Now()
+	type listResult struct {
+		pods    []*kubecontainer.Pod
+		latency time.Duration
+		err     error
+	}
+	result := make(chan listResult, 1)
+	atomic.AddInt32(&d.listingGoroutines, 1)
+	go func() {
+		pods, err := d.getPods(getter, all)
+		latency := d.clock.Since(start)
+		recordRefresh(d.name, refreshType, latency, err)
+		atomic.AddInt32(&d.listingGoroutines, -1)
+		result <- listResult{pods, latency, err}
+	}()
+	select {
+	case r := <-result:
+		return r.pods, r.latency, r.err
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+}
+
+// getPods calls the getter and the observers, turning a panic into an
+// error so that a broken getter doesn't kill the background thread. The pods
+// of a failed listing are dropped: they may be any subset of the running pods,
+// and neither the cache nor its callers must ever see them.
+func (d *dockerCache) getPods(getter podsGetter, all bool) (pods []*kubecontainer.Pod, err error) {
+	d.notifyObservers(func(o CacheObserver) { o.RefreshStarted() })
+	start := d.clock.Now()
+	defer func() {
+		duration := d.clock.Since(start)
+		if err != nil {
+			d.notifyObservers(func(o CacheObserver) { o.RefreshFailed(err, duration) })
+		} else {
+			d.notifyObservers(func(o CacheObserver) { o.RefreshSucceeded(pods, duration) })
+		}
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			for _, fn := range util.PanicHandlers {
+				fn(r)
+			}
+			pods, err = nil, fmt.Errorf("listing pods panicked: %v", r)
+		}
+	}()
+	pods, err = getter.GetPods(all)
+	if err != nil {
+		return nil, err
+	}
+	return pods, nil
+}
+
+// refreshError wraps the error of a listing which failed to refresh pods last
+// refreshed at cacheTime. Must be called with d.lock held.
+func (d *dockerCache) refreshError(err error, cacheTime time.Time) error {
+	var age time.Duration
+	if !cacheTime.IsZero() {
+		age = d.clock.Since(cacheTime)
+	}
+	return &RefreshError{Err: err, CacheAge: age}
+}
+
+// recordFailure keeps track of a failed refresh. Must be called with d.lock
+// held.
+func (d *dockerCache) recordFailure(err error) {
+	d.lastError = err
+	if d.consecutiveFailures == 0 {
+		d.firstFailureTime = d.clock.Now()
+	}
+	d.consecutiveFailures++
+	d.lastFailureTime = d.clock.Now()
+	d.addRecentError(TimestampedError{Time: d.lastFailureTime, Err: err})
+	if d.onError != nil {
+		d.pendingErrors = append(d.pendingErrors, err)
+	}
+	if d.circuitThreshold > 0 && d.consecutiveFailures >= d.circuitThreshold {
+		// A failed probe opens the circuit again.
+		if d.circuitOpenedAt.IsZero() {
+			glog.Warningf("Docker cache %q failed to refresh %d times in a row, not listing docker for %v", d.name, d.consecutiveFailures, d.circuitCooldown)
+		}
+		d.circuitOpenedAt = d.clock.Now()
+	}
+	if d.consecutiveFailures >= failureWarningThreshold && d.clock.Since(d.lastFailureWarning) >= failureWarningInterval {
+		glog.Warningf("Docker cache %q failed to refresh %d times in a row, last error: %v", d.name, d.consecutiveFailures, err)
+		d.lastFailureWarning = d.clock.Now()
+	}
+}
+
+// addRecentError records err in the recentErrors ring buffer, overwriting the
+// oldest error once it is full. Must be called with d.lock held.
+func (d *dockerCache) addRecentError(err TimestampedError) {
+	if cap(d.recentErrors) == 0 {
+		return
+	}
+	if len(d.recentErrors) < cap(d.recentErrors) {
+		d.recentErrors = append(d.recentErrors, err)
+		return
+	}
+	d.recentErrors[d.nextRecentError] = err
+	d.nextRecentError = (d.nextRecentError + 1) % len(d.recentErrors)
+}
+
+// clearRecentErrors empties the recentErrors ring buffer. Must be called with
+// d.lock held.
+func (d *dockerCache) clearRecentErrors() {
+	d.recentErrors = d.recentErrors[:0]
+	d.nextRecentError = 0
+}
+
+// circuitState returns the state of the circuit breaker. Must be called with
+// d.lock held.
+func (d *dockerCache) circuitState() CircuitState {
+	if d.circuitOpenedAt.IsZero() {
+		return CircuitClosed
+	}
+	if d.clock.Since(d.circuitOpenedAt) < d.circuitCooldown {
+		return CircuitOpen
+	}
+	return CircuitHalfOpen
+}
+
+// runCallbacks hands the failures recorded since the last call to d.onError,
+// and the pods changed since to the refresh hooks. Must be called without
+// d.lock held, usually deferred before taking it.
+func (d *dockerCache) runCallbacks() {
+	d.lock.Lock()
+	errs := d.pendingErrors
+	d.pendingErrors = nil
+	evictions := d.pendingEvictions
+	d.pendingEvictions = nil
+	d.lock.Unlock()
+	for _, err := range errs {
+		d.onError(err)
+	}
+	for _, uid := range evictions {
+		uid := uid
+		d.notifyObservers(func(o CacheObserver) { o.CacheEvicted(uid) })
+	}
+	d.runRefreshHooks()
+}
+
+// runRefreshHooks hands the pods changed since the last call to the refresh
+// hooks. Must be called without d.lock held. Only one caller runs the hooks at
+// a time: the others, including the hooks themselves, leave the pods changed
+// meanwhile to it.
+func (d *dockerCache) runRefreshHooks() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.runningHooks {
+		return
+	}
+	d.runningHooks = true
+	defer func() { d.runningHooks = false }()
+	for d.pendingRefresh != nil {
+		refresh := d.pendingRefresh
+		d.pendingRefresh = nil
+		hooks := make([]refreshHook, len(d.refreshHooks))
+		copy(hooks, d.refreshHooks)
+		d.lock.Unlock()
+		// The cached pods are replaced, never modified, so they can be
+		// copied without d.lock held.
+		pods := copyPods(refresh.pods)
+		for _, hook := range hooks {
+			d.runRefreshHook(hook.fn, pods, refresh.asOf)
+		}
+		d.lock.Lock()
+	}
+}
+
+// runRefreshHook calls fn, turning a panic into a logged error so that a broken
+// hook doesn't kill the background thread.
+func (d *dockerCache) runRefreshHook(fn func(pods []*kubecontainer.Pod, asOf time.Time), pods []*kubecontainer.Pod, asOf time.Time) {
+	defer func() {
+		if r := recover(); r != nil {
+			for _, fn := range util.PanicHandlers {
+				fn(r)
+			}
+			glog.Errorf("Docker cache %q refresh hook panicked: %v", d.name, r)
+		}
+	}()
+	fn(pods, asOf)
+}
+
+func (d *dockerCache) ForceUpdateIfOlder(minExpectedCacheTime time.Time) error {
+	defer d.runCallbacks()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.stopped {
+		return ErrCacheStopped
+	}
+	// The cache can't be fresher than now: expecting so would list docker
+	// on every call.
+	if now := d.clock.Now(); minExpectedCacheTime.After(now) {
+		glog.Warningf("Docker cache %q refresh requested with pods from %v, which is in the future, using %v instead", d.name, minExpectedCacheTime, now)
+		minExpectedCacheTime = now
+	}
+	return d.refreshIfOlder(minExpectedCacheTime)
+}
+
+func (d *dockerCache) AssertUpToDate() error {
+	return d.ForceUpdateIfOlder(d.clock.Now())
+}
+
+// refreshIfOlder refreshes the cache unless it was refreshed at or after
+// minCacheTime, and returns an error if the refresh didn't make it that fresh,
+// e.g. because the clock went backwards. Must be called with d.lock held.
+func (d *dockerCache) refreshIfOlder(minCacheTime time.Time) error {
+	if !d.cacheTime.Before(minCacheTime) {
+		return nil
+	}
+	// Callers with the same expectations are serialized by d.lock: all but
+	// the first find the cache fresh enough above, and return without
+	// listing docker. A background refresh in flight may also do.
+	if d.refreshing {
+		if err := d.updateCache(context.Background()); err != nil || !d.cacheTime.Before(minCacheTime) {
+			return err
+		}
+	}
+	if err := d.updateCache(context.Background()); err != nil {
+		return err
+	}
+	if d.cacheTime.Before(minCacheTime) {
+		return fmt.Errorf("docker cache refreshed with pods from %v, older than the requested %v", d.cacheTime, minCacheTime)
+	}
+	return nil
+}
+
+// GetPodsMaxStale is like GetPods, but refreshes the cache if it is older than
+// maxStale instead of the sync staleness threshold.
+func (d *dockerCache) GetPodsMaxStale(maxStale time.Duration) ([]*kubecontainer.Pod, error) {
+	defer d.runCallbacks()
+	if maxStale < 0 {
+		maxStale = 0
+	}
+	// The age is measured from the call rather than from when d.lock is
+	// taken, so that concurrent callers share the refresh of the first one
+	// instead of listing docker in turn.
+	minCacheTime := d.clock.Now().Add(-maxStale)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.stopped {
+		return nil, ErrCacheStopped
+	}
+	if d.paused {
+		if d.cacheTime.Before(minCacheTime) {
+			err := d.staleError(ErrCachePaused)
+			if withholdsPods(err) {
+				return nil, err
+			}
+			return copyPods(d.pods), err
+		}
+		return copyPods(d.pods), nil
+	}
+	if err := d.refreshIfOlder(minCacheTime); err != nil {
+		if d.cacheTime.IsZero() {
+			d.reset = false
+			d.keepUpdating()
+		}
+		err = d.staleError(err)
+		if withholdsPods(err) {
+			return nil, err
+		}
+		return copyPods(d.pods), err
+	}
+	d.podsIdle.touch(d.clock.Now(), d.idleTimeout)
+	d.keepUpdating()
+	return copyPods(d.pods), nil
+}
+
+func (d *dockerCache) Prime(pods []*kubecontainer.Pod, asOf time.Time) {
+	defer d.runCallbacks()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.stopped {
+		return
+	}
+	age := d.clock.Since(asOf)
+	if age < 0 || age > d.syncStalenessThreshold || !asOf.After(d.cacheTime) {
+		glog.V(4).Infof("Not priming docker cache %q with pods listed at %v", d.name, asOf)
+		return
+	}
+	// docker wasn't listed: the cache isn't any healthier.
+	d.storePods(copyPods(pods), asOf)
+}
+
+func (d *dockerCache) WaitForInitialSync(timeout time.Duration) error {
+	defer d.runCallbacks()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for {
+		if d.stopped {
+			return ErrCacheStopped
+		}
+		if !d.cacheTime.IsZero() {
+			return nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if err := d.updateCache(ctx); err == nil {
+			return nil
+		}
+		// Don't hold the lock while waiting to retry.
+		d.lock.Unlock()
+		select {
+		case <-ctx.Done():
+		case <-time.After(d.refreshInterval):
+		}
+		d.lock.Lock()
+	}
+	if d.lastError != nil {
+		return fmt.Errorf("docker cache was not synced within %v: %v", timeout, d.lastError)
+	}
+	return fmt.Errorf("docker cache was not synced within %v", timeout)
+}
+
+func (d *dockerCache) ForceUpdate() error {
+	return d.ForceUpdateWithContext(context.Background())
+}
+
+func (d *dockerCache) ForceUpdateWithContext(ctx context.Context) error {
+	defer d.runCallbacks()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.stopped {
+		return ErrCacheStopped
+	}
+	// The listing may complete before its caller records the outcome: wait
+	// for it, so that the refresh isn't repeated meanwhile.
+	for d.forceUpdateDebounce > 0 && d.forceUpdateDone != nil {
+		if err := d.waitForRefresh(ctx, d.forceUpdateDone); err != nil {
+			return err
+		}
+	}
+	if d.forceUpdateDebounce > 0 && !d.lastForceUpdate.IsZero() && d.clock.Since(d.lastForceUpdate) < d.forceUpdateDebounce {
+		return d.lastForceUpdateError
+	}
+	if d.forceUpdateDebounce > 0 {
+		done := make(chan struct{})
+		d.forceUpdateDone = done
+		defer func() {
+			d.forceUpdateDone = nil
+			close(done)
+		}()
+	}
+	err := d.updateCache(ctx)
+	if err == nil || err != ctx.Err() {
+		d.lastForceUpdate = d.clock.Now()
+		d.lastForceUpdateError = err
+	}
+	return err
+}
+
+// updateCache lists docker and stores the result. The cache content is left
+// untouched on failure. If docker is already being listed, by the background
+// thread or another caller, its result is shared instead. d.lock is released
+// while waiting for the listing, which is given up on with
+// ErrSyncRefreshTimeout after d.syncRefreshTimeout, or with ctx.Err() once ctx
+// is done. Must be called with d.lock held.
+func (d *dockerCache) updateCache(ctx context.Context) error {
+	if d.stopped {
+		return ErrCacheStopped
+	}
+	if !d.refreshing {
+		if d.circuitState() == CircuitOpen {
+			return ErrCircuitOpen
+		}
+		d.startRefresh()
+	}
+	// Later listings may complete before this caller gets d.lock back:
+	// report the outcome of the one it waited for.
+	r := d.refresh
+	if err := d.waitForRefresh(ctx, r.done); err != nil {
+		return err
+	}
+	return r.err
+}
+
+// refreshResult is the outcome of a listing of docker, shared by all the
+// callers waiting for it.
+type refreshResult struct {
+	// Closed once err is set.
+	done chan struct{}
+	err  error
+}
+
+func newRefreshResult() *refreshResult {
+	return &refreshResult{done: make(chan struct{})}
+}
+
+// finish records the error of the listing, nil if it succeeded, and wakes up
+// the waiters. Must be called with d.lock held.
+func (r *refreshResult) finish(err error) {
+	r.err = err
+	close(r.done)
+}
+
+// waitForRefresh releases d.lock until done is closed, and returns
+// ErrSyncRefreshTimeout after d.syncRefreshTimeout, or ctx.Err() once ctx is
+// done, if it isn't. Must be called with d.lock held.
+func (d *dockerCache) waitForRefresh(ctx context.Context, done chan struct{}) error {
+	d.lock.Unlock()
+	timeout := time.NewTimer(d.syncRefreshTimeout)
+	defer timeout.Stop()
+	select {
+	case <-done:
+		d.lock.Lock()
+		return nil
+	case <-ctx.Done():
+		d.lock.Lock()
+		return ctx.Err()
+	case <-timeout.C:
+		d.lock.Lock()
+		glog.Warningf("Docker cache %q not refreshed within %v, serving cached pods", d.name, d.syncRefreshTimeout)
+		return ErrSyncRefreshTimeout
+	}
+}
+
+// startRefresh starts listing docker with syncRefresh, unless that's already
+// being done. Must be called with d.lock held.
+func (d *dockerCache) startRefresh() {
+	if d.refreshing {
+		return
+	}
+	d.refreshing = true
+	d.refresh = newRefreshResult()
+	d.updater.Add(1)
+	go d.syncRefresh(d.getter)
+}
+
+// syncRefresh lists docker for updateCache without d.lock held, and stores the
+// result. d.refreshing must have been set with d.lock held.
+func (d *dockerCache) syncRefresh(getter podsGetter) {
+	defer d.updater.Done()
+	// Nobody may be waiting for the listing anymore. The failures are
+	// left to the waiters, so they see them before their call returns.
+	defer d.runRefreshHooks()
+	pods, latency, err := d.listPods(d.ctx, getter, syncRefresh, false)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.refreshing = false
+	// Stop doesn't wait for the listings in flight: drop their results.
+	if d.stopped {
+		d.refresh.finish(ErrCacheStopped)
+		return
+	}
+	if err != nil {
+		err = d.refreshError(err, d.cacheTime)
+		d.recordFailure(err)
+		d.refresh.finish(err)
+		return
+	}
+	d.setPods(pods, d.clock.Now(), latency)
+	d.refresh.finish(nil)
+}
+
+func (d *dockerCache) SetGetter(getter podsGetter) error {
+	if getter == nil {
+		return errors.New("dockerCache: getter must not be nil")
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.getter = getter
+	return nil
+}
+
+func (d *dockerCache) Reset() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	// Let the refreshes in flight finish first, so that they can't bring
+	// back pods listed before the reset.
+	for d.refreshing || d.allRefreshing {
+		done := d.refresh.done
+		if !d.refreshing {
+			done = d.allRefresh.done
+		}
+		d.lock.Unlock()
+		<-done
+		d.lock.Lock()
+	}
+	d.cacheTime = time.Time{}
+	d.pods = nil
+	d.podsByUID = nil
+	// Keep the generation, so that the pods reloaded after the reset are
+	// newer than whatever generation callers hold.
+	d.podGenerations = nil
+	d.removedPods = lru.New(d.removedPodsCacheSize)
+	d.misses = nil
+	d.podRestarts = nil
+	d.podsByNamespace = nil
+	d.containersByID = nil
+	d.containersByImage = nil
+	d.containerCount = 0
+	d.lastRefreshDuration = 0
+	d.allPodsTime = time.Time{}
+	d.allPods = nil
+	d.podStatuses = nil
+	d.containerStates = nil
+	d.allPodsIdle = idleTimer{}
+	d.evictedPods = nil
+	d.lastError = nil
+	d.consecutiveFailures = 0
+	d.circuitOpenedAt = time.Time{}
+	d.clearRecentErrors()
+	d.lastForceUpdate = time.Time{}
+	d.lastForceUpdateError = nil
+	d.backoff = 0
+	d.podsIdle = idleTimer{}
+	d.reset = true
+}
+
+func (d *dockerCache) EvictPod(uid types.UID) {
+	defer d.runCallbacks()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	_, evicted := d.podsByUID[uid]
+	if evicted {
+		pods := make([]*kubecontainer.Pod, 0, len(d.pods)-1)
+		for _, pod := range d.pods {
+			if pod.ID != uid {
+				pods = append(pods, pod)
+			}
+		}
+		d.indexPods(pods)
+	}
+	for i, pod := range d.allPods {
+		if pod.ID != uid {
+			continue
+		}
+		for _, c := range pod.Containers {
+			delete(d.containerStates, c.ID)
+		}
+		allPods := make([]*kubecontainer.Pod, 0, len(d.allPods)-1)
+		allPods = append(allPods, d.allPods[:i]...)
+		d.allPods = append(allPods, d.allPods[i+1:]...)
+		evicted = true
+		break
+	}
+	if evicted && len(d.observers) > 0 {
+		d.pendingEvictions = append(d.pendingEvictions, uid)
+	}
+	delete(d.podStatuses, uid)
+	if d.evictedPods == nil {
+		d.evictedPods = make(map[types.UID]bool)
+	}
+	d.evictedPods[uid] = true
+}
+
+func (d *dockerCache) Pause() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.stopped || d.paused {
+		return
+	}
+	glog.Infof("Pausing docker cache %q", d.name)
+	d.paused = true
+}
+
+func (d *dockerCache) Resume() error {
+	defer d.runCallbacks()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.stopped {
+		return ErrCacheStopped
+	}
+	if !d.paused {
+		return nil
+	}
+	glog.Infof("Resuming docker cache %q", d.name)
+	d.paused = false
+	err := d.updateCache(context.Background())
+	d.podsIdle.touch(d.clock.Now(), d.idleTimeout)
+	d.keepUpdating()
+	return err
+}
+
+func (d *dockerCache) DebugGoroutineCount() int {
+	return int(atomic.LoadInt32(&d.updaterGoroutines) + atomic.LoadInt32(&d.listingGoroutines))
+}
+
+func (d *dockerCache) Name() string {
+	return d.name
+}
+
+func (d *dockerCache) ReadOnlyView() DockerCacheView {
+	return readOnlyView{d}
+}
+
+func (d *dockerCache) Stop() {
+	d.stopOnce.Do(func() {
+		d.lock.Lock()
+		d.stopped = true
+		close(d.stopCh)
+		d.cancel()
+		for id, s := range d.subscribers {
+			delete(d.subscribers, id)
+			close(s.ch)
+		}
+		for id, s := range d.eventSubscribers {
+			delete(d.eventSubscribers, id)
+			close(s.ch)
+		}
+		d.refreshHooks = nil
+		d.lock.Unlock()
+		ageCollector.remove(d)
+	})
+	// The cached pods can't change anymore: they are the most recent ones
+	// to save.
+	defer d.saveSnapshot(true)
+	if d.stopTimeout == 0 {
+		d.updater.Wait()
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		d.updater.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(d.stopTimeout):
+		glog.Warningf("Docker cache %q refreshes still running %v after being stopped", d.name, d.stopTimeout)
+	}
+}
+
+// copyPods returns a deep copy of pods, so that callers can't observe or cause
+// writes to the cached pods.
+func copyPods(pods []*kubecontainer.Pod) []*kubecontainer.Pod {
+	if pods == nil {
+		return nil
+	}
+	result := make([]*kubecontainer.Pod, len(pods))
+	for i, pod := range pods {
+		result[i] = pod.DeepCopy()
+	}
+	return result
+}
+
+// nextBackoff returns the delay before the next background refresh. The delay
+// doubles after every failed refresh, up to d.maxBackoff, and goes back to
+// d.refreshInterval as soon as a refresh succeeds. Must be called with d.lock
+// held.
+func (d *dockerCache) nextBackoff(failed bool) time.Duration {
+	switch {
+	case !failed || d.backoff == 0:
+		d.backoff = d.refreshInterval
+	case d.backoff < d.maxBackoff:
+		d.backoff *= 2
+		if d.backoff > d.maxBackoff {
+			d.backoff = d.maxBackoff
+		}
+	}
+	return d.backoff
+}
+
+// adaptToLatency lengthens delay to d.latencyFactor times the latency of the
+// last refresh, if that is longer.
+func (d *dockerCache) adaptToLatency(delay, latency time.Duration) time.Duration {
+	if min := time.Duration(d.latencyFactor * float64(latency)); min > delay {
+		return min
+	}
+	return delay
+}
+
+// jitter randomly shortens or lengthens delay by up to d.jitterFactor of it,
+// leaving the mean delay unchanged.
+func (d *dockerCache) jitter(delay time.Duration) time.Duration {
+	if d.jitterFactor == 0 {
+		return delay
+	}
+	return delay + time.Duration((2*d.random()-1)*d.jitterFactor*float64(delay))
+}
+
+// clampDelay returns the pause the background thread should actually take
+// before its next listing.
+func (d *dockerCache) clampDelay(delay time.Duration) time.Duration {
+	if delay < d.minBackgroundInterval {
+		return d.minBackgroundInterval
+	}
+	return delay
+}
+
+// idleTimer measures how long a cache went without being read. It only counts
+// the time the clock moves forward, checking after checking, so that the clock
+// going back, e.g. after an NTP correction or a VM resume, doesn't keep the
+// background thread running until it catches up with a stop time in the
+// future. The zero value is expired.
+type idleTimer struct {
+	// How much longer the cache may go without a read, once negative.
+	left      time.Duration
+	lastCheck time.Time
+}
+
+// touch records a read at now, restarting the timer for timeout.
+func (t *idleTimer) touch(now time.Time, timeout time.Duration) {
+	t.left = timeout
+	t.lastCheck = now
+}
+
+// expired returns true if more than the timeout elapsed since the last read,
+// counting the time from the previous check to now if the clock moved forward.
+func (t *idleTimer) expired(now time.Time) bool {
+	if t.lastCheck.IsZero() {
+		return true
+	}
+	// Stop counting once expired, so that a jump far ahead doesn't
+	// overflow.
+	if elapsed := now.Sub(t.lastCheck); elapsed > 0 && t.left >= 0 {
+		t.left -= elapsed
+	}
+	t.lastCheck = now
+	return t.left < 0
+}
+
+// idle returns true if neither GetPods nor GetAllPods were called within the
+// idle timeout. Must be called with d.lock held.
+func (d *dockerCache) idle() bool {
+	now := d.clock.Now()
+	return d.podsIdle.expired(now) && d.allPodsIdle.expired(now)
+}
+
+// startUpdatingCache refreshes the cache until it is stopped, or idle with its
+// pods loaded and the circuit breaker closed. Until the pods first load, e.g.
+// while docker isn't up yet, it keeps retrying whatever the idle timer, and
+// while the circuit is open it probes docker once per cooldown, so that the
+// cache recovers even if nobody reads it. A cache which loaded once stops
+// when idle even if docker fails since. The thread only clears d.updatingCache while
+// holding d.lock, right before returning without touching the cache again, so
+// that keepUpdating never runs two of them at the same time.
+func (d *dockerCache) startUpdatingCache() {
+	defer d.updater.Done()
+	atomic.AddInt32(&d.updaterGoroutines, 1)
+	defer atomic.AddInt32(&d.updaterGoroutines, -1)
+	glog.V(4).Infof("Docker cache %q updating thread started", d.name)
+	d.lock.Lock()
+	delay := d.nextBackoff(false)
+	d.lock.Unlock()
+	for {
+		select {
+		case <-d.stopCh:
+			d.lock.Lock()
+			d.updatingCache = false
+			d.lock.Unlock()
+			glog.V(4).Infof("Docker cache %q updating thread stopped", d.name)
+			return
+		case <-time.After(d.clampDelay(d.jitter(delay))):
+		}
+
+		d.lock.Lock()
+		if d.reset || d.paused {
+			d.updatingCache = false
+			d.lock.Unlock()
+			glog.V(4).Infof("Docker cache %q updating thread stopped after a reset or pause", d.name)
+			return
+		}
+		// Don't list docker again if the cache was just refreshed
+		// synchronously.
+		circuitOpen := d.circuitState() == CircuitOpen
+		refreshPods := !d.refreshing && !circuitOpen && d.clock.Since(d.cacheTime) >= d.refreshInterval
+		refreshAllPods := !d.allRefreshing && !circuitOpen && !d.allPodsIdle.expired(d.clock.Now()) && d.clock.Since(d.allPodsTime) >= d.refreshInterval
+		if refreshPods {
+			d.refreshing = true
+			d.refresh = newRefreshResult()
+		}
+		if refreshAllPods {
+			d.allRefreshing = true
+			d.allRefresh = newRefreshResult()
+		}
+		// List with the getter of the time the refresh started, even if
+		// SetGetter replaces it meanwhile.
+		getter := d.getter
+		d.lock.Unlock()
+
+		var pods, allPods []*kubecontainer.Pod
+		var latency time.Duration
+		var err, allErr error
+		if refreshPods {
+			pods, latency, err = d.listPods(d.ctx, getter, backgroundRefresh, false)
+		}
+		cacheTime := d.clock.Now()
+		if refreshAllPods {
+			allPods, _, allErr = d.listPods(d.ctx, getter, backgroundRefresh, true)
+		}
+
+		d.lock.Lock()
+		// Stop doesn't wait for the listings in flight: drop their
+		// results.
+		if d.stopped {
+			if refreshAllPods {
+				d.allRefreshing = false
+				d.allRefresh.finish(ErrCacheStopped)
+			}
+			if refreshPods {
+				d.refreshing = false
+				d.refresh.finish(ErrCacheStopped)
+			}
+			d.updatingCache = false
+			d.lock.Unlock()
+			glog.V(4).Infof("Docker cache %q updating thread stopped", d.name)
+			return
+		}
+		// Reset only waits for the pods to be listed, drop all the pods
+		// listed before it.
+		if refreshAllPods {
+			d.allRefreshing = false
+			var stored error
+			if !d.reset {
+				stored = d.storeAllPods(allPods, allErr)
+			}
+			d.allRefresh.finish(stored)
+		}
+		if refreshPods {
+			d.refreshing = false
+			if err != nil {
+				err = d.refreshError(err, d.cacheTime)
+				delay = d.adaptToLatency(d.nextBackoff(true), latency)
+				glog.V(2).Infof("Failed to refresh docker cache %q, retrying in %v: %v", d.name, delay, err)
+				d.recordFailure(err)
+			} else {
+				glog.V(4).Infof("Refreshed docker cache %q with %d pods", d.name, len(pods))
+				delay = d.adaptToLatency(d.nextBackoff(false), latency)
+				d.setPods(pods, cacheTime, latency)
+			}
+			d.refresh.finish(err)
+		}
+		if (err == nil || !d.cacheTime.IsZero()) && d.idle() && d.circuitOpenedAt.IsZero() {
 			d.updatingCache = false
-			run = false
+			d.lock.Unlock()
+			d.runCallbacks()
+			d.saveSnapshot(false)
+			glog.V(4).Infof("Docker cache %q updating thread stopped after being idle", d.name)
+			return
 		}
-		d.pods = pods
-		d.cacheTime = cacheTime
 		d.lock.Unlock()
+		d.runCallbacks()
+		d.saveSnapshot(false)
 	}
 }
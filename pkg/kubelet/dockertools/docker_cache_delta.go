@@ -0,0 +1,126 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockertools
+
+import (
+	"sort"
+	"sync"
+
+	kubecontainer "github.com/GoogleCloudPlatform/kubernetes/pkg/kubelet/container"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/types"
+	"golang.org/x/net/context"
+)
+
+// podDeltaSource is a cache a DeltaReader reads from.
+type podDeltaSource interface {
+	// podsModifiedSince returns the pods added or modified after the given
+	// generation, like GetPodsModifiedSince, the UIDs of the known pods
+	// which are no longer cached, and the current generation.
+	podsModifiedSince(generation uint64, known map[types.UID]*kubecontainer.Pod) ([]*kubecontainer.Pod, []types.UID, uint64, error)
+	// podChanged returns true if pod differs from old, of the same UID, at
+	// the granularity the cache detects changes at.
+	podChanged(old, pod *kubecontainer.Pod) bool
+}
+
+// DeltaReader returns the changes of the pods of a DockerCache between its
+// successive calls, so that polling consumers don't have to keep track of the
+// generations of the cache. Readers are independent of each other, and safe
+// for concurrent use.
+type DeltaReader struct {
+	source podDeltaSource
+
+	lock sync.Mutex
+	// Generation of the cache at the previous call.
+	generation uint64
+	// The pods returned so far, by UID.
+	pods map[types.UID]*kubecontainer.Pod
+}
+
+func newDeltaReader(source podDeltaSource) *DeltaReader {
+	return &DeltaReader{
+		source: source,
+		pods:   make(map[types.UID]*kubecontainer.Pod),
+	}
+}
+
+// Changed returns the pods added, removed and modified since the previous
+// call, all the cached pods being added on the first call. Removed pods are
+// returned as they were last seen, sorted by UID. The cache is refreshed under
+// the same rules as GetPods, and the error is the one GetPods would return:
+// the changes are dropped, and reported again on the next call, only when no
+// pods are served.
+func (r *DeltaReader) Changed() (added, removed, modified []*kubecontainer.Pod, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	pods, removedIDs, generation, err := r.source.podsModifiedSince(r.generation, r.pods)
+	if withholdsPods(err) {
+		return nil, nil, nil, err
+	}
+	for _, pod := range pods {
+		old, found := r.pods[pod.ID]
+		switch {
+		case !found:
+			added = append(added, pod)
+		case r.source.podChanged(old, pod):
+			modified = append(modified, pod)
+		default:
+			continue
+		}
+		r.pods[pod.ID] = pod.DeepCopy()
+	}
+	for _, uid := range removedIDs {
+		removed = append(removed, r.pods[uid])
+		delete(r.pods, uid)
+	}
+	sort.Sort(podsByID(removed))
+	r.generation = generation
+	return added, removed, modified, err
+}
+
+func (d *dockerCache) NewDeltaReader() *DeltaReader {
+	return newDeltaReader(d)
+}
+
+func (d *dockerCache) podChanged(old, pod *kubecontainer.Pod) bool {
+	return !podEqual(d.changeDetection, old, pod)
+}
+
+func (d *dockerCache) podsModifiedSince(generation uint64, known map[types.UID]*kubecontainer.Pod) ([]*kubecontainer.Pod, []types.UID, uint64, error) {
+	defer d.runCallbacks()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	err := d.updateIfStale(context.Background())
+	if withholdsPods(err) {
+		return nil, nil, 0, err
+	}
+	if generation > d.generation {
+		generation = 0
+	}
+	var pods []*kubecontainer.Pod
+	for _, pod := range d.pods {
+		if d.podGenerations[pod.ID] > generation {
+			pods = append(pods, pod.DeepCopy())
+		}
+	}
+	var removed []types.UID
+	for uid := range known {
+		if _, found := d.podsByUID[uid]; !found {
+			removed = append(removed, uid)
+		}
+	}
+	return pods, removed, d.generation, err
+}
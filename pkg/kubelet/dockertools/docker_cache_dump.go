@@ -0,0 +1,89 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockertools
+
+import (
+	"encoding/json"
+	"time"
+
+	kubecontainer "github.com/GoogleCloudPlatform/kubernetes/pkg/kubelet/container"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/types"
+)
+
+// DockerCacheDump is the JSON serialization of the content of a DockerCache
+// returned by DumpJSON. Fields may be added, but the existing ones keep
+// their name and meaning.
+type DockerCacheDump struct {
+	// Time of the most recent successful refresh, zero if none.
+	CacheTime time.Time `json:"cacheTime"`
+	// Number of cached pods.
+	PodCount int `json:"podCount"`
+	// The cached pods, sorted by UID.
+	Pods []PodDump `json:"pods"`
+}
+
+// PodDump is a cached pod in a DockerCacheDump.
+type PodDump struct {
+	ID         types.UID       `json:"id"`
+	Name       string          `json:"name"`
+	Namespace  string          `json:"namespace"`
+	Containers []ContainerDump `json:"containers"`
+}
+
+// ContainerDump is a container of a cached pod in a DockerCacheDump.
+type ContainerDump struct {
+	ID    types.UID                    `json:"id"`
+	Name  string                       `json:"name"`
+	Image string                       `json:"image"`
+	State kubecontainer.ContainerState `json:"state"`
+	// Creation time of the container, in seconds since the epoch.
+	Created int64 `json:"created"`
+}
+
+func (d *dockerCache) DumpJSON() ([]byte, error) {
+	d.lock.Lock()
+	dump := DockerCacheDump{
+		CacheTime: d.cacheTime,
+		PodCount:  len(d.pods),
+		Pods:      make([]PodDump, 0, len(d.pods)),
+	}
+	for _, pod := range d.pods {
+		dump.Pods = append(dump.Pods, newPodDump(pod))
+	}
+	d.lock.Unlock()
+	return json.Marshal(dump)
+}
+
+// newPodDump returns the serialization of pod.
+func newPodDump(pod *kubecontainer.Pod) PodDump {
+	dump := PodDump{
+		ID:         pod.ID,
+		Name:       pod.Name,
+		Namespace:  pod.Namespace,
+		Containers: make([]ContainerDump, 0, len(pod.Containers)),
+	}
+	for _, c := range pod.Containers {
+		dump.Containers = append(dump.Containers, ContainerDump{
+			ID:      c.ID,
+			Name:    c.Name,
+			Image:   c.Image,
+			State:   c.State,
+			Created: c.Created,
+		})
+	}
+	return dump
+}
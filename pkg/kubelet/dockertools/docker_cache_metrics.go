@@ -0,0 +1,181 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockertools
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	dockerCacheSubsystem = "kubelet"
+
+	// Label set to the name of the cache on all the metrics.
+	cacheLabel = "cache"
+
+	// Refresh types used as metric labels.
+	syncRefresh       = "sync"
+	backgroundRefresh = "background"
+)
+
+var (
+	dockerCacheRefreshCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: dockerCacheSubsystem,
+			Name:      "docker_cache_refresh_total",
+			Help:      "Number of docker cache refreshes. Broken down by cache and refresh type: sync or background.",
+		},
+		[]string{cacheLabel, "refresh_type"},
+	)
+	dockerCacheRefreshErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: dockerCacheSubsystem,
+			Name:      "docker_cache_refresh_errors_total",
+			Help:      "Number of failed docker cache refreshes. Broken down by cache and refresh type: sync or background.",
+		},
+		[]string{cacheLabel, "refresh_type"},
+	)
+	dockerCacheRefreshLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Subsystem: dockerCacheSubsystem,
+			Name:      "docker_cache_refresh_latency_microseconds",
+			Help:      "Latency in microseconds of listing docker to refresh the docker cache. Broken down by cache and refresh type: sync or background.",
+			// Use buckets ranging from 1 ms to 4 seconds.
+			Buckets: prometheus.ExponentialBuckets(1000, 2.0, 13),
+		},
+		[]string{cacheLabel, "refresh_type"},
+	)
+	dockerCacheTruncatedRefreshes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: dockerCacheSubsystem,
+			Name:      "docker_cache_truncated_refreshes_total",
+			Help:      "Number of docker cache refreshes which listed more pods than the configured maximum. Broken down by cache.",
+		},
+		[]string{cacheLabel},
+	)
+	dockerCacheDuplicatePods = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: dockerCacheSubsystem,
+			Name:      "docker_cache_duplicate_pods_total",
+			Help:      "Number of pods dropped from docker listings because another pod with the same UID was listed. Broken down by cache.",
+		},
+		[]string{cacheLabel},
+	)
+	dockerCacheSyncRefreshes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: dockerCacheSubsystem,
+			Name:      "docker_cache_sync_refresh_total",
+			Help:      "Number of docker cache reads which listed docker synchronously because the cached pods were stale. Many of them compared to background refreshes mean that the idle shutdown timeout is too short for the poll period of the callers. Broken down by cache.",
+		},
+		[]string{cacheLabel},
+	)
+	dockerCacheSubscriberDrops = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: dockerCacheSubsystem,
+			Name:      "docker_cache_subscriber_dropped_total",
+			Help:      "Number of pod snapshots and events dropped because a docker cache subscriber didn't receive them fast enough. Broken down by cache and subscriber.",
+		},
+		[]string{cacheLabel, "subscriber"},
+	)
+	dockerCacheAgeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("", dockerCacheSubsystem, "docker_cache_age_seconds"),
+		"Time in seconds since the docker cache was last refreshed successfully. Broken down by cache.",
+		[]string{cacheLabel}, nil)
+)
+
+var (
+	registerDockerCacheMetrics sync.Once
+	ageCollector               = &dockerCacheAgeCollector{caches: make(map[string]DockerCache)}
+)
+
+// RegisterMetrics registers the docker cache metrics. The cache age is
+// reported for the given cache, under its name, until it is stopped: call it
+// for every cache whose age should be reported. It fails if another cache of
+// the same name is reported.
+func RegisterMetrics(cache DockerCache) error {
+	registerDockerCacheMetrics.Do(func() {
+		prometheus.MustRegister(dockerCacheRefreshCount)
+		prometheus.MustRegister(dockerCacheRefreshErrors)
+		prometheus.MustRegister(dockerCacheRefreshLatency)
+		prometheus.MustRegister(dockerCacheTruncatedRefreshes)
+		prometheus.MustRegister(dockerCacheDuplicatePods)
+		prometheus.MustRegister(dockerCacheSyncRefreshes)
+		prometheus.MustRegister(dockerCacheSubscriberDrops)
+		prometheus.MustRegister(ageCollector)
+	})
+	return ageCollector.add(cache)
+}
+
+// recordRefresh updates the refresh metrics of the named cache with the
+// outcome of a docker listing which took the given time.
+func recordRefresh(name, refreshType string, latency time.Duration, err error) {
+	dockerCacheRefreshCount.WithLabelValues(name, refreshType).Inc()
+	dockerCacheRefreshLatency.WithLabelValues(name, refreshType).Observe(float64(latency / time.Microsecond))
+	if err != nil {
+		dockerCacheRefreshErrors.WithLabelValues(name, refreshType).Inc()
+	}
+}
+
+// Custom collector reporting the current age of docker caches, keyed by name.
+type dockerCacheAgeCollector struct {
+	lock   sync.Mutex
+	caches map[string]DockerCache
+}
+
+func (c *dockerCacheAgeCollector) add(cache DockerCache) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	name := cache.Name()
+	if registered, found := c.caches[name]; found && registered != cache {
+		return fmt.Errorf("the age of another docker cache named %q is already reported", name)
+	}
+	c.caches[name] = cache
+	return nil
+}
+
+// remove stops reporting the age of cache, if it is the one reported under
+// its name.
+func (c *dockerCacheAgeCollector) remove(cache DockerCache) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if name := cache.Name(); c.caches[name] == cache {
+		delete(c.caches, name)
+	}
+}
+
+func (c *dockerCacheAgeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dockerCacheAgeDesc
+}
+
+func (c *dockerCacheAgeCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for name, cache := range c.caches {
+		lastUpdated := cache.LastUpdated()
+		if lastUpdated.IsZero() {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(
+			dockerCacheAgeDesc,
+			prometheus.GaugeValue,
+			time.Since(lastUpdated).Seconds(),
+			name)
+	}
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockertools
+
+import (
+	"time"
+
+	kubecontainer "github.com/GoogleCloudPlatform/kubernetes/pkg/kubelet/container"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/types"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/util"
+	"github.com/golang/glog"
+)
+
+// CacheObserver is notified of the docker listings and evictions of a
+// DockerCache, e.g. to log them, record metrics or notify other components
+// from a single place. Its methods are called without any lock of the cache
+// held, from whichever goroutine listed docker or evicted the pod, so they
+// may use the cache. An observer which panics is skipped. Embed
+// NoopCacheObserver to implement only some of the methods.
+type CacheObserver interface {
+	// RefreshStarted is called before every docker listing.
+	RefreshStarted()
+	// RefreshSucceeded is called with the raw result of every successful
+	// docker listing and how long it took, before the cache drops, sorts
+	// or copies anything. The pods must not be modified.
+	RefreshSucceeded(pods []*kubecontainer.Pod, duration time.Duration)
+	// RefreshFailed is called with the error of every failed docker
+	// listing and how long it took.
+	RefreshFailed(err error, duration time.Duration)
+	// CacheEvicted is called with the UID of every pod dropped by
+	// EvictPod, once it was dropped. Evicting a pod which isn't cached is
+	// not notified.
+	CacheEvicted(uid types.UID)
+}
+
+// NoopCacheObserver is a CacheObserver ignoring everything.
+type NoopCacheObserver struct{}
+
+var _ CacheObserver = NoopCacheObserver{}
+
+func (NoopCacheObserver) RefreshStarted()                                      {}
+func (NoopCacheObserver) RefreshSucceeded([]*kubecontainer.Pod, time.Duration) {}
+func (NoopCacheObserver) RefreshFailed(error, time.Duration)                   {}
+func (NoopCacheObserver) CacheEvicted(types.UID)                               {}
+
+// tapObserver hands every docker listing to the Tap of a DockerCacheConfig.
+type tapObserver struct {
+	NoopCacheObserver
+	tap func(pods []*kubecontainer.Pod, err error, duration time.Duration)
+}
+
+func (o tapObserver) RefreshSucceeded(pods []*kubecontainer.Pod, duration time.Duration) {
+	o.tap(pods, nil, duration)
+}
+
+func (o tapObserver) RefreshFailed(err error, duration time.Duration) {
+	o.tap(nil, err, duration)
+}
+
+// notifyObservers calls fn with every observer, recovering from their panics.
+// Must be called without d.lock held.
+func (d *dockerCache) notifyObservers(fn func(o CacheObserver)) {
+	for _, o := range d.observers {
+		d.notifyObserver(o, fn)
+	}
+}
+
+func (d *dockerCache) notifyObserver(o CacheObserver, fn func(o CacheObserver)) {
+	defer func() {
+		if r := recover(); r != nil {
+			for _, fn := range util.PanicHandlers {
+				fn(r)
+			}
+			glog.Errorf("Docker cache %q observer %T panicked: %v", d.name, o, r)
+		}
+	}()
+	fn(o)
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockertools
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	kubecontainer "github.com/GoogleCloudPlatform/kubernetes/pkg/kubelet/container"
+	"github.com/golang/glog"
+)
+
+// SnapshotStore persists the pods of a DockerCache, so that a new cache, e.g.
+// after the kubelet restarted, starts with the pods listed by the previous
+// one instead of empty.
+type SnapshotStore interface {
+	// Save stores the pods listed at the given time, replacing the
+	// previous snapshot. Failures are only logged: a snapshot is an
+	// optimization.
+	Save(pods []*kubecontainer.Pod, asOf time.Time)
+	// Load returns the last saved pods and the time they were listed at,
+	// a zero time if no snapshot was ever saved.
+	Load() ([]*kubecontainer.Pod, time.Time, error)
+}
+
+// FileSnapshotStore is a SnapshotStore keeping the snapshot in a JSON file.
+type FileSnapshotStore struct {
+	path string
+}
+
+// NewFileSnapshotStore returns a store keeping the snapshot at path. The
+// directory of path must exist.
+func NewFileSnapshotStore(path string) *FileSnapshotStore {
+	return &FileSnapshotStore{path: path}
+}
+
+// fileSnapshot is the content of the file of a FileSnapshotStore.
+type fileSnapshot struct {
+	Time time.Time            `json:"time"`
+	Pods []*kubecontainer.Pod `json:"pods"`
+}
+
+func (s *FileSnapshotStore) Save(pods []*kubecontainer.Pod, asOf time.Time) {
+	data, err := json.Marshal(fileSnapshot{Time: asOf, Pods: pods})
+	if err != nil {
+		glog.Errorf("Failed to encode the docker cache snapshot: %v", err)
+		return
+	}
+	// Write to a temporary file first, so that a crash can't leave a
+	// truncated snapshot behind.
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		glog.Errorf("Failed to save the docker cache snapshot to %q: %v", s.path, err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		glog.Errorf("Failed to save the docker cache snapshot to %q: %v", s.path, err)
+	}
+}
+
+func (s *FileSnapshotStore) Load() ([]*kubecontainer.Pod, time.Time, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, time.Time{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var snapshot fileSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, time.Time{}, err
+	}
+	return snapshot.Pods, snapshot.Time, nil
+}
+
+// loadSnapshot loads the pods of d.snapshotStore into the cache, unless they
+// are older than d.snapshotMaxAge. Must be called with d.lock held.
+func (d *dockerCache) loadSnapshot() {
+	pods, asOf, err := d.snapshotStore.Load()
+	if err != nil {
+		glog.Warningf("Docker cache %q failed to load its snapshot: %v", d.name, err)
+		return
+	}
+	if asOf.IsZero() {
+		return
+	}
+	if age := d.clock.Since(asOf); age < 0 || age > d.snapshotMaxAge {
+		glog.V(2).Infof("Docker cache %q discarding its snapshot listed %v ago", d.name, age)
+		return
+	}
+	glog.V(2).Infof("Docker cache %q loaded %d pods from its snapshot listed %v ago", d.name, len(pods), d.clock.Since(asOf))
+	// docker wasn't listed: the cache isn't any healthier.
+	d.storePods(pods, asOf)
+	d.lastSnapshot = asOf
+}
+
+// saveSnapshot saves the cached pods to d.snapshotStore, unless they were
+// already saved or, if force is not set, were listed less than
+// d.snapshotInterval after the last saved ones. Must be called without d.lock
+// held.
+func (d *dockerCache) saveSnapshot(force bool) {
+	d.lock.Lock()
+	if d.snapshotStore == nil || d.cacheTime.IsZero() || !d.cacheTime.After(d.lastSnapshot) ||
+		(!force && d.cacheTime.Sub(d.lastSnapshot) < d.snapshotInterval) {
+		d.lock.Unlock()
+		return
+	}
+	// The cached pods are replaced, never modified, so they can be copied
+	// without d.lock held.
+	pods, asOf := d.pods, d.cacheTime
+	d.lastSnapshot = asOf
+	d.lock.Unlock()
+	d.snapshotStore.Save(copyPods(pods), asOf)
+}
@@ -0,0 +1,5321 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockertools
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
+	kubecontainer "github.com/GoogleCloudPlatform/kubernetes/pkg/kubelet/container"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/labels"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/types"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/util"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/util/wait"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/net/context"
+)
+
+// fakePodsGetter is a podsGetter returning a fixed set of pods and counting
+// how many times it was called.
+type fakePodsGetter struct {
+	sync.Mutex
+	pods []*kubecontainer.Pod
+	// Returned instead of pods when all containers are listed, if set.
+	allPods  []*kubecontainer.Pod
+	err      error
+	calls    int
+	allCalls int
+}
+
+func (f *fakePodsGetter) GetPods(all bool) ([]*kubecontainer.Pod, error) {
+	f.Lock()
+	defer f.Unlock()
+	if all {
+		f.allCalls++
+		if f.allPods != nil {
+			return f.allPods, f.err
+		}
+		return f.pods, f.err
+	}
+	f.calls++
+	return f.pods, f.err
+}
+
+func (f *fakePodsGetter) callCount() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.calls
+}
+
+// blockingPodsGetter is a podsGetter that, once blocked, does not answer
+// until released.
+type blockingPodsGetter struct {
+	fakePodsGetter
+	blocked  bool
+	release  chan struct{}
+	listings chan struct{}
+}
+
+func newBlockingPodsGetter() *blockingPodsGetter {
+	return &blockingPodsGetter{
+		release:  make(chan struct{}),
+		listings: make(chan struct{}, 100),
+	}
+}
+
+func (f *blockingPodsGetter) GetPods(all bool) ([]*kubecontainer.Pod, error) {
+	f.Lock()
+	blocked := f.blocked
+	f.Unlock()
+	if blocked {
+		f.listings <- struct{}{}
+		<-f.release
+	}
+	return f.fakePodsGetter.GetPods(all)
+}
+
+func (f *blockingPodsGetter) setBlocked(blocked bool) {
+	f.Lock()
+	defer f.Unlock()
+	f.blocked = blocked
+}
+
+// fakeClock is a util.Clock whose time only moves when stepped. It is safe to
+// share with the background updater.
+type fakeClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.Lock()
+	defer f.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) Since(ts time.Time) time.Duration {
+	return f.Now().Sub(ts)
+}
+
+func (f *fakeClock) Step(d time.Duration) {
+	f.Lock()
+	defer f.Unlock()
+	f.now = f.now.Add(d)
+}
+
+// testDockerCacheConfig returns the base configuration of the caches under
+// test, with a short threshold and interval.
+func testDockerCacheConfig(clock util.Clock) DockerCacheConfig {
+	return DefaultDockerCacheConfig().
+		WithSyncStalenessThreshold(time.Second).
+		WithRefreshInterval(10 * time.Millisecond).
+		WithClock(clock)
+}
+
+func newTestDockerCache(t *testing.T, getter podsGetter, clock util.Clock) *dockerCache {
+	cache, err := NewDockerCache(getter, testDockerCacheConfig(clock))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return cache.(*dockerCache)
+}
+
+// waitForUpdaterStop waits until the background updater of d has exited.
+func waitForUpdaterStop(t *testing.T, d *dockerCache) {
+	err := wait.Poll(5*time.Millisecond, 5*time.Second, func() (bool, error) {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		return !d.updatingCache, nil
+	})
+	if err != nil {
+		t.Fatalf("background updater did not stop: %v", err)
+	}
+}
+
+func TestNewDockerCacheDefaults(t *testing.T) {
+	cache, err := NewDockerCache(&fakePodsGetter{}, DockerCacheConfig{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d := cache.(*dockerCache)
+	if d.syncStalenessThreshold != defaultSyncStalenessThreshold {
+		t.Errorf("expected sync staleness threshold %v, got %v", defaultSyncStalenessThreshold, d.syncStalenessThreshold)
+	}
+	if d.refreshInterval != defaultRefreshInterval {
+		t.Errorf("expected refresh interval %v, got %v", defaultRefreshInterval, d.refreshInterval)
+	}
+}
+
+func TestDefaultDockerCacheConfig(t *testing.T) {
+	config := DefaultDockerCacheConfig()
+	cache, err := NewDockerCacheDefault(&fakePodsGetter{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d := cache.(*dockerCache)
+	if d.syncStalenessThreshold != config.SyncStalenessThreshold || d.refreshInterval != config.RefreshInterval || d.idleTimeout != config.IdleShutdownTimeout {
+		t.Errorf("expected the default configuration %+v, got %+v", config, d)
+	}
+
+	tuned := config.WithRefreshInterval(time.Second).WithMaxPods(10)
+	if tuned.RefreshInterval != time.Second || tuned.MaxPods != 10 || tuned.SyncStalenessThreshold != config.SyncStalenessThreshold {
+		t.Errorf("unexpected tuned configuration %+v", tuned)
+	}
+	if config.RefreshInterval != defaultRefreshInterval || config.MaxPods != 0 {
+		t.Errorf("expected the base configuration to be left unchanged, got %+v", config)
+	}
+}
+
+func TestNewDockerCacheRejectsNilGetter(t *testing.T) {
+	if _, err := NewDockerCache(nil, DockerCacheConfig{}); err == nil {
+		t.Errorf("expected an error for a nil getter")
+	}
+}
+
+func TestNewDockerCacheValidatesRefreshInterval(t *testing.T) {
+	tests := []struct {
+		config DockerCacheConfig
+		valid  bool
+	}{
+		{DockerCacheConfig{SyncStalenessThreshold: time.Second, RefreshInterval: 500 * time.Millisecond}, true},
+		{DockerCacheConfig{SyncStalenessThreshold: time.Second, RefreshInterval: time.Second}, false},
+		{DockerCacheConfig{SyncStalenessThreshold: time.Second, RefreshInterval: 2 * time.Second}, false},
+		{DockerCacheConfig{SyncStalenessThreshold: 50 * time.Millisecond}, false},
+		{DockerCacheConfig{RefreshInterval: 3 * time.Second}, false},
+		{DockerCacheConfig{RefreshInterval: 10 * time.Millisecond}, true},
+		{DockerCacheConfig{RefreshInterval: time.Millisecond}, false},
+		{DockerCacheConfig{RefreshInterval: -time.Second}, false},
+	}
+	for i, test := range tests {
+		_, err := NewDockerCache(&fakePodsGetter{}, test.config)
+		if test.valid && err != nil {
+			t.Errorf("%d: unexpected error: %v", i, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%d: expected an error for %+v", i, test.config)
+		}
+	}
+}
+
+func TestDockerCacheBackedByRuntime(t *testing.T) {
+	runtime := &kubecontainer.FakeRuntime{Podlist: []*kubecontainer.Pod{{ID: "1234"}}}
+	cache, err := NewDockerCache(runtime, DockerCacheConfig{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer cache.Stop()
+
+	var runtimeCache kubecontainer.RuntimeCache = cache
+	pods, err := runtimeCache.GetPods()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pods) != 1 || pods[0].ID != "1234" {
+		t.Errorf("expected the runtime pods, got %v", pods)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	d := newTestDockerCache(t, &fakePodsGetter{}, newFakeClock())
+	delay := 100 * time.Millisecond
+	if jittered := d.jitter(delay); jittered != delay {
+		t.Errorf("expected no jitter by default, got %v", jittered)
+	}
+
+	d.jitterFactor = 0.5
+	for _, test := range []struct {
+		random   float64
+		expected time.Duration
+	}{
+		{0, 50 * time.Millisecond},
+		{0.5, 100 * time.Millisecond},
+		{0.75, 125 * time.Millisecond},
+	} {
+		random := test.random
+		d.random = func() float64 { return random }
+		if jittered := d.jitter(delay); jittered != test.expected {
+			t.Errorf("%v: expected %v, got %v", test.random, test.expected, jittered)
+		}
+	}
+
+	// The mean delay is unaffected.
+	d.random = rand.New(rand.NewSource(1)).Float64
+	var total time.Duration
+	samples := 10000
+	for i := 0; i < samples; i++ {
+		jittered := d.jitter(delay)
+		if jittered < 50*time.Millisecond || jittered > 150*time.Millisecond {
+			t.Fatalf("jittered delay %v out of bounds", jittered)
+		}
+		total += jittered
+	}
+	if mean := total / time.Duration(samples); mean < 98*time.Millisecond || mean > 102*time.Millisecond {
+		t.Errorf("expected a mean delay close to %v, got %v", delay, mean)
+	}
+}
+
+func TestNewDockerCacheValidatesJitterFactor(t *testing.T) {
+	for _, factor := range []float64{-0.1, 1, 2} {
+		if _, err := NewDockerCache(&fakePodsGetter{}, DockerCacheConfig{JitterFactor: factor}); err == nil {
+			t.Errorf("expected an error for jitter factor %v", factor)
+		}
+	}
+}
+
+func TestClampDelay(t *testing.T) {
+	tests := []struct {
+		minInterval time.Duration
+		delay       time.Duration
+		expected    time.Duration
+	}{
+		{0, -time.Second, defaultMinBackgroundInterval},
+		{0, 0, defaultMinBackgroundInterval},
+		{0, time.Nanosecond, defaultMinBackgroundInterval},
+		{0, time.Second, time.Second},
+		{minRefreshInterval, 0, minRefreshInterval},
+		{minRefreshInterval, minRefreshInterval, minRefreshInterval},
+		{time.Second, 100 * time.Millisecond, time.Second},
+		{time.Second, 2 * time.Second, 2 * time.Second},
+	}
+	for _, test := range tests {
+		cache, err := NewDockerCache(&fakePodsGetter{}, DefaultDockerCacheConfig().WithMinBackgroundInterval(test.minInterval))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if delay := cache.(*dockerCache).clampDelay(test.delay); delay != test.expected {
+			t.Errorf("min %v, delay %v: expected %v, got %v", test.minInterval, test.delay, test.expected, delay)
+		}
+	}
+}
+
+func TestDefaultMinBackgroundInterval(t *testing.T) {
+	tests := []struct {
+		staleness time.Duration
+		expected  time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{time.Second, 100 * time.Millisecond},
+		// Shorter thresholds keep the smallest interval rather than being
+		// rejected.
+		{100 * time.Millisecond, minRefreshInterval},
+		{50 * time.Millisecond, minRefreshInterval},
+	}
+	for _, test := range tests {
+		config := DockerCacheConfig{SyncStalenessThreshold: test.staleness, RefreshInterval: 10 * time.Millisecond}
+		cache, err := NewDockerCache(&fakePodsGetter{}, config)
+		if err != nil {
+			t.Fatalf("staleness %v: unexpected error: %v", test.staleness, err)
+		}
+		if interval := cache.(*dockerCache).minBackgroundInterval; interval != test.expected {
+			t.Errorf("staleness %v: expected a min background interval of %v, got %v", test.staleness, test.expected, interval)
+		}
+		cache.Stop()
+	}
+}
+
+func TestNewDockerCacheValidatesMinBackgroundInterval(t *testing.T) {
+	for _, interval := range []time.Duration{time.Millisecond, defaultSyncStalenessThreshold} {
+		if _, err := NewDockerCache(&fakePodsGetter{}, DefaultDockerCacheConfig().WithMinBackgroundInterval(interval)); err == nil {
+			t.Errorf("expected an error for a min background interval of %v", interval)
+		}
+	}
+}
+
+func TestGetPodsRefreshesOnlyWhenStale(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1234"}}}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	// Stop the background updater from interfering with the call counts.
+	d.updatingCache = true
+
+	pods, err := d.GetPods()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pods) != 1 || getter.callCount() != 1 {
+		t.Fatalf("expected the first call to list docker once, got %d calls and %v", getter.callCount(), pods)
+	}
+
+	clock.Step(time.Second)
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if getter.callCount() != 1 {
+		t.Errorf("expected pods within the sync staleness threshold to be served from cache, got %d calls", getter.callCount())
+	}
+
+	clock.Step(time.Millisecond)
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if getter.callCount() != 2 {
+		t.Errorf("expected stale pods to be refreshed, got %d calls", getter.callCount())
+	}
+}
+
+func TestSyncStalenessThreshold(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1234"}}}
+	clock := newFakeClock()
+	d, err := NewDockerCache(getter, DockerCacheConfig{
+		SyncStalenessThreshold:   5 * time.Second,
+		RefreshInterval:          500 * time.Millisecond,
+		DisableBackgroundRefresh: true,
+		Clock:                    clock,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Stop()
+
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Pods far older than the refresh interval are still served up to the
+	// threshold.
+	clock.Step(5 * time.Second)
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if getter.callCount() != 1 {
+		t.Errorf("expected pods within the threshold to be served from cache, got %d calls", getter.callCount())
+	}
+	clock.Step(time.Millisecond)
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if getter.callCount() != 2 {
+		t.Errorf("expected pods past the threshold to be refreshed, got %d calls", getter.callCount())
+	}
+}
+
+func TestReset(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1234", Containers: []*kubecontainer.Container{{ID: "a"}}}}}
+	d := newTestDockerCache(t, getter, newFakeClock())
+	defer d.Stop()
+
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d.Reset()
+	waitForUpdaterStop(t, d)
+	d.lock.Lock()
+	if d.pods != nil || d.podsByUID != nil || d.containersByID != nil || !d.cacheTime.IsZero() {
+		t.Errorf("expected the cache to be emptied, got pods %v cached at %v", d.pods, d.cacheTime)
+	}
+	d.lock.Unlock()
+	if getter.callCount() != 1 {
+		t.Errorf("expected Reset not to list docker, got %d calls", getter.callCount())
+	}
+
+	getter.Lock()
+	getter.pods = []*kubecontainer.Pod{{ID: "5678"}}
+	getter.Unlock()
+	pods, err := d.GetPods()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pods) != 1 || pods[0].ID != "5678" {
+		t.Errorf("expected the pods to be reloaded, got %v", pods)
+	}
+	if getter.callCount() != 2 {
+		t.Errorf("expected the read after Reset to list docker once, got %d calls", getter.callCount()-1)
+	}
+	if _, _, found, _ := d.GetContainerByID("a"); found {
+		t.Errorf("expected container a to be gone after Reset")
+	}
+}
+
+func TestGetPodsSortsPodsByUID(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "3"}, {ID: "1"}, {ID: "2"}}}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	expected := []types.UID{"1", "2", "3"}
+	listings := [][]*kubecontainer.Pod{
+		{{ID: "2"}, {ID: "3"}, {ID: "1"}},
+		{{ID: "1"}, {ID: "3"}, {ID: "2", Containers: []*kubecontainer.Container{{ID: "a"}}}},
+	}
+	for i := 0; i <= len(listings); i++ {
+		pods, err := d.GetPods()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var ids []types.UID
+		for _, pod := range pods {
+			ids = append(ids, pod.ID)
+		}
+		if !reflect.DeepEqual(ids, expected) {
+			t.Errorf("refresh %d: expected pods %v, got %v", i, expected, ids)
+		}
+		if i < len(listings) {
+			getter.Lock()
+			getter.pods = listings[i]
+			getter.Unlock()
+			clock.Step(2 * time.Second)
+		}
+	}
+}
+
+func TestUpdatingThreadStopsAfterIdleWindow(t *testing.T) {
+	getter := &fakePodsGetter{}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The clock stays within the idle window, so the updater has to keep
+	// running.
+	if err := wait.Poll(5*time.Millisecond, 5*time.Second, func() (bool, error) {
+		clock.Step(20 * time.Millisecond)
+		return getter.callCount() > 3, nil
+	}); err != nil {
+		t.Fatalf("background updater is not refreshing the cache: %v", err)
+	}
+	d.lock.Lock()
+	running := d.updatingCache
+	d.lock.Unlock()
+	if !running {
+		t.Fatalf("background updater stopped before the idle window elapsed")
+	}
+
+	clock.Step(2 * time.Second)
+	waitForUpdaterStop(t, d)
+}
+
+// overlapDetectingPodsGetter is a podsGetter recording whether it was ever
+// asked to list the running containers by two callers at the same time.
+type overlapDetectingPodsGetter struct {
+	sync.Mutex
+	inFlight int
+	overlap  bool
+}
+
+func (f *overlapDetectingPodsGetter) GetPods(all bool) ([]*kubecontainer.Pod, error) {
+	if all {
+		return nil, nil
+	}
+	f.Lock()
+	f.inFlight++
+	if f.inFlight > 1 {
+		f.overlap = true
+	}
+	f.Unlock()
+	time.Sleep(time.Millisecond)
+	f.Lock()
+	f.inFlight--
+	f.Unlock()
+	return nil, nil
+}
+
+func TestAtMostOneUpdatingThread(t *testing.T) {
+	getter := &overlapDetectingPodsGetter{}
+	clock := newFakeClock()
+	d, err := NewDockerCache(getter, DockerCacheConfig{
+		SyncStalenessThreshold: 50 * time.Millisecond,
+		RefreshInterval:        minRefreshInterval,
+		IdleShutdownTimeout:    minRefreshInterval,
+		Clock:                  clock,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Stop()
+
+	// Go back and forth across the idle window, so that the updating
+	// thread keeps stopping while new requests restart it.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := d.GetPods(); err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				clock.Step(time.Duration(j%3) * minRefreshInterval)
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+
+	getter.Lock()
+	defer getter.Unlock()
+	if getter.overlap {
+		t.Errorf("expected docker never to be listed concurrently")
+	}
+}
+
+func TestGetPodsOnceDoesNotStartUpdatingThread(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1234"}}}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	for i := 0; i < 3; i++ {
+		pods, err := d.GetPodsOnce()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(pods) != 1 {
+			t.Errorf("expected the cached pods, got %v", pods)
+		}
+	}
+	if getter.callCount() != 1 {
+		t.Errorf("expected the pods within the sync staleness threshold to be reused, got %d calls", getter.callCount())
+	}
+	d.lock.Lock()
+	if d.updatingCache {
+		t.Errorf("expected the updating thread not to be started")
+	}
+	d.lock.Unlock()
+
+	clock.Step(2 * time.Second)
+	if _, err := d.GetPodsOnce(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if getter.callCount() != 2 {
+		t.Errorf("expected a stale cache to be refreshed, got %d calls", getter.callCount())
+	}
+}
+
+func TestDisableBackgroundRefresh(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1234"}}}
+	clock := newFakeClock()
+	cache, err := NewDockerCache(getter, testDockerCacheConfig(clock).
+		WithDisableBackgroundRefresh(true))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d := cache.(*dockerCache)
+	defer d.Stop()
+
+	for i := 0; i < 3; i++ {
+		if _, err := d.GetPods(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := d.GetAllPods(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if getter.callCount() != 1 {
+		t.Errorf("expected the pods within the sync staleness threshold to be reused, got %d calls", getter.callCount())
+	}
+	d.lock.Lock()
+	if d.updatingCache {
+		t.Errorf("expected the updating thread not to be started")
+	}
+	d.lock.Unlock()
+
+	clock.Step(2 * time.Second)
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := d.ForceUpdate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if getter.callCount() != 3 {
+		t.Errorf("expected a synchronous and a forced refresh, got %d calls", getter.callCount())
+	}
+}
+
+func TestStopTerminatesUpdatingThread(t *testing.T) {
+	getter := &fakePodsGetter{}
+	d := newTestDockerCache(t, getter, newFakeClock())
+
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d.Stop()
+	d.lock.Lock()
+	running := d.updatingCache
+	d.lock.Unlock()
+	if running {
+		t.Errorf("expected the background updater to have exited")
+	}
+
+	calls := getter.callCount()
+	if _, err := d.GetPods(); err != ErrCacheStopped {
+		t.Errorf("expected %v, got %v", ErrCacheStopped, err)
+	}
+	if err := d.ForceUpdateIfOlder(time.Now()); err != ErrCacheStopped {
+		t.Errorf("expected %v, got %v", ErrCacheStopped, err)
+	}
+	if getter.callCount() != calls {
+		t.Errorf("expected no docker listing after Stop, got %d new calls", getter.callCount()-calls)
+	}
+	// Stopping twice must be safe.
+	d.Stop()
+}
+
+func TestGetPodsReturnsCopy(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1234"}, {ID: "5678"}}}
+	d := newTestDockerCache(t, getter, newFakeClock())
+	defer d.Stop()
+
+	pods, err := d.GetPods()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pods[0] = &kubecontainer.Pod{ID: "bogus"}
+	pods, err = d.GetPods()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pods[0].ID != "1234" {
+		t.Errorf("modifying the returned slice changed the cache: %v", pods[0].ID)
+	}
+}
+
+func TestGetPodsConcurrentWithRefresh(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1234"}, {ID: "5678"}}}
+	d := newTestDockerCache(t, getter, util.RealClock{})
+	defer d.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			pods, err := d.GetPods()
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			for _, pod := range pods {
+				_ = pod.ID
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if err := d.ForceUpdateIfOlder(time.Now()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	<-done
+}
+
+func TestGetPodByUID(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1234", Name: "foo"}, {ID: "5678", Name: "bar"}}}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	pod, found, err := d.GetPodByUID("5678")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !found || pod.Name != "bar" {
+		t.Errorf("expected to find pod bar, got %v (found %v)", pod, found)
+	}
+	if _, found, _ := d.GetPodByUID("9999"); found {
+		t.Errorf("expected pod 9999 not to be found")
+	}
+
+	// A stale cache is refreshed before the lookup.
+	getter.Lock()
+	getter.pods = []*kubecontainer.Pod{{ID: "9999", Name: "baz"}}
+	getter.Unlock()
+	clock.Step(2 * time.Second)
+	pod, found, err = d.GetPodByUID("9999")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !found || pod.Name != "baz" {
+		t.Errorf("expected to find pod baz, got %v (found %v)", pod, found)
+	}
+	if _, found, _ := d.GetPodByUID("1234"); found {
+		t.Errorf("expected pod 1234 to be gone after the refresh")
+	}
+}
+
+func TestGetPodByUIDSinglePodGetter(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1234", Name: "foo"}}}
+	var lookups []types.UID
+	cache, err := NewDockerCache(getter, DockerCacheConfig{
+		SyncStalenessThreshold: time.Second,
+		RefreshInterval:        10 * time.Millisecond,
+		Clock:                  newFakeClock(),
+		SinglePodGetter: func(uid types.UID) (*kubecontainer.Pod, error) {
+			lookups = append(lookups, uid)
+			if uid == "5678" {
+				return &kubecontainer.Pod{ID: "5678", Name: "bar"}, nil
+			}
+			return nil, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer cache.Stop()
+
+	if _, found, err := cache.GetPodByUID("1234"); !found || err != nil {
+		t.Fatalf("expected to find pod 1234, got found %v, error %v", found, err)
+	}
+	pod, found, err := cache.GetPodByUID("5678")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !found || pod.Name != "bar" {
+		t.Errorf("expected to find pod bar, got %v (found %v)", pod, found)
+	}
+	if _, found, _ := cache.GetPodByUID("9999"); found {
+		t.Errorf("expected pod 9999 not to be found")
+	}
+	if expected := []types.UID{"5678", "9999"}; !reflect.DeepEqual(lookups, expected) {
+		t.Errorf("expected lookups of %v, got %v", expected, lookups)
+	}
+	// The looked up pod was merged into the cache.
+	if _, found, _ := cache.GetPodByUID("5678"); !found {
+		t.Errorf("expected pod 5678 to be cached")
+	}
+	if len(lookups) != 2 {
+		t.Errorf("expected no further lookups, got %v", lookups)
+	}
+	if getter.callCount() != 1 {
+		t.Errorf("expected a single listing, got %d", getter.callCount())
+	}
+}
+
+func TestGetPodByUIDSinglePodGetterDoesNotBlockReads(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1234"}}}
+	clock := newFakeClock()
+	lookingUp := make(chan struct{})
+	release := make(chan struct{})
+	var lookupErr error
+	cache, err := NewDockerCache(getter, testDockerCacheConfig(clock).
+		WithDisableBackgroundRefresh(true).
+		WithSinglePodGetter(func(uid types.UID) (*kubecontainer.Pod, error) {
+			lookingUp <- struct{}{}
+			<-release
+			if lookupErr != nil {
+				return nil, lookupErr
+			}
+			return &kubecontainer.Pod{ID: uid}, nil
+		}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d := cache.(*dockerCache)
+	defer d.Stop()
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	type lookup struct {
+		pod   *kubecontainer.Pod
+		found bool
+		err   error
+	}
+	result := make(chan lookup)
+	go func() {
+		pod, found, err := d.GetPodByUID("5678")
+		result <- lookup{pod, found, err}
+	}()
+	<-lookingUp
+	// Reads go on during the lookup.
+	if pods, err := d.GetPods(); err != nil || len(pods) != 1 {
+		t.Errorf("expected the cached pod during the lookup, got %v (error %v)", pods, err)
+	}
+	if pods, err := d.ReadOnlyView().GetPods(); err != nil || len(pods) != 1 {
+		t.Errorf("expected the cached pod from the view during the lookup, got %v (error %v)", pods, err)
+	}
+	close(release)
+	if r := <-result; r.err != nil || !r.found || r.pod.ID != "5678" {
+		t.Errorf("expected pod 5678 to be found, got %v (found %v, error %v)", r.pod, r.found, r.err)
+	}
+
+	// The lookup doesn't hide the failure of the refresh.
+	getter.Lock()
+	getter.err = fmt.Errorf("docker is down")
+	getter.Unlock()
+	clock.Step(2 * time.Second)
+	go func() {
+		pod, found, err := d.GetPodByUID("9012")
+		result <- lookup{pod, found, err}
+	}()
+	<-lookingUp
+	if r := <-result; !IsStaleCacheError(r.err) || !r.found {
+		t.Errorf("expected pod 9012 to be found with a stale cache error, got found %v, error %v", r.found, r.err)
+	}
+
+	// Lookup failures are refresh errors.
+	clock.Step(-2 * time.Second)
+	getter.Lock()
+	getter.err = nil
+	getter.Unlock()
+	if err := d.ForceUpdate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lookupErr = fmt.Errorf("inspect failed")
+	go func() {
+		pod, found, err := d.GetPodByUID("3456")
+		result <- lookup{pod, found, err}
+	}()
+	<-lookingUp
+	r := <-result
+	if refreshErr, ok := r.err.(*RefreshError); !ok || refreshErr.Err != lookupErr || r.found {
+		t.Errorf("expected the lookup error as a refresh error, got found %v, error %v", r.found, r.err)
+	}
+}
+
+func TestForceUpdatePod(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{
+		{ID: "1", Containers: []*kubecontainer.Container{{ID: "a", State: kubecontainer.ContainerStateRunning}}},
+		{ID: "2", Containers: []*kubecontainer.Container{{ID: "b", State: kubecontainer.ContainerStateRunning}}},
+	}}
+	lookedUp := map[types.UID]*kubecontainer.Pod{}
+	var lookups []types.UID
+	clock := newFakeClock()
+	cache, err := NewDockerCache(getter, testDockerCacheConfig(clock).
+		WithDisableBackgroundRefresh(true).
+		WithSinglePodGetter(func(uid types.UID) (*kubecontainer.Pod, error) {
+			lookups = append(lookups, uid)
+			if uid == "9999" {
+				return nil, fmt.Errorf("docker is down")
+			}
+			return lookedUp[uid], nil
+		}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d := cache.(*dockerCache)
+	defer d.Stop()
+	events, cancel := d.SubscribeEvents("test")
+	defer cancel()
+	receive := func() []PodCacheEventType {
+		var received []PodCacheEventType
+		for {
+			select {
+			case event := <-events:
+				received = append(received, event.Type)
+			default:
+				return received
+			}
+		}
+	}
+
+	// The cache was never loaded: docker is listed.
+	if err := d.ForceUpdatePod("1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if getter.callCount() != 1 || len(lookups) != 0 {
+		t.Fatalf("expected a listing of docker, got %d listings and lookups of %v", getter.callCount(), lookups)
+	}
+	receive()
+	cacheTime := d.LastUpdated()
+
+	lookedUp["1"] = &kubecontainer.Pod{ID: "1", Containers: []*kubecontainer.Container{{ID: "a", State: kubecontainer.ContainerStateExited}}}
+	lookedUp["3"] = &kubecontainer.Pod{ID: "3"}
+	steps := []struct {
+		uid      types.UID
+		expected []PodCacheEventType
+		err      bool
+	}{
+		{uid: "1", expected: []PodCacheEventType{PodModified}},
+		{uid: "1"},
+		{uid: "2", expected: []PodCacheEventType{PodRemoved}},
+		{uid: "3", expected: []PodCacheEventType{PodAdded}},
+		{uid: "4"},
+		{uid: "9999", err: true},
+	}
+	for _, step := range steps {
+		clock.Step(time.Millisecond)
+		if err := d.ForceUpdatePod(step.uid); (err != nil) != step.err {
+			t.Errorf("pod %s: expected an error %v, got %v", step.uid, step.err, err)
+		}
+		if events := receive(); !reflect.DeepEqual(events, step.expected) {
+			t.Errorf("pod %s: expected events %v, got %v", step.uid, step.expected, events)
+		}
+	}
+	pods, err := d.GetPods()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pods) != 2 || pods[0].ID != "1" || pods[0].Containers[0].State != kubecontainer.ContainerStateExited || pods[1].ID != "3" {
+		t.Errorf("expected the looked up pods to be merged, got %+v", pods)
+	}
+	if getter.callCount() != 1 {
+		t.Errorf("expected docker not to be listed again, got %d listings", getter.callCount())
+	}
+	if d.LastUpdated() != cacheTime {
+		t.Errorf("expected the cache time to be kept at %v, got %v", cacheTime, d.LastUpdated())
+	}
+}
+
+func TestForceUpdatePodDoesNotBlockReads(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1"}}}
+	lookingUp := make(chan struct{})
+	release := make(chan struct{})
+	cache, err := NewDockerCache(getter, testDockerCacheConfig(newFakeClock()).
+		WithDisableBackgroundRefresh(true).
+		WithSinglePodGetter(func(uid types.UID) (*kubecontainer.Pod, error) {
+			close(lookingUp)
+			<-release
+			return &kubecontainer.Pod{ID: uid, Containers: []*kubecontainer.Container{{ID: "a"}}}, nil
+		}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer cache.Stop()
+	if err := cache.ForceUpdate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	result := make(chan error)
+	go func() {
+		result <- cache.ForceUpdatePod("1")
+	}()
+	<-lookingUp
+	if pods, err := cache.GetPods(); err != nil || len(pods) != 1 || len(pods[0].Containers) != 0 {
+		t.Errorf("expected the cached pod during the lookup, got %v (error %v)", pods, err)
+	}
+	close(release)
+	if err := <-result; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pods, err := cache.GetPods(); err != nil || len(pods) != 1 || len(pods[0].Containers) != 1 {
+		t.Errorf("expected the looked up pod to be stored, got %v (error %v)", pods, err)
+	}
+}
+
+func TestForceUpdatePodWithoutSinglePodGetter(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1"}}}
+	cache, err := NewDockerCache(getter, testDockerCacheConfig(newFakeClock()).WithDisableBackgroundRefresh(true))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer cache.Stop()
+
+	for i := 1; i <= 2; i++ {
+		if err := cache.ForceUpdatePod("1"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if getter.callCount() != i {
+			t.Errorf("expected %d listings of docker, got %d", i, getter.callCount())
+		}
+	}
+	cache.Stop()
+	if err := cache.ForceUpdatePod("1"); err != ErrCacheStopped {
+		t.Errorf("expected %v once stopped, got %v", ErrCacheStopped, err)
+	}
+}
+
+func TestGetPodsModifiedSince(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{
+		{ID: "1", Containers: []*kubecontainer.Container{{ID: "a", State: kubecontainer.ContainerStateRunning}}},
+		{ID: "2", Containers: []*kubecontainer.Container{{ID: "b", State: kubecontainer.ContainerStateRunning}}},
+	}}
+	d := newTestDockerCache(t, getter, newFakeClock())
+	defer d.Stop()
+
+	check := func(step string, since uint64, expected []types.UID) uint64 {
+		pods, generation, err := d.GetPodsModifiedSince(since)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", step, err)
+		}
+		var ids []types.UID
+		for _, pod := range pods {
+			ids = append(ids, pod.ID)
+		}
+		if !reflect.DeepEqual(ids, expected) {
+			t.Errorf("%s: expected pods %v, got %v", step, expected, ids)
+		}
+		return generation
+	}
+	setPods := func(pods []*kubecontainer.Pod) {
+		getter.Lock()
+		getter.pods = pods
+		getter.Unlock()
+		if err := d.ForceUpdate(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	generation := check("initial", 0, []types.UID{"1", "2"})
+	check("unchanged", generation, nil)
+	setPods([]*kubecontainer.Pod{
+		{ID: "1", Containers: []*kubecontainer.Container{{ID: "a", State: kubecontainer.ContainerStateRunning}}},
+		{ID: "2", Containers: []*kubecontainer.Container{{ID: "b", State: kubecontainer.ContainerStateExited}}},
+		{ID: "3"},
+	})
+	next := check("changed", generation, []types.UID{"2", "3"})
+	if next <= generation {
+		t.Errorf("expected the generation to increase from %d, got %d", generation, next)
+	}
+	// Refreshes listing the same pods leave the generation alone.
+	setPods(getter.pods)
+	if again := check("same pods", next, nil); again != next {
+		t.Errorf("expected generation %d, got %d", next, again)
+	}
+	// Generations the cache never reached return all the pods.
+	check("future generation", next+10, []types.UID{"1", "2", "3"})
+
+	d.Reset()
+	check("after reset", next, []types.UID{"1", "2", "3"})
+}
+
+func TestSetGetter(t *testing.T) {
+	oldGetter := newBlockingPodsGetter()
+	oldGetter.pods = []*kubecontainer.Pod{{ID: "old"}}
+	d := newTestDockerCache(t, oldGetter, util.RealClock{})
+	defer d.Stop()
+
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := d.SetGetter(nil); err == nil {
+		t.Errorf("expected an error for a nil getter")
+	}
+	// Catch a background refresh in flight with the old getter.
+	oldGetter.setBlocked(true)
+	<-oldGetter.listings
+	newGetter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "new"}}}
+	if err := d.SetGetter(newGetter); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The cached pods are kept.
+	if pods, err := d.GetPodsOnce(); err != nil || len(pods) != 1 || pods[0].ID != "old" {
+		t.Errorf("expected the cached pods to be kept, got %v (error %v)", pods, err)
+	}
+	oldGetter.setBlocked(false)
+	close(oldGetter.release)
+
+	err := wait.Poll(5*time.Millisecond, 5*time.Second, func() (bool, error) {
+		pods, err := d.GetPods()
+		return err == nil && len(pods) == 1 && pods[0].ID == "new", nil
+	})
+	if err != nil {
+		t.Errorf("expected the new getter to be used by the next refreshes")
+	}
+}
+
+func TestGetPodCount(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1"}, {ID: "2"}}}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	if count, err := d.GetPodCount(); err != nil || count != 2 {
+		t.Errorf("expected 2 pods, got %d (error %v)", count, err)
+	}
+	d.lock.Lock()
+	if !d.updatingCache {
+		t.Errorf("expected GetPodCount to start the updating thread")
+	}
+	d.lock.Unlock()
+	getter.Lock()
+	getter.pods = []*kubecontainer.Pod{{ID: "1"}, {ID: "2"}, {ID: "3"}}
+	getter.Unlock()
+	clock.Step(2 * time.Second)
+	if count, err := d.GetPodCount(); err != nil || count != 3 {
+		t.Errorf("expected the stale cache to be refreshed to 3 pods, got %d (error %v)", count, err)
+	}
+	if getter.callCount() != 2 {
+		t.Errorf("expected 2 listings, got %d", getter.callCount())
+	}
+}
+
+func TestGetPodsSnapshot(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1"}}}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	loaded := clock.Now()
+	pods, asOf, err := d.GetPodsSnapshot()
+	if err != nil || len(pods) != 1 || !asOf.Equal(loaded) {
+		t.Errorf("expected pod 1 listed at %v, got %v at %v (error %v)", loaded, pods, asOf, err)
+	}
+	clock.Step(500 * time.Millisecond)
+	if _, asOf, _ := d.GetPodsSnapshot(); !asOf.Equal(loaded) {
+		t.Errorf("expected the cached pods listed at %v, got %v", loaded, asOf)
+	}
+
+	getter.Lock()
+	getter.err = fmt.Errorf("docker is down")
+	getter.Unlock()
+	clock.Step(2 * time.Second)
+	pods, asOf, err = d.GetPodsSnapshot()
+	if !IsStaleCacheError(err) || len(pods) != 1 || !asOf.Equal(loaded) {
+		t.Errorf("expected the stale pods listed at %v, got %v at %v (error %v)", loaded, pods, asOf, err)
+	}
+}
+
+func TestGetPodIDs(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "2"}, {ID: "3"}, {ID: "1"}}}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	ids, err := d.GetPodIDs()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []types.UID{"1", "2", "3"}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("expected %v, got %v", expected, ids)
+	}
+	getter.Lock()
+	getter.pods = nil
+	getter.Unlock()
+	clock.Step(2 * time.Second)
+	if ids, err := d.GetPodIDs(); err != nil || len(ids) != 0 {
+		t.Errorf("expected the stale cache to be refreshed to no pods, got %v (error %v)", ids, err)
+	}
+}
+
+func TestGetPodContainerCount(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{
+		{ID: "1", Containers: []*kubecontainer.Container{{ID: "a"}, {ID: "b"}}},
+		{ID: "2"},
+	}}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	if count, found, err := d.GetPodContainerCount("1"); err != nil || !found || count != 2 {
+		t.Errorf("expected 2 containers, got %d, %v (error %v)", count, found, err)
+	}
+	if count, found, err := d.GetPodContainerCount("2"); err != nil || !found || count != 0 {
+		t.Errorf("expected no containers, got %d, %v (error %v)", count, found, err)
+	}
+	if _, found, err := d.GetPodContainerCount("3"); err != nil || found {
+		t.Errorf("expected pod 3 not to be found, got %v (error %v)", found, err)
+	}
+	if getter.callCount() != 1 {
+		t.Errorf("expected a single listing, got %d", getter.callCount())
+	}
+}
+
+func TestContains(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1"}}}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	if found, err := d.Contains("1"); err != nil || !found {
+		t.Errorf("expected pod 1 to be found, got %v (error %v)", found, err)
+	}
+	if found, err := d.Contains("2"); err != nil || found {
+		t.Errorf("expected pod 2 not to be found, got %v (error %v)", found, err)
+	}
+	if getter.callCount() != 1 {
+		t.Errorf("expected a single listing, got %d", getter.callCount())
+	}
+
+	// Contains keeps the background thread running.
+	clock.Step(time.Minute)
+	if _, err := d.Contains("1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.idle() {
+		t.Errorf("expected the cache not to be idle")
+	}
+}
+
+func TestGetRecentlyRemovedPod(t *testing.T) {
+	getter := &fakePodsGetter{}
+	clock := newFakeClock()
+	d, err := NewDockerCache(getter, testDockerCacheConfig(clock).
+		WithDisableBackgroundRefresh(true).
+		WithRemovedPodsCacheSize(2).
+		WithRemovedPodTTL(10*time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Stop()
+	setPods := func(ids ...types.UID) {
+		var pods []*kubecontainer.Pod
+		for _, id := range ids {
+			pods = append(pods, &kubecontainer.Pod{ID: id, Containers: []*kubecontainer.Container{{ID: "c" + id}}})
+		}
+		getter.Lock()
+		getter.pods = pods
+		getter.Unlock()
+		if err := d.ForceUpdate(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	setPods("1", "2", "3", "4")
+	if _, found := d.GetRecentlyRemovedPod("1"); found {
+		t.Errorf("expected a cached pod not to be removed")
+	}
+	setPods("4")
+	// Only the 2 most recently removed pods are kept.
+	if _, found := d.GetRecentlyRemovedPod("1"); found {
+		t.Errorf("expected pod 1 to be evicted")
+	}
+	pod, found := d.GetRecentlyRemovedPod("3")
+	if !found || len(pod.Containers) != 1 || pod.Containers[0].ID != "c3" {
+		t.Errorf("expected the last state of pod 3, got %v (found %v)", pod, found)
+	}
+	// Pods listed again are no longer removed.
+	setPods("2", "4")
+	if _, found := d.GetRecentlyRemovedPod("2"); found {
+		t.Errorf("expected pod 2 to be forgotten once listed again")
+	}
+
+	clock.Step(5 * time.Second)
+	setPods("4")
+	clock.Step(6 * time.Second)
+	if _, found := d.GetRecentlyRemovedPod("3"); found {
+		t.Errorf("expected pod 3 to expire")
+	}
+	if _, found := d.GetRecentlyRemovedPod("2"); !found {
+		t.Errorf("expected pod 2 removed 6s ago to be kept")
+	}
+}
+
+func TestDumpJSON(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{
+		{ID: "1234", Name: "foo", Namespace: "default", Containers: []*kubecontainer.Container{
+			{ID: "a", Name: "bar", Image: "busybox", State: kubecontainer.ContainerStateRunning, Created: 10},
+		}},
+	}}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := d.DumpJSON()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `{"cacheTime":"2015-01-01T00:00:00Z","podCount":1,"pods":[` +
+		`{"id":"1234","name":"foo","namespace":"default","containers":[` +
+		`{"id":"a","name":"bar","image":"busybox","state":"running","created":10}]}]}`
+	if string(data) != expected {
+		t.Errorf("expected dump %s, got %s", expected, data)
+	}
+}
+
+func TestGetPodsByUIDs(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1", Name: "foo"}, {ID: "2", Name: "bar"}, {ID: "3", Name: "baz"}}}
+	d := newTestDockerCache(t, getter, newFakeClock())
+	defer d.Stop()
+
+	pods, err := d.GetPodsByUIDs([]types.UID{"1", "3", "4"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pods) != 2 || pods["1"].Name != "foo" || pods["3"].Name != "baz" {
+		t.Errorf("expected pods foo and baz, got %v", pods)
+	}
+	if getter.callCount() != 1 {
+		t.Errorf("expected docker to be listed once, got %d calls", getter.callCount())
+	}
+	if pods, err := d.GetPodsByUIDs(nil); err != nil || len(pods) != 0 {
+		t.Errorf("expected no pods, got %v, %v", pods, err)
+	}
+}
+
+func TestGetPodsFiltered(t *testing.T) {
+	getter := &fakePodsGetter{allPods: []*kubecontainer.Pod{
+		{ID: "1", Namespace: "ns1", Containers: []*kubecontainer.Container{
+			{ID: "a", State: kubecontainer.ContainerStateRunning},
+		}},
+		{ID: "2", Namespace: "ns1", Containers: []*kubecontainer.Container{
+			{ID: "b", State: kubecontainer.ContainerStateRunning},
+			{ID: "c", State: kubecontainer.ContainerStateExited},
+		}},
+		{ID: "3", Namespace: "ns2", Containers: []*kubecontainer.Container{
+			{ID: "d", State: kubecontainer.ContainerStateExited},
+		}},
+	}}
+	d := newTestDockerCache(t, getter, newFakeClock())
+	defer d.Stop()
+
+	tests := []struct {
+		name     string
+		pred     func(pod *kubecontainer.Pod) bool
+		expected []types.UID
+	}{
+		{"namespace ns1", ByNamespace("ns1"), []types.UID{"1", "2"}},
+		{"nonexistent namespace", ByNamespace("ns3"), nil},
+		{"exited containers", WithExitedContainers(), []types.UID{"2", "3"}},
+		{"custom", func(pod *kubecontainer.Pod) bool { return len(pod.Containers) == 1 }, []types.UID{"1", "3"}},
+	}
+	for _, test := range tests {
+		pods, err := d.GetPodsFiltered(test.pred)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		var uids []types.UID
+		for _, pod := range pods {
+			uids = append(uids, pod.ID)
+		}
+		if !reflect.DeepEqual(uids, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, uids)
+		}
+	}
+}
+
+func TestGetPodStatus(t *testing.T) {
+	getter := &fakePodsGetter{allPods: []*kubecontainer.Pod{
+		{ID: "1234", Containers: []*kubecontainer.Container{
+			{ID: "a", Name: "foo", State: kubecontainer.ContainerStateRunning},
+			{ID: "b", Name: "foo", State: kubecontainer.ContainerStateExited},
+			{ID: "c", Name: "foo", State: kubecontainer.ContainerStateExited},
+			{ID: "d", Name: "bar", State: kubecontainer.ContainerStateRunning},
+		}},
+		{ID: "5678", Containers: []*kubecontainer.Container{
+			{ID: "e", Name: "baz", State: kubecontainer.ContainerStateExited},
+		}},
+	}}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	now := clock.Now()
+	tests := []struct {
+		uid      types.UID
+		expected kubecontainer.PodStatus
+	}{
+		{
+			"1234",
+			kubecontainer.PodStatus{
+				RunningContainers: 2,
+				ExitedContainers:  2,
+				RestartCounts:     map[string]int{"foo": 2},
+				Phase:             api.PodRunning,
+				StateSince:        map[types.UID]time.Time{"a": now, "b": now, "c": now, "d": now},
+			},
+		},
+		{
+			"5678",
+			kubecontainer.PodStatus{
+				ExitedContainers: 1,
+				RestartCounts:    map[string]int{"baz": 1},
+				Phase:            api.PodUnknown,
+				StateSince:       map[types.UID]time.Time{"e": now},
+			},
+		},
+	}
+	for _, test := range tests {
+		status, found, err := d.GetPodStatus(test.uid)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.uid, err)
+		}
+		if !found || !reflect.DeepEqual(*status, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v (found %v)", test.uid, test.expected, status, found)
+		}
+		// The cached status is not affected by the caller.
+		status.RestartCounts["foo"] = 42
+	}
+	if status, _, _ := d.GetPodStatus("1234"); status.RestartCounts["foo"] != 2 {
+		t.Errorf("modifying the returned status changed the cache: %+v", status)
+	}
+	getter.Lock()
+	if getter.allCalls != 1 {
+		t.Errorf("expected docker to be listed once, got %d calls", getter.allCalls)
+	}
+	getter.Unlock()
+	if _, found, err := d.GetPodStatus("9999"); found || err != nil {
+		t.Errorf("expected pod 9999 not to be found without error, got %v, %v", found, err)
+	}
+}
+
+func TestGetPodAndStatus(t *testing.T) {
+	getter := &fakePodsGetter{allPods: []*kubecontainer.Pod{
+		{ID: "1234", Containers: []*kubecontainer.Container{
+			{ID: "a", Name: "foo", State: kubecontainer.ContainerStateRunning},
+			{ID: "b", Name: "foo", State: kubecontainer.ContainerStateExited},
+		}},
+	}}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	pod, status, found, err := d.GetPodAndStatus("1234")
+	if err != nil || !found {
+		t.Fatalf("expected pod 1234 to be found, got %v (error %v)", found, err)
+	}
+	if len(pod.Containers) != 2 {
+		t.Errorf("expected the exited container to be returned, got %+v", pod.Containers)
+	}
+	if status.RunningContainers != 1 || status.ExitedContainers != 1 || status.RestartCounts["foo"] != 1 {
+		t.Errorf("expected the status of both containers, got %+v", status)
+	}
+	// The returned pod and status are copies.
+	pod.Containers[0].State = kubecontainer.ContainerStateExited
+	status.RestartCounts["foo"] = 42
+	if pod, status, _, _ := d.GetPodAndStatus("1234"); pod.Containers[0].State != kubecontainer.ContainerStateRunning || status.RestartCounts["foo"] != 1 {
+		t.Errorf("modifying the returned pod and status changed the cache: %+v, %+v", pod.Containers[0], status)
+	}
+	getter.Lock()
+	if getter.allCalls != 1 {
+		t.Errorf("expected docker to be listed once, got %d calls", getter.allCalls)
+	}
+	getter.Unlock()
+	if _, _, found, err := d.GetPodAndStatus("9999"); found || err != nil {
+		t.Errorf("expected pod 9999 not to be found without error, got %v, %v", found, err)
+	}
+}
+
+func TestGetContainerStateAge(t *testing.T) {
+	getter := &fakePodsGetter{allPods: []*kubecontainer.Pod{
+		{ID: "1234", Containers: []*kubecontainer.Container{
+			{ID: "a", State: kubecontainer.ContainerStateRunning},
+			{ID: "b", State: kubecontainer.ContainerStateRunning},
+		}},
+	}}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	if _, err := d.GetAllPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	getter.Lock()
+	getter.allPods = []*kubecontainer.Pod{
+		{ID: "1234", Containers: []*kubecontainer.Container{
+			{ID: "a", State: kubecontainer.ContainerStateRunning},
+			{ID: "b", State: kubecontainer.ContainerStateExited},
+		}},
+	}
+	getter.Unlock()
+	clock.Step(2 * time.Second)
+	if _, err := d.GetAllPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	clock.Step(time.Second)
+
+	tests := []struct {
+		id       types.UID
+		expected time.Duration
+		found    bool
+	}{
+		{"a", 3 * time.Second, true},
+		{"b", time.Second, true},
+		{"c", 0, false},
+	}
+	for _, test := range tests {
+		age, found, err := d.GetContainerStateAge(test.id)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.id, err)
+		}
+		if age != test.expected || found != test.found {
+			t.Errorf("%s: expected %v (found %v), got %v (found %v)", test.id, test.expected, test.found, age, found)
+		}
+	}
+}
+
+func TestSelectPods(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{
+		{ID: "1", Labels: map[string]string{"app": "web", "tier": "frontend"}},
+		{ID: "2", Labels: map[string]string{"app": "web", "tier": "backend"}},
+		{ID: "3", Labels: map[string]string{"app": "db"}},
+		{ID: "4"},
+	}}
+	d := newTestDockerCache(t, getter, newFakeClock())
+	defer d.Stop()
+
+	tests := []struct {
+		selector labels.Selector
+		expected []types.UID
+	}{
+		{labels.SelectorFromSet(labels.Set{"app": "web"}), []types.UID{"1", "2"}},
+		{labels.SelectorFromSet(labels.Set{"app": "web", "tier": "backend"}), []types.UID{"2"}},
+		{labels.SelectorFromSet(labels.Set{"app": "cache"}), nil},
+		{labels.Everything(), []types.UID{"1", "2", "3", "4"}},
+	}
+	for _, test := range tests {
+		pods, err := d.selectPods(test.selector)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", test.selector, err)
+			continue
+		}
+		var ids []types.UID
+		for _, pod := range pods {
+			ids = append(ids, pod.ID)
+		}
+		if !reflect.DeepEqual(ids, test.expected) {
+			t.Errorf("expected %v for %q, got %v", test.expected, test.selector, ids)
+		}
+	}
+	if getter.callCount() != 1 {
+		t.Errorf("expected a single listing, got %d", getter.callCount())
+	}
+}
+
+func TestGetPodsInNamespace(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{
+		{ID: "1", Name: "foo", Namespace: "ns1"},
+		{ID: "2", Name: "bar", Namespace: "ns2"},
+		{ID: "3", Name: "baz", Namespace: "ns1"},
+		{ID: "4", Name: "qux"},
+	}}
+	d := newTestDockerCache(t, getter, newFakeClock())
+	defer d.Stop()
+
+	tests := []struct {
+		namespace string
+		expected  []string
+	}{
+		{"ns1", []string{"foo", "baz"}},
+		{"ns2", []string{"bar"}},
+		{"", []string{"qux"}},
+		{"nonexistent", nil},
+	}
+	for _, test := range tests {
+		pods, err := d.GetPodsInNamespace(test.namespace)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.namespace, err)
+			continue
+		}
+		var names []string
+		for _, pod := range pods {
+			names = append(names, pod.Name)
+		}
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("%q: expected %v, got %v", test.namespace, test.expected, names)
+		}
+	}
+}
+
+func TestImageIndex(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{
+		{ID: "1234", Containers: []*kubecontainer.Container{{ID: "a", Image: "busybox"}, {ID: "b", Image: "nginx"}}},
+		{ID: "5678", Containers: []*kubecontainer.Container{{ID: "c", Image: "busybox"}}},
+	}}
+	d := newTestDockerCache(t, getter, newFakeClock())
+	defer d.Stop()
+
+	images, err := d.GetImagesInUse()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []kubecontainer.ImageID{"busybox", "nginx"}; !reflect.DeepEqual(images, expected) {
+		t.Errorf("expected images %v, got %v", expected, images)
+	}
+
+	tests := []struct {
+		image    string
+		expected []types.UID
+	}{
+		{"busybox", []types.UID{"a", "c"}},
+		{"nginx", []types.UID{"b"}},
+		{"redis", nil},
+	}
+	for _, test := range tests {
+		containers, err := d.GetContainersForImage(test.image)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.image, err)
+			continue
+		}
+		var ids []types.UID
+		for _, c := range containers {
+			ids = append(ids, c.ID)
+		}
+		if !reflect.DeepEqual(ids, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.image, test.expected, ids)
+		}
+	}
+}
+
+func TestGetContainerByID(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{
+		{ID: "1234", Name: "foo", Containers: []*kubecontainer.Container{{ID: "a", Name: "one"}}},
+		{ID: "5678", Name: "bar", Containers: []*kubecontainer.Container{{ID: "b", Name: "two"}, {ID: "c", Name: "three"}}},
+	}}
+	d := newTestDockerCache(t, getter, newFakeClock())
+	defer d.Stop()
+
+	pod, container, found, err := d.GetContainerByID("c")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !found || pod.Name != "bar" || container.Name != "three" {
+		t.Errorf("expected to find container three in pod bar, got %v %v (found %v)", pod, container, found)
+	}
+	if _, _, found, err := d.GetContainerByID("d"); found || err != nil {
+		t.Errorf("expected container d not to be found without error, got %v %v", found, err)
+	}
+}
+
+// slowPodsGetter is a podsGetter taking step on the fake clock to answer.
+type slowPodsGetter struct {
+	*fakePodsGetter
+	clock *fakeClock
+	step  time.Duration
+}
+
+func (f *slowPodsGetter) GetPods(all bool) ([]*kubecontainer.Pod, error) {
+	f.clock.Step(f.step)
+	return f.fakePodsGetter.GetPods(all)
+}
+
+func TestGetPodsTimed(t *testing.T) {
+	clock := newFakeClock()
+	getter := &slowPodsGetter{
+		fakePodsGetter: &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1234"}}},
+		clock:          clock,
+		step:           300 * time.Millisecond,
+	}
+	cache, err := NewDockerCache(getter, testDockerCacheConfig(clock).WithDisableBackgroundRefresh(true))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d := cache.(*dockerCache)
+	defer d.Stop()
+
+	pods, refreshed, dur, err := d.GetPodsTimed()
+	if err != nil || len(pods) != 1 {
+		t.Fatalf("expected a single pod, got %v (error %v)", pods, err)
+	}
+	if !refreshed || dur != 300*time.Millisecond {
+		t.Errorf("expected a 300ms synchronous refresh, got %v after %v", refreshed, dur)
+	}
+	if _, refreshed, dur, err = d.GetPodsTimed(); err != nil || refreshed || dur != 0 {
+		t.Errorf("expected the pods to be served from the cache, got %v after %v (error %v)", refreshed, dur, err)
+	}
+	clock.Step(2 * time.Second)
+	if _, refreshed, dur, err = d.GetPodsTimed(); err != nil || !refreshed || dur != 300*time.Millisecond {
+		t.Errorf("expected a 300ms synchronous refresh, got %v after %v (error %v)", refreshed, dur, err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	clock := newFakeClock()
+	getter := &slowPodsGetter{
+		fakePodsGetter: &fakePodsGetter{pods: []*kubecontainer.Pod{
+			{ID: "1234", Containers: []*kubecontainer.Container{{ID: "a"}, {ID: "b"}}},
+			{ID: "5678", Containers: []*kubecontainer.Container{{ID: "c"}}},
+		}},
+		clock: clock,
+		step:  20 * time.Millisecond,
+	}
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	if stats := d.Stats(); stats != (DockerCacheStats{}) {
+		t.Errorf("expected empty stats before the first refresh, got %+v", stats)
+	}
+	if err := d.ForceUpdate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := DockerCacheStats{
+		PodCount:            2,
+		ContainerCount:      3,
+		LastRefreshDuration: 20 * time.Millisecond,
+		LastRefreshTime:     clock.Now(),
+	}
+	if stats := d.Stats(); stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+}
+
+func TestLastUpdated(t *testing.T) {
+	getter := &fakePodsGetter{}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	if !d.LastUpdated().IsZero() {
+		t.Errorf("expected a new cache not to have been updated, got %v", d.LastUpdated())
+	}
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d.LastUpdated() != clock.Now() {
+		t.Errorf("expected last update at %v, got %v", clock.Now(), d.LastUpdated())
+	}
+
+	clock.Step(time.Minute)
+	if err := d.ForceUpdateIfOlder(clock.Now()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d.LastUpdated() != clock.Now() {
+		t.Errorf("expected last update at %v, got %v", clock.Now(), d.LastUpdated())
+	}
+
+	// A failed refresh leaves the timestamp untouched.
+	last := d.LastUpdated()
+	getter.Lock()
+	getter.err = fmt.Errorf("docker is down")
+	getter.Unlock()
+	clock.Step(time.Minute)
+	if err := d.ForceUpdateIfOlder(clock.Now()); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if d.LastUpdated() != last {
+		t.Errorf("expected last update at %v, got %v", last, d.LastUpdated())
+	}
+}
+
+func TestAssertUpToDate(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1234"}}}
+	clock := newFakeClock()
+	cache, err := NewDockerCache(getter, testDockerCacheConfig(clock).WithDisableBackgroundRefresh(true))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d := cache.(*dockerCache)
+	defer d.Stop()
+
+	if err := d.AssertUpToDate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if getter.callCount() != 1 || d.LastUpdated() != clock.Now() {
+		t.Fatalf("expected the empty cache to be loaded, got %d calls, last update at %v", getter.callCount(), d.LastUpdated())
+	}
+	// The cache was refreshed at the instant of the call.
+	if err := d.AssertUpToDate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if getter.callCount() != 1 {
+		t.Errorf("expected a cache refreshed now not to be refreshed again, got %d calls", getter.callCount())
+	}
+	// Older pods are refreshed, however recent, even within the staleness
+	// threshold.
+	clock.Step(time.Millisecond)
+	if err := d.AssertUpToDate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if getter.callCount() != 2 || d.LastUpdated() != clock.Now() {
+		t.Errorf("expected the cache to be refreshed, got %d calls, last update at %v", getter.callCount(), d.LastUpdated())
+	}
+
+	getter.Lock()
+	getter.err = fmt.Errorf("docker is down")
+	getter.Unlock()
+	clock.Step(time.Millisecond)
+	if err := d.AssertUpToDate(); err == nil {
+		t.Errorf("expected the refresh error")
+	}
+}
+
+func TestForceUpdateIfOlderClampsFutureTimes(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1234"}}}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	if err := d.ForceUpdateIfOlder(clock.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if getter.callCount() != 1 {
+		t.Fatalf("expected the empty cache to be loaded, got %d calls", getter.callCount())
+	}
+	// The cache is as fresh as it can be, so future expectations don't list
+	// docker again.
+	for i := 0; i < 10; i++ {
+		if err := d.ForceUpdateIfOlder(clock.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if getter.callCount() != 1 {
+		t.Errorf("expected future times to be clamped to now, got %d calls", getter.callCount())
+	}
+}
+
+func TestForceUpdateIfOlderConcurrentCallers(t *testing.T) {
+	getter := newBlockingPodsGetter()
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	getter.setBlocked(true)
+	clock.Step(time.Minute)
+	minExpectedCacheTime := clock.Now()
+	const callers = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- d.ForceUpdateIfOlder(minExpectedCacheTime)
+		}()
+	}
+	<-getter.listings
+	// Let the other callers queue up behind the listing.
+	time.Sleep(20 * time.Millisecond)
+	getter.setBlocked(false)
+	close(getter.release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if calls := getter.callCount(); calls != 2 {
+		t.Errorf("expected a single listing for all the callers, got %d", calls-1)
+	}
+}
+
+func TestGetPodsMaxStale(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1"}}}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Older than the sync staleness threshold, but within maxStale.
+	clock.Step(2 * time.Second)
+	pods, err := d.GetPodsMaxStale(time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pods) != 1 || getter.callCount() != 1 {
+		t.Errorf("expected the cached pods without listing, got %v after %d listings", pods, getter.callCount())
+	}
+
+	// Within the sync staleness threshold, but older than maxStale.
+	if err := d.ForceUpdate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	calls := getter.callCount()
+	clock.Step(500 * time.Millisecond)
+	if _, err := d.GetPodsMaxStale(100 * time.Millisecond); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if getter.callCount() != calls+1 {
+		t.Errorf("expected a refresh, got %d listings", getter.callCount()-calls)
+	}
+
+	getter.Lock()
+	getter.err = fmt.Errorf("docker is down")
+	getter.Unlock()
+	clock.Step(500 * time.Millisecond)
+	pods, err = d.GetPodsMaxStale(0)
+	if !IsStaleCacheError(err) || len(pods) != 1 {
+		t.Errorf("expected stale pods and a *StaleCacheError, got %v, %v", pods, err)
+	}
+}
+
+func TestGetPodsMaxStaleConcurrentCallers(t *testing.T) {
+	getter := newBlockingPodsGetter()
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	getter.setBlocked(true)
+	clock.Step(time.Minute)
+	const callers = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := d.GetPodsMaxStale(0)
+			errs <- err
+		}()
+	}
+	<-getter.listings
+	// Let the other callers queue up behind the listing.
+	time.Sleep(20 * time.Millisecond)
+	getter.setBlocked(false)
+	close(getter.release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if calls := getter.callCount(); calls != 2 {
+		t.Errorf("expected a single listing for all the callers, got %d", calls-1)
+	}
+}
+
+func TestReadsDuringSlowRefresh(t *testing.T) {
+	getter := newBlockingPodsGetter()
+	getter.pods = []*kubecontainer.Pod{{ID: "1"}}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := d.GetAllPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	getter.setBlocked(true)
+	clock.Step(time.Minute)
+	const callers = 10
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := d.GetPods(); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := d.GetAllPods(); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	<-getter.listings
+	<-getter.listings
+
+	// Readers which don't need a refresh are served while docker is
+	// being listed.
+	for i := 0; i < callers; i++ {
+		pods, err := d.GetPodsMaxStale(time.Hour)
+		if err != nil || len(pods) != 1 {
+			t.Fatalf("expected the cached pods, got %v, %v", pods, err)
+		}
+		d.LastUpdated()
+		d.Stats()
+	}
+
+	getter.setBlocked(false)
+	close(getter.release)
+	wg.Wait()
+	getter.Lock()
+	calls, allCalls := getter.calls, getter.allCalls
+	getter.Unlock()
+	if calls != 2 || allCalls != 2 {
+		t.Errorf("expected a single listing of each kind for all the callers, got %d and %d", calls-1, allCalls-1)
+	}
+}
+
+func TestForceUpdateIfOlderVerifiesFreshness(t *testing.T) {
+	clock := newFakeClock()
+	getter := &slowPodsGetter{fakePodsGetter: &fakePodsGetter{}, clock: clock}
+	d, err := NewDockerCache(getter, testDockerCacheConfig(clock).WithDisableBackgroundRefresh(true))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Stop()
+
+	if err := d.ForceUpdateIfOlder(clock.Now()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !d.LastUpdated().Equal(clock.Now()) {
+		t.Errorf("expected the cache to be refreshed at %v, got %v", clock.Now(), d.LastUpdated())
+	}
+
+	// The clock goes backwards while docker is listed: the refresh works,
+	// but the cache isn't as fresh as requested.
+	clock.Step(time.Minute)
+	getter.step = -time.Hour
+	if err := d.ForceUpdateIfOlder(clock.Now()); err == nil {
+		t.Errorf("expected an error for a refresh older than requested")
+	}
+}
+
+func TestPrimeKeepsFailures(t *testing.T) {
+	getter := &fakePodsGetter{err: fmt.Errorf("docker is down")}
+	clock := newFakeClock()
+	cache, err := NewDockerCache(getter, testDockerCacheConfig(clock).
+		WithDisableBackgroundRefresh(true).
+		WithCircuitBreakerThreshold(1))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d := cache.(*dockerCache)
+	defer d.Stop()
+	if err := d.ForceUpdate(); err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	// Seeding pods doesn't tell whether docker answers again.
+	d.Prime([]*kubecontainer.Pod{{ID: "1234"}}, clock.Now())
+	status := d.CacheStatus()
+	if status.ConsecutiveFailures != 1 || status.CircuitState != CircuitOpen || status.LastError == nil {
+		t.Errorf("expected the failure to be kept, got %+v", status)
+	}
+	if pods, _ := d.GetPodsOnce(); len(pods) != 1 {
+		t.Errorf("expected the seeded pods, got %v", pods)
+	}
+}
+
+func TestPrime(t *testing.T) {
+	getter := &fakePodsGetter{}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	// Rejected seeds.
+	d.Prime([]*kubecontainer.Pod{{ID: "future"}}, clock.Now().Add(time.Second))
+	d.Prime([]*kubecontainer.Pod{{ID: "expired"}}, clock.Now().Add(-2*time.Second))
+	if !d.LastUpdated().IsZero() {
+		t.Errorf("expected the invalid seeds to be ignored")
+	}
+
+	seeded := []*kubecontainer.Pod{{ID: "1234"}}
+	asOf := clock.Now().Add(-500 * time.Millisecond)
+	d.Prime(seeded, asOf)
+	// GetPodsOnce doesn't let the updating thread replace the seeded pods.
+	seeded[0].ID = "changed"
+	pods, err := d.GetPodsOnce()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pods) != 1 || pods[0].ID != "1234" {
+		t.Errorf("expected the seeded pods, got %v", pods)
+	}
+	if getter.callCount() != 0 {
+		t.Errorf("expected docker not to be listed, got %d calls", getter.callCount())
+	}
+	if !d.LastUpdated().Equal(asOf) {
+		t.Errorf("expected the cache time %v, got %v", asOf, d.LastUpdated())
+	}
+
+	// An older seed doesn't replace the cached pods.
+	d.Prime([]*kubecontainer.Pod{{ID: "older"}}, asOf.Add(-time.Millisecond))
+	if pods, _ := d.GetPodsOnce(); len(pods) != 1 || pods[0].ID != "1234" {
+		t.Errorf("expected the older seed to be ignored, got %v", pods)
+	}
+}
+
+func TestWaitForInitialSync(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1234"}}, err: fmt.Errorf("docker is down")}
+	d := newTestDockerCache(t, getter, newFakeClock())
+	defer d.Stop()
+
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		getter.Lock()
+		getter.err = nil
+		getter.Unlock()
+	}()
+	if err := d.WaitForInitialSync(5 * time.Second); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if getter.callCount() < 2 {
+		t.Errorf("expected the failed refresh to be retried, got %d calls", getter.callCount())
+	}
+	pods, err := d.GetPods()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pods) != 1 {
+		t.Errorf("expected the synced pods, got %v", pods)
+	}
+	if err := d.WaitForInitialSync(time.Nanosecond); err != nil {
+		t.Errorf("expected an already synced cache to return immediately, got %v", err)
+	}
+}
+
+func TestWaitForInitialSyncTimeout(t *testing.T) {
+	getter := &fakePodsGetter{err: fmt.Errorf("docker is down")}
+	d := newTestDockerCache(t, getter, newFakeClock())
+	defer d.Stop()
+
+	if err := d.WaitForInitialSync(50 * time.Millisecond); err == nil {
+		t.Errorf("expected an error when docker never answers")
+	}
+}
+
+func TestForceUpdate(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1234"}}}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	if err := d.ForceUpdate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// ForceUpdate ignores the freshness of the cache.
+	getter.Lock()
+	getter.pods = []*kubecontainer.Pod{{ID: "5678"}}
+	getter.Unlock()
+	if err := d.ForceUpdate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if getter.callCount() != 2 {
+		t.Errorf("expected 2 calls, got %d", getter.callCount())
+	}
+	if _, found, _ := d.GetPodByUID("5678"); !found {
+		t.Errorf("expected the forced update to be stored")
+	}
+
+	// A failed update keeps the previous content.
+	getter.Lock()
+	getter.pods = nil
+	getter.err = fmt.Errorf("docker is down")
+	getter.Unlock()
+	if err := d.ForceUpdate(); err == nil {
+		t.Errorf("expected an error")
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if len(d.pods) != 1 || d.pods[0].ID != "5678" {
+		t.Errorf("expected the cache to be untouched, got %v", d.pods)
+	}
+}
+
+func TestMaxPods(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{
+		{ID: "1", Containers: []*kubecontainer.Container{{ID: "a", Created: 10}}},
+		{ID: "2", Containers: []*kubecontainer.Container{{ID: "b", Created: 30}}},
+		{ID: "3", Containers: []*kubecontainer.Container{{ID: "c", Created: 5}, {ID: "d", Created: 40}}},
+		{ID: "4", Containers: []*kubecontainer.Container{{ID: "e", Created: 30}}},
+	}}
+	d, err := NewDockerCache(getter, DockerCacheConfig{MaxPods: 3})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Stop()
+
+	pods, err := d.GetPods()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var uids []types.UID
+	for _, pod := range pods {
+		uids = append(uids, pod.ID)
+	}
+	if expected := []types.UID{"2", "3", "4"}; !reflect.DeepEqual(uids, expected) {
+		t.Errorf("expected pods %v, got %v", expected, uids)
+	}
+	if _, found, _ := d.GetPodByUID("1"); found {
+		t.Errorf("expected the oldest pod not to be cached")
+	}
+}
+
+func TestRegisterMetricsRejectsDuplicateNames(t *testing.T) {
+	newCache := func() DockerCache {
+		cache, err := NewDockerCache(&fakePodsGetter{}, testDockerCacheConfig(newFakeClock()).WithName("age"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return cache
+	}
+	reported := func() []string {
+		ch := make(chan prometheus.Metric, 100)
+		ageCollector.Collect(ch)
+		close(ch)
+		var names []string
+		for metric := range ch {
+			var m dto.Metric
+			if err := metric.Write(&m); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for _, label := range m.GetLabel() {
+				if label.GetValue() == "age" {
+					names = append(names, label.GetValue())
+				}
+			}
+		}
+		return names
+	}
+
+	first := newCache()
+	if _, err := first.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := RegisterMetrics(first); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := RegisterMetrics(first); err != nil {
+		t.Errorf("expected registering a cache again to succeed, got %v", err)
+	}
+	second := newCache()
+	if err := RegisterMetrics(second); err == nil {
+		t.Errorf("expected registering another cache of the same name to fail")
+	}
+	if names := reported(); len(names) != 1 {
+		t.Errorf("expected the age of the first cache to be reported, got %v", names)
+	}
+
+	// Stopping the cache which isn't reported leaves the reported one alone.
+	second.Stop()
+	if names := reported(); len(names) != 1 {
+		t.Errorf("expected the age of the first cache to be reported, got %v", names)
+	}
+	first.Stop()
+	if names := reported(); len(names) != 0 {
+		t.Errorf("expected the age of a stopped cache not to be reported, got %v", names)
+	}
+	third := newCache()
+	defer third.Stop()
+	if err := RegisterMetrics(third); err != nil {
+		t.Errorf("expected the name of a stopped cache to be reusable, got %v", err)
+	}
+}
+
+func TestDockerCacheCounterNames(t *testing.T) {
+	tests := []struct {
+		counter *prometheus.CounterVec
+		name    string
+	}{
+		{dockerCacheRefreshCount, "kubelet_docker_cache_refresh_total"},
+		{dockerCacheRefreshErrors, "kubelet_docker_cache_refresh_errors_total"},
+		{dockerCacheTruncatedRefreshes, "kubelet_docker_cache_truncated_refreshes_total"},
+		{dockerCacheDuplicatePods, "kubelet_docker_cache_duplicate_pods_total"},
+		{dockerCacheSyncRefreshes, "kubelet_docker_cache_sync_refresh_total"},
+		{dockerCacheSubscriberDrops, "kubelet_docker_cache_subscriber_dropped_total"},
+	}
+	for _, test := range tests {
+		descs := make(chan *prometheus.Desc, 1)
+		test.counter.Describe(descs)
+		if desc := (<-descs).String(); !strings.Contains(desc, fmt.Sprintf("fqName: %q", test.name)) {
+			t.Errorf("expected counter %s, got %s", test.name, desc)
+		}
+	}
+}
+
+func TestDuplicatePods(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{
+		{ID: "1", Name: "first", Containers: []*kubecontainer.Container{{ID: "a"}}},
+		{ID: "2", Name: "first", Containers: []*kubecontainer.Container{{ID: "b"}}},
+		{ID: "1", Name: "second", Containers: []*kubecontainer.Container{{ID: "a"}, {ID: "c"}}},
+		{ID: "2", Name: "second", Containers: []*kubecontainer.Container{{ID: "d"}}},
+		{ID: "2", Name: "third"},
+	}}
+	d, err := NewDockerCache(getter, DockerCacheConfig{Name: "duplicates"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Stop()
+	duplicates := func() float64 {
+		var metric dto.Metric
+		if err := dockerCacheDuplicatePods.WithLabelValues("duplicates").Write(&metric); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return metric.GetCounter().GetValue()
+	}
+	before := duplicates()
+
+	pods, err := d.GetPods()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var names []string
+	for _, pod := range pods {
+		names = append(names, string(pod.ID)+"/"+pod.Name)
+	}
+	if expected := []string{"1/second", "2/first"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected pods %v, got %v", expected, names)
+	}
+	if pod, _, _ := d.GetPodByUID("1"); pod == nil || len(pod.Containers) != 2 {
+		t.Errorf("expected the pod with the most containers to be indexed, got %v", pod)
+	}
+	if count := duplicates() - before; count != 3 {
+		t.Errorf("expected 3 duplicate pods counted, got %v", count)
+	}
+}
+
+func TestNewDockerCacheValidatesMaxPods(t *testing.T) {
+	if _, err := NewDockerCache(&fakePodsGetter{}, DockerCacheConfig{MaxPods: -1}); err == nil {
+		t.Errorf("expected an error for a negative max pods")
+	}
+}
+
+func TestRange(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1"}, {ID: "2"}, {ID: "3"}}}
+	d := newTestDockerCache(t, getter, newFakeClock())
+	defer d.Stop()
+
+	var uids []types.UID
+	err := d.Range(func(pod *kubecontainer.Pod) bool {
+		uids = append(uids, pod.ID)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []types.UID{"1", "2", "3"}; !reflect.DeepEqual(uids, expected) {
+		t.Errorf("expected pods %v, got %v", expected, uids)
+	}
+
+	uids = nil
+	err = d.Range(func(pod *kubecontainer.Pod) bool {
+		uids = append(uids, pod.ID)
+		return pod.ID != "2"
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []types.UID{"1", "2"}; !reflect.DeepEqual(uids, expected) {
+		t.Errorf("expected the iteration to stop after pod 2, got %v", uids)
+	}
+}
+
+func TestGetPodsWithFreshness(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1234"}}}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	pods, fresh, err := d.GetPodsWithFreshness()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !fresh || len(pods) != 1 {
+		t.Errorf("expected fresh pods, got %v (fresh %v)", pods, fresh)
+	}
+
+	dockerErr := fmt.Errorf("docker is down")
+	getter.Lock()
+	getter.err = dockerErr
+	getter.Unlock()
+	clock.Step(2 * time.Second)
+	pods, fresh, err = d.GetPodsWithFreshness()
+	if !IsStaleCacheError(err) {
+		t.Errorf("expected a stale cache error, got %v", err)
+	}
+	// The docker error can be reached from the stale cache error.
+	if !errors.Is(err, dockerErr) {
+		t.Errorf("expected the docker error to be wrapped, got %v", err)
+	}
+	if fresh || len(pods) != 1 {
+		t.Errorf("expected stale pods, got %v (fresh %v)", pods, fresh)
+	}
+}
+
+func TestStaleCacheErrorPredicatesUnwrap(t *testing.T) {
+	warming := fmt.Errorf("listing pods: %w", &StaleCacheError{Err: ErrCacheWarming})
+	if !IsStaleCacheError(warming) || !IsCacheWarming(warming) {
+		t.Errorf("expected a wrapped warming error to be recognized, got %v", warming)
+	}
+	failed := fmt.Errorf("listing pods: %w", &StaleCacheError{Err: errors.New("docker down")})
+	if !IsStaleCacheError(failed) || IsCacheWarming(failed) {
+		t.Errorf("expected a wrapped refresh error not to report warming, got %v", failed)
+	}
+	if IsStaleCacheError(ErrCacheWarming) || IsCacheWarming(ErrCacheWarming) {
+		t.Errorf("expected a bare error not to be a stale cache error")
+	}
+}
+
+func TestGetPodsRefusesPodsOlderThanMaxCacheAge(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1234"}}}
+	clock := newFakeClock()
+	d, err := NewDockerCache(getter, testDockerCacheConfig(clock).
+		WithMaxCacheAge(5*time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Stop()
+
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	getter.Lock()
+	getter.err = fmt.Errorf("docker is down")
+	getter.Unlock()
+
+	clock.Step(2 * time.Second)
+	if pods, err := d.GetPods(); !IsStaleCacheError(err) || len(pods) != 1 {
+		t.Errorf("expected the stale pods below the max cache age, got %v, %v", pods, err)
+	}
+	clock.Step(4 * time.Second)
+	if pods, err := d.GetPods(); err != ErrCacheTooStale || pods != nil {
+		t.Errorf("expected %v and no pods, got %v, %v", ErrCacheTooStale, pods, err)
+	}
+	if _, found, err := d.GetPodByUID("1234"); err != ErrCacheTooStale || found {
+		t.Errorf("expected %v and no pod, got %v, %v", ErrCacheTooStale, found, err)
+	}
+
+	getter.Lock()
+	getter.err = nil
+	getter.Unlock()
+	if pods, err := d.GetPods(); err != nil || len(pods) != 1 {
+		t.Errorf("expected the pods once docker is back, got %v, %v", pods, err)
+	}
+}
+
+func TestAllReadsRefusePodsOlderThanMaxCacheAge(t *testing.T) {
+	getter := &fakePodsGetter{
+		pods:    []*kubecontainer.Pod{{ID: "1234", Containers: []*kubecontainer.Container{{ID: "a"}}}},
+		allPods: []*kubecontainer.Pod{{ID: "1234", Containers: []*kubecontainer.Container{{ID: "a"}}}},
+	}
+	clock := newFakeClock()
+	cache, err := NewDockerCache(getter, testDockerCacheConfig(clock).
+		WithDisableBackgroundRefresh(true).
+		WithMaxCacheAge(5*time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer cache.Stop()
+
+	reads := []struct {
+		name string
+		read func() (bool, error)
+	}{
+		{"GetAllPods", func() (bool, error) {
+			pods, err := cache.GetAllPods()
+			return len(pods) > 0, err
+		}},
+		{"GetPodsFiltered", func() (bool, error) {
+			pods, err := cache.GetPodsFiltered(func(*kubecontainer.Pod) bool { return true })
+			return len(pods) > 0, err
+		}},
+		{"GetPodStatus", func() (bool, error) {
+			_, found, err := cache.GetPodStatus("1234")
+			return found, err
+		}},
+		{"GetPodAndStatus", func() (bool, error) {
+			_, _, found, err := cache.GetPodAndStatus("1234")
+			return found, err
+		}},
+		{"GetContainerStateAge", func() (bool, error) {
+			_, found, err := cache.GetContainerStateAge("a")
+			return found, err
+		}},
+		{"ReadOnlyView", func() (bool, error) {
+			pods, err := cache.ReadOnlyView().GetPods()
+			return len(pods) > 0, err
+		}},
+	}
+	if _, err := cache.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, r := range reads {
+		if served, err := r.read(); err != nil || !served {
+			t.Fatalf("%s: expected the pods, got %v, %v", r.name, served, err)
+		}
+	}
+	getter.Lock()
+	getter.err = fmt.Errorf("docker is down")
+	getter.Unlock()
+
+	clock.Step(2 * time.Second)
+	for _, r := range reads {
+		if served, err := r.read(); err == ErrCacheTooStale || !served {
+			t.Errorf("%s: expected the pods below the max cache age, got %v, %v", r.name, served, err)
+		}
+	}
+	clock.Step(4 * time.Second)
+	for _, r := range reads {
+		if served, err := r.read(); err != ErrCacheTooStale || served {
+			t.Errorf("%s: expected %v and no pods, got %v, %v", r.name, ErrCacheTooStale, served, err)
+		}
+	}
+}
+
+func TestNewDockerCacheValidatesMaxCacheAge(t *testing.T) {
+	_, err := NewDockerCache(&fakePodsGetter{}, DockerCacheConfig{
+		SyncStalenessThreshold: time.Second,
+		MaxCacheAge:            500 * time.Millisecond,
+	})
+	if err == nil {
+		t.Errorf("expected an error for a max cache age below the sync staleness threshold")
+	}
+}
+
+func TestForceUpdateDebounce(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1234"}}}
+	clock := newFakeClock()
+	d, err := NewDockerCache(getter, DockerCacheConfig{
+		ForceUpdateDebounce: 50 * time.Millisecond,
+		Clock:               clock,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := d.ForceUpdate(); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if getter.callCount() != 1 {
+		t.Errorf("expected the forced refreshes to collapse, got %d calls", getter.callCount())
+	}
+
+	clock.Step(50 * time.Millisecond)
+	if err := d.ForceUpdate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if getter.callCount() != 2 {
+		t.Errorf("expected a new refresh after the debounce window, got %d calls", getter.callCount())
+	}
+}
+
+func TestGetPodsServesStaleDataOnRefreshError(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1234"}}}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	refreshErr := fmt.Errorf("docker is down")
+	getter.Lock()
+	getter.pods = nil
+	getter.err = refreshErr
+	getter.Unlock()
+
+	for i := 1; i <= 2; i++ {
+		clock.Step(2 * time.Second)
+		pods, err := d.GetPods()
+		if !IsStaleCacheError(err) {
+			t.Fatalf("expected a stale cache error, got %v", err)
+		}
+		refreshError, ok := err.(*StaleCacheError).Err.(*RefreshError)
+		if !ok || refreshError.Unwrap() != refreshErr {
+			t.Errorf("expected the refresh error to be wrapped, got %v", err)
+		}
+		if expected := time.Duration(2*i) * time.Second; refreshError.CacheAge != expected {
+			t.Errorf("expected a cache age of %v, got %v", expected, refreshError.CacheAge)
+		}
+		if len(pods) != 1 || pods[0].ID != "1234" {
+			t.Errorf("expected the last known good pods, got %v", pods)
+		}
+		status := d.CacheStatus()
+		if status.LastError.(*RefreshError).Err != refreshErr || status.ConsecutiveFailures < i {
+			t.Errorf("unexpected status after %d failures: %+v", i, status)
+		}
+	}
+
+	getter.Lock()
+	getter.err = nil
+	getter.Unlock()
+	clock.Step(2 * time.Second)
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status := d.CacheStatus(); status.LastError != nil || status.ConsecutiveFailures != 0 {
+		t.Errorf("expected a successful refresh to clear the errors, got %+v", status)
+	}
+}
+
+func TestTap(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1234"}}}
+	var d *dockerCache
+	var lock sync.Mutex
+	var tapped [][]*kubecontainer.Pod
+	var tappedErrs []error
+	tap := func(pods []*kubecontainer.Pod, err error, duration time.Duration) {
+		// The cache isn't locked.
+		d.LastUpdated()
+		lock.Lock()
+		defer lock.Unlock()
+		tapped = append(tapped, pods)
+		tappedErrs = append(tappedErrs, err)
+	}
+	clock := newFakeClock()
+	// Without the background thread, so that only the listings below are
+	// tapped.
+	cache, err := NewDockerCache(getter, testDockerCacheConfig(clock).
+		WithDisableBackgroundRefresh(true).
+		WithTap(tap))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d = cache.(*dockerCache)
+	defer d.Stop()
+
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := d.GetAllPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The partial listing of a failed refresh is dropped before the tap,
+	// like for any observer.
+	failure := fmt.Errorf("docker is down")
+	getter.Lock()
+	getter.pods = []*kubecontainer.Pod{{ID: "9999"}}
+	getter.err = failure
+	getter.Unlock()
+	clock.Step(2 * time.Second)
+	if _, err := d.GetPods(); !IsStaleCacheError(err) {
+		t.Fatalf("expected a stale cache error, got %v", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(tapped) != 3 {
+		t.Fatalf("expected 3 tapped listings, got %d", len(tapped))
+	}
+	for i := 0; i < 2; i++ {
+		if len(tapped[i]) != 1 || tapped[i][0].ID != "1234" {
+			t.Errorf("expected listing %d to be pod 1234, got %v", i, tapped[i])
+		}
+	}
+	if tapped[2] != nil {
+		t.Errorf("expected the failed listing to be tapped without pods, got %v", tapped[2])
+	}
+	if tappedErrs[0] != nil || tappedErrs[1] != nil || tappedErrs[2] != failure {
+		t.Errorf("unexpected tapped errors: %v", tappedErrs)
+	}
+}
+
+func TestGetPodsDiscardsPartialListing(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1234"}, {ID: "5678"}}}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	getter.Lock()
+	getter.pods = []*kubecontainer.Pod{{ID: "9999"}}
+	getter.err = fmt.Errorf("docker is down")
+	getter.Unlock()
+
+	// Synchronous refresh.
+	clock.Step(2 * time.Second)
+	pods, err := d.GetPods()
+	if !IsStaleCacheError(err) {
+		t.Fatalf("expected a stale cache error, got %v", err)
+	}
+	if len(pods) != 2 || pods[0].ID != "1234" || pods[1].ID != "5678" {
+		t.Errorf("expected the last known good pods, got %v", pods)
+	}
+
+	// Background refresh.
+	getter = &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1234"}, {ID: "5678"}}}
+	d = newTestDockerCache(t, getter, util.RealClock{})
+	defer d.Stop()
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	getter.Lock()
+	getter.pods = []*kubecontainer.Pod{{ID: "9999"}}
+	getter.err = fmt.Errorf("docker is down")
+	getter.Unlock()
+	err = wait.Poll(5*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return d.CacheStatus().ConsecutiveFailures >= 3, nil
+	})
+	if err != nil {
+		t.Fatalf("background refreshes did not fail: %v", err)
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if len(d.pods) != 2 || d.pods[0].ID != "1234" || d.pods[1].ID != "5678" {
+		t.Errorf("expected a failed background refresh to keep the cached pods, got %v", d.pods)
+	}
+	if _, found := d.podsByUID["9999"]; found {
+		t.Errorf("expected the partial listing not to be indexed")
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1234"}}}
+	clock := newFakeClock()
+	d, err := NewDockerCache(getter, testDockerCacheConfig(clock).
+		WithUnhealthyThreshold(10*time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := d.Healthy(); err != nil {
+		t.Errorf("expected a new cache to be healthy, got %v", err)
+	}
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	getter.Lock()
+	getter.err = fmt.Errorf("docker is down")
+	getter.Unlock()
+	clock.Step(2 * time.Second)
+	d.GetPods()
+	if err := d.Healthy(); err != nil {
+		t.Errorf("expected a recent failure to be tolerated, got %v", err)
+	}
+	clock.Step(11 * time.Second)
+	d.GetPods()
+	err = d.Healthy()
+	if err == nil || !strings.Contains(err.Error(), "2 times") || !strings.Contains(err.Error(), "docker is down") {
+		t.Errorf("expected sustained failures to be reported, got %v", err)
+	}
+
+	getter.Lock()
+	getter.err = nil
+	getter.Unlock()
+	clock.Step(2 * time.Second)
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := d.Healthy(); err != nil {
+		t.Errorf("expected a successful refresh to restore health, got %v", err)
+	}
+	d.Stop()
+	if err := d.Healthy(); err != ErrCacheStopped {
+		t.Errorf("expected %v, got %v", ErrCacheStopped, err)
+	}
+}
+
+func TestRecordFailureRateLimitsWarnings(t *testing.T) {
+	clock := newFakeClock()
+	d := newTestDockerCache(t, &fakePodsGetter{}, clock)
+	defer d.Stop()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for i := 1; i < failureWarningThreshold; i++ {
+		d.recordFailure(fmt.Errorf("error %d", i))
+	}
+	if !d.lastFailureWarning.IsZero() {
+		t.Errorf("expected no warning below the threshold")
+	}
+	d.recordFailure(fmt.Errorf("error"))
+	warned := d.lastFailureWarning
+	if !warned.Equal(clock.Now()) {
+		t.Errorf("expected a warning once the threshold is reached")
+	}
+	clock.Step(time.Second)
+	d.recordFailure(fmt.Errorf("error"))
+	if !d.lastFailureWarning.Equal(warned) {
+		t.Errorf("expected the warnings to be rate limited")
+	}
+	clock.Step(failureWarningInterval)
+	d.recordFailure(fmt.Errorf("error"))
+	if !d.lastFailureWarning.Equal(clock.Now()) {
+		t.Errorf("expected a new warning after the rate limit interval")
+	}
+}
+
+func TestOnErrorCalledForFailedRefreshes(t *testing.T) {
+	getter := &fakePodsGetter{err: fmt.Errorf("docker is down")}
+	clock := newFakeClock()
+	var lock sync.Mutex
+	var errs []error
+	var d DockerCache
+	d, err := NewDockerCache(getter, DockerCacheConfig{
+		SyncStalenessThreshold: time.Second,
+		RefreshInterval:        10 * time.Millisecond,
+		Clock:                  clock,
+		OnError: func(err error) {
+			// The cache must not be locked while the handler runs.
+			d.CacheStatus()
+			lock.Lock()
+			defer lock.Unlock()
+			errs = append(errs, err)
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Stop()
+
+	if err, ok := d.ForceUpdate().(*RefreshError); !ok || err.Err != getter.err {
+		t.Fatalf("expected %v to be wrapped, got %v", getter.err, err)
+	}
+	lock.Lock()
+	if len(errs) != 1 || errs[0].(*RefreshError).Err != getter.err {
+		t.Errorf("expected the synchronous failure to be reported, got %v", errs)
+	}
+	lock.Unlock()
+
+	// Keep the updating thread running and failing.
+	getter.Lock()
+	getter.err = nil
+	getter.Unlock()
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	getter.Lock()
+	getter.err = fmt.Errorf("docker is still down")
+	getter.Unlock()
+	err = wait.Poll(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		clock.Step(20 * time.Millisecond)
+		lock.Lock()
+		defer lock.Unlock()
+		return len(errs) > 1, nil
+	})
+	if err != nil {
+		t.Errorf("expected the background failures to be reported")
+	}
+}
+
+func TestInternStrings(t *testing.T) {
+	for _, intern := range []bool{false, true} {
+		cache, err := NewDockerCache(&fakePodsGetter{pods: newDenseNodePods()}, testDockerCacheConfig(newFakeClock()).
+			WithInternStrings(intern))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		d := cache.(*dockerCache)
+		if _, err := d.GetPods(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		d.lock.Lock()
+		shared := stringData(d.pods[0].Containers[0].Image) == stringData(d.pods[1].Containers[0].Image) &&
+			stringData(d.podsByUID["pod0"].Namespace) == stringData(d.podsByUID["pod3"].Namespace)
+		bytes := sharedStringBytes(d.pods)
+		d.lock.Unlock()
+		if shared != intern {
+			t.Errorf("intern %v: expected equal strings to be shared %v", intern, intern)
+		}
+		// 3 namespaces and 4 images once interned.
+		if expected := 3*len("namespace0") + 4*len("gcr.io/google_containers/image0:latest"); intern && bytes != expected {
+			t.Errorf("expected the strings to take %d bytes, got %d", expected, bytes)
+		}
+		d.Stop()
+	}
+}
+
+func TestDaemonRestartDetected(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{
+		{ID: "1234", Containers: []*kubecontainer.Container{{ID: "a"}, {ID: "b"}}},
+		{ID: "5678", Containers: []*kubecontainer.Container{{ID: "c"}}},
+	}}
+	clock := newFakeClock()
+	var errs []error
+	d, err := NewDockerCache(getter, testDockerCacheConfig(clock).
+		WithDisableBackgroundRefresh(true).
+		WithOnError(func(err error) { errs = append(errs, err) }))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Stop()
+
+	refresh := func(pods []*kubecontainer.Pod) {
+		getter.Lock()
+		getter.pods = pods
+		getter.Unlock()
+		if err := d.ForceUpdate(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	refresh(getter.pods)
+	// Some containers survive.
+	refresh([]*kubecontainer.Pod{
+		{ID: "1234", Containers: []*kubecontainer.Container{{ID: "a"}, {ID: "d"}}},
+	})
+	if len(errs) != 0 {
+		t.Errorf("expected no restart with overlapping containers, got %v", errs)
+	}
+	// All the containers are replaced.
+	refresh([]*kubecontainer.Pod{
+		{ID: "1234", Containers: []*kubecontainer.Container{{ID: "e"}, {ID: "f"}}},
+		{ID: "5678", Containers: []*kubecontainer.Container{{ID: "g"}}},
+	})
+	if len(errs) != 1 || errs[0] != ErrDaemonRestartDetected {
+		t.Errorf("expected %v to be reported, got %v", ErrDaemonRestartDetected, errs)
+	}
+	// Losing all the containers is not a restart.
+	refresh(nil)
+	if len(errs) != 1 {
+		t.Errorf("expected no restart without containers, got %v", errs)
+	}
+}
+
+// flakyPodsGetter is a podsGetter failing its first failures listings.
+type flakyPodsGetter struct {
+	fakePodsGetter
+	failures int
+}
+
+func (f *flakyPodsGetter) GetPods(all bool) ([]*kubecontainer.Pod, error) {
+	f.Lock()
+	failing := f.failures > 0
+	f.failures--
+	f.Unlock()
+	if failing {
+		return nil, fmt.Errorf("docker is not up yet")
+	}
+	return f.fakePodsGetter.GetPods(all)
+}
+
+func TestDockerUnreachableAtStartup(t *testing.T) {
+	getter := &flakyPodsGetter{fakePodsGetter: fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1234"}}}, failures: 4}
+	d := newTestDockerCache(t, getter, util.RealClock{})
+	defer d.Stop()
+
+	if _, err := d.GetPods(); err == nil {
+		t.Fatalf("expected the first listing to fail")
+	}
+	// Nobody asks again, but the background thread keeps retrying although
+	// idle until docker answers.
+	err := wait.Poll(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return !d.LastUpdated().IsZero(), nil
+	})
+	if err != nil {
+		t.Fatalf("expected the cache to be loaded once docker answered")
+	}
+	pods, err := d.GetPodsOnce()
+	if err != nil || len(pods) != 1 || pods[0].ID != "1234" {
+		t.Errorf("expected the cached pods, got %v (error %v)", pods, err)
+	}
+}
+
+func TestUpdaterStopsWhenIdleAfterDockerFails(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1234"}}}
+	cache, err := NewDockerCache(getter, testDockerCacheConfig(util.RealClock{}).
+		WithIdleShutdownTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d := cache.(*dockerCache)
+	defer d.Stop()
+
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Once loaded, the cache isn't worth listing a dead docker for if
+	// nobody reads it.
+	getter.Lock()
+	getter.err = fmt.Errorf("docker is down")
+	getter.Unlock()
+	waitForUpdaterStop(t, d)
+}
+
+// panickingPodsGetter is a podsGetter which panics while panicking is set.
+type panickingPodsGetter struct {
+	fakePodsGetter
+	panicking bool
+}
+
+func (f *panickingPodsGetter) GetPods(all bool) ([]*kubecontainer.Pod, error) {
+	f.Lock()
+	panicking := f.panicking
+	f.Unlock()
+	if panicking {
+		var pod *kubecontainer.Pod
+		_ = pod.ID
+	}
+	return f.fakePodsGetter.GetPods(all)
+}
+
+func (f *panickingPodsGetter) setPanicking(panicking bool) {
+	f.Lock()
+	defer f.Unlock()
+	f.panicking = panicking
+}
+
+func TestGetterPanicIsRecovered(t *testing.T) {
+	getter := &panickingPodsGetter{fakePodsGetter: fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1234"}}}}
+	getter.setPanicking(true)
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	if _, err := d.GetPods(); !IsStaleCacheError(err) {
+		t.Errorf("expected the panic to be reported as an error, got %v", err)
+	}
+	getter.setPanicking(false)
+	if pods, err := d.GetPods(); err != nil || len(pods) != 1 {
+		t.Fatalf("expected the cache to recover, got %v, %v", pods, err)
+	}
+
+	// The updating thread survives a panic too.
+	getter.setPanicking(true)
+	err := wait.Poll(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		clock.Step(20 * time.Millisecond)
+		return d.CacheStatus().ConsecutiveFailures > 0, nil
+	})
+	if err != nil {
+		t.Fatalf("expected the updating thread to report the panic")
+	}
+	getter.setPanicking(false)
+	err = wait.Poll(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		clock.Step(20 * time.Millisecond)
+		return d.CacheStatus().ConsecutiveFailures == 0, nil
+	})
+	if err != nil {
+		t.Errorf("expected the updating thread to keep refreshing after a panic")
+	}
+}
+
+func TestNextBackoff(t *testing.T) {
+	cache, err := NewDockerCache(&fakePodsGetter{}, DockerCacheConfig{
+		SyncStalenessThreshold: time.Second,
+		RefreshInterval:        100 * time.Millisecond,
+		MaxRefreshBackoff:      time.Second,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d := cache.(*dockerCache)
+
+	tests := []struct {
+		failed   bool
+		expected time.Duration
+	}{
+		{false, 100 * time.Millisecond},
+		{true, 200 * time.Millisecond},
+		{true, 400 * time.Millisecond},
+		{true, 800 * time.Millisecond},
+		{true, time.Second},
+		{true, time.Second},
+		{false, 100 * time.Millisecond},
+		{true, 200 * time.Millisecond},
+	}
+	for i, test := range tests {
+		if delay := d.nextBackoff(test.failed); delay != test.expected {
+			t.Errorf("%d: expected delay %v, got %v", i, test.expected, delay)
+		}
+	}
+}
+
+func TestAdaptToLatency(t *testing.T) {
+	tests := []struct {
+		factor   float64
+		latency  time.Duration
+		expected time.Duration
+	}{
+		{0, 300 * time.Millisecond, 100 * time.Millisecond},
+		{2, 30 * time.Millisecond, 100 * time.Millisecond},
+		{2, 300 * time.Millisecond, 600 * time.Millisecond},
+		{1.5, time.Second, 1500 * time.Millisecond},
+	}
+	for _, test := range tests {
+		cache, err := NewDockerCache(&fakePodsGetter{}, DefaultDockerCacheConfig().WithLatencyFactor(test.factor))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		d := cache.(*dockerCache)
+		if delay := d.adaptToLatency(100*time.Millisecond, test.latency); delay != test.expected {
+			t.Errorf("factor %v, latency %v: expected delay %v, got %v", test.factor, test.latency, test.expected, delay)
+		}
+	}
+	if _, err := NewDockerCache(&fakePodsGetter{}, DefaultDockerCacheConfig().WithLatencyFactor(-1)); err == nil {
+		t.Errorf("expected an error for a negative latency factor")
+	}
+}
+
+func TestNewDockerCacheValidatesMaxRefreshBackoff(t *testing.T) {
+	_, err := NewDockerCache(&fakePodsGetter{}, DockerCacheConfig{
+		SyncStalenessThreshold: time.Second,
+		RefreshInterval:        100 * time.Millisecond,
+		MaxRefreshBackoff:      50 * time.Millisecond,
+	})
+	if err == nil {
+		t.Errorf("expected an error for a max backoff below the refresh interval")
+	}
+}
+
+func TestSyncRefreshSharesInFlightBackgroundRefresh(t *testing.T) {
+	getter := &fakePodsGetter{}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	// Pretend the background updater is running and listing docker.
+	d.updatingCache = true
+	d.refreshing = true
+	d.refresh = newRefreshResult()
+
+	result := make(chan []*kubecontainer.Pod)
+	go func() {
+		pods, err := d.GetPods()
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		result <- pods
+	}()
+	select {
+	case <-result:
+		t.Fatalf("GetPods returned before the in-flight refresh completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	d.lock.Lock()
+	d.refreshing = false
+	d.setPods([]*kubecontainer.Pod{{ID: "1234"}}, clock.Now(), 0)
+	d.refresh.finish(nil)
+	d.lock.Unlock()
+
+	pods := <-result
+	if len(pods) != 1 || pods[0].ID != "1234" {
+		t.Errorf("expected the result of the in-flight refresh, got %v", pods)
+	}
+	if getter.callCount() != 0 {
+		t.Errorf("expected docker not to be listed again, got %d calls", getter.callCount())
+	}
+}
+
+func TestWaitersGetTheRefreshTheyWaitedFor(t *testing.T) {
+	for _, waitedErr := range []error{fmt.Errorf("docker is down"), nil} {
+		getter := &fakePodsGetter{}
+		clock := newFakeClock()
+		cache, err := NewDockerCache(getter, testDockerCacheConfig(clock).WithDisableBackgroundRefresh(true))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		d := cache.(*dockerCache)
+		// Pretend docker is being listed.
+		d.lock.Lock()
+		d.refreshing = true
+		d.refresh = newRefreshResult()
+		d.lock.Unlock()
+
+		result := make(chan error)
+		go func() {
+			result <- d.ForceUpdate()
+		}()
+		select {
+		case err := <-result:
+			t.Fatalf("ForceUpdate returned %v before the listing in flight completed", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		// The listing ends, and another one ends differently before the
+		// waiter gets the lock back.
+		d.lock.Lock()
+		d.refreshing = false
+		if waitedErr != nil {
+			d.recordFailure(waitedErr)
+		} else {
+			d.setPods(nil, clock.Now(), 0)
+		}
+		d.refresh.finish(waitedErr)
+		d.refresh = newRefreshResult()
+		if waitedErr != nil {
+			d.setPods(nil, clock.Now(), 0)
+			d.refresh.finish(nil)
+		} else {
+			d.recordFailure(fmt.Errorf("docker is down again"))
+			d.refresh.finish(d.lastError)
+		}
+		d.lock.Unlock()
+
+		if err := <-result; err != waitedErr {
+			t.Errorf("expected the error of the awaited listing %v, got %v", waitedErr, err)
+		}
+		if getter.callCount() != 0 {
+			t.Errorf("expected docker not to be listed again, got %d calls", getter.callCount())
+		}
+		d.Stop()
+	}
+}
+
+func TestConcurrentGetPodsListsDockerOnce(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1234"}}}
+	d := newTestDockerCache(t, getter, newFakeClock())
+	defer d.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := d.GetPods(); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	// The clock is frozen, so the background updater never finds the cache
+	// old enough to be refreshed again.
+	time.Sleep(50 * time.Millisecond)
+	if getter.callCount() != 1 {
+		t.Errorf("expected docker to be listed once, got %d calls", getter.callCount())
+	}
+}
+
+func TestGetAllPods(t *testing.T) {
+	getter := &fakePodsGetter{
+		pods:    []*kubecontainer.Pod{{ID: "1234"}},
+		allPods: []*kubecontainer.Pod{{ID: "1234"}, {ID: "5678"}},
+	}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	allPods, err := d.GetAllPods()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(allPods) != 2 {
+		t.Errorf("expected 2 pods, got %v", allPods)
+	}
+	pods, err := d.GetPods()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pods) != 1 {
+		t.Errorf("expected 1 running pod, got %v", pods)
+	}
+
+	// Within the sync staleness threshold both views are served from the cache.
+	getter.Lock()
+	allCalls := getter.allCalls
+	getter.Unlock()
+	if _, err := d.GetAllPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	getter.Lock()
+	defer getter.Unlock()
+	if getter.allCalls != allCalls {
+		t.Errorf("expected all pods to be served from cache, got %d new calls", getter.allCalls-allCalls)
+	}
+}
+
+func TestIdenticalRefreshDoesNotChurnCache(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{
+		{ID: "1234", Containers: []*kubecontainer.Container{{ID: "a", State: kubecontainer.ContainerStateRunning}}},
+	}}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	if err := d.ForceUpdate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ch, cancel := d.Subscribe("test")
+	defer cancel()
+	cached := d.pods
+
+	// Same pods listed again.
+	getter.Lock()
+	getter.pods = []*kubecontainer.Pod{
+		{ID: "1234", Containers: []*kubecontainer.Container{{ID: "a", State: kubecontainer.ContainerStateRunning}}},
+	}
+	getter.Unlock()
+	clock.Step(time.Second)
+	if err := d.ForceUpdate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d.lock.Lock()
+	if d.pods[0] != cached[0] {
+		t.Errorf("expected the cached pods to be kept")
+	}
+	if !d.cacheTime.Equal(clock.Now()) {
+		t.Errorf("expected the cache time to be bumped")
+	}
+	d.lock.Unlock()
+	select {
+	case pods := <-ch:
+		t.Errorf("expected no notification, got %v", pods)
+	default:
+	}
+
+	// The container exited.
+	getter.Lock()
+	getter.pods = []*kubecontainer.Pod{
+		{ID: "1234", Containers: []*kubecontainer.Container{{ID: "a", State: kubecontainer.ContainerStateExited}}},
+	}
+	getter.Unlock()
+	if err := d.ForceUpdate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	select {
+	case pods := <-ch:
+		if pods[0].Containers[0].State != kubecontainer.ContainerStateExited {
+			t.Errorf("expected the new container state, got %v", pods[0].Containers[0])
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected a notification for the changed container state")
+	}
+}
+
+func TestCustomEqualsFn(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1234"}}}
+	d, err := NewDockerCache(getter, DockerCacheConfig{
+		EqualsFn: func(old, pods []*kubecontainer.Pod) bool { return old != nil },
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Stop()
+
+	if err := d.ForceUpdate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	getter.Lock()
+	getter.pods = []*kubecontainer.Pod{{ID: "5678"}}
+	getter.Unlock()
+	if err := d.ForceUpdate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pods, err := d.GetPods()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pods) != 1 || pods[0].ID != "1234" {
+		t.Errorf("expected the pods reported equal to be kept, got %v", pods)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1234"}}}
+	d := newTestDockerCache(t, getter, newFakeClock())
+	defer d.Stop()
+
+	ch, cancel := d.Subscribe("test")
+	if err := d.ForceUpdate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	select {
+	case pods := <-ch:
+		if len(pods) != 1 || pods[0].ID != "1234" {
+			t.Errorf("unexpected snapshot %v", pods)
+		}
+	default:
+		t.Fatalf("expected a snapshot after the pods changed")
+	}
+
+	// An unchanged refresh is not notified.
+	if err := d.ForceUpdate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	select {
+	case pods := <-ch:
+		t.Errorf("unexpected snapshot %v", pods)
+	default:
+	}
+
+	// A slow subscriber only loses the oldest snapshots, which are counted.
+	dropped := func() float64 {
+		var metric dto.Metric
+		if err := dockerCacheSubscriberDrops.WithLabelValues(d.name, "test").Write(&metric); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return metric.GetCounter().GetValue()
+	}
+	before := dropped()
+	for i := 0; i < subscriberBufferSize+2; i++ {
+		getter.Lock()
+		getter.pods = []*kubecontainer.Pod{{ID: types.UID(fmt.Sprintf("%d", i))}}
+		getter.Unlock()
+		if err := d.ForceUpdate(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	var last []*kubecontainer.Pod
+	for i := 0; i < subscriberBufferSize; i++ {
+		last = <-ch
+	}
+	if expected := types.UID(fmt.Sprintf("%d", subscriberBufferSize+1)); last[0].ID != expected {
+		t.Errorf("expected the latest snapshot to be %s, got %v", expected, last[0].ID)
+	}
+	if delta := dropped() - before; delta != 2 {
+		t.Errorf("expected 2 dropped snapshots to be counted, got %v", delta)
+	}
+	d.lock.Lock()
+	for _, s := range d.subscribers {
+		if s.dropped != 2 {
+			t.Errorf("expected the subscriber to have dropped 2 snapshots, got %d", s.dropped)
+		}
+		// Only the first drop is logged until the clock moves on.
+		if s.unreported != 1 {
+			t.Errorf("expected the second drop not to be logged yet, got %d unreported drops", s.unreported)
+		}
+	}
+	d.lock.Unlock()
+
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Errorf("expected the channel to be closed after cancelling")
+	}
+	// Cancelling twice must be safe.
+	cancel()
+}
+
+func TestStopClosesSubscriptions(t *testing.T) {
+	d := newTestDockerCache(t, &fakePodsGetter{}, newFakeClock())
+	ch, cancel := d.Subscribe("test")
+	events, cancelEvents := d.SubscribeEvents("test")
+	d.Stop()
+	if _, ok := <-ch; ok {
+		t.Errorf("expected the channel to be closed after Stop")
+	}
+	if _, ok := <-events; ok {
+		t.Errorf("expected the event channel to be closed after Stop")
+	}
+	cancel()
+	cancelEvents()
+}
+
+func TestSubscribeEvents(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{
+		{ID: "1", Containers: []*kubecontainer.Container{{ID: "a", State: kubecontainer.ContainerStateRunning}}},
+		{ID: "2", Containers: []*kubecontainer.Container{{ID: "b", State: kubecontainer.ContainerStateRunning}}},
+	}}
+	d := newTestDockerCache(t, getter, newFakeClock())
+	defer d.Stop()
+
+	ch, cancel := d.SubscribeEvents("test")
+	receive := func() []PodCacheEvent {
+		var events []PodCacheEvent
+		for {
+			select {
+			case event := <-ch:
+				events = append(events, event)
+			default:
+				return events
+			}
+		}
+	}
+	check := func(step string, expected []PodCacheEvent) {
+		events := receive()
+		if len(events) != len(expected) {
+			t.Fatalf("%s: expected events %v, got %v", step, expected, events)
+		}
+		for i := range events {
+			if events[i].Type != expected[i].Type || events[i].Pod.ID != expected[i].Pod.ID {
+				t.Errorf("%s: expected event %v, got %v", step, expected[i], events[i])
+			}
+		}
+	}
+
+	if err := d.ForceUpdate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	check("initial", []PodCacheEvent{{PodAdded, &kubecontainer.Pod{ID: "1"}}, {PodAdded, &kubecontainer.Pod{ID: "2"}}})
+
+	getter.Lock()
+	getter.pods = []*kubecontainer.Pod{
+		{ID: "1", Containers: []*kubecontainer.Container{{ID: "a", State: kubecontainer.ContainerStateExited}}},
+		{ID: "3", Containers: []*kubecontainer.Container{{ID: "c", State: kubecontainer.ContainerStateRunning}}},
+	}
+	getter.Unlock()
+	if err := d.ForceUpdate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	check("changed", []PodCacheEvent{{PodModified, &kubecontainer.Pod{ID: "1"}}, {PodAdded, &kubecontainer.Pod{ID: "3"}}, {PodRemoved, &kubecontainer.Pod{ID: "2"}}})
+
+	if err := d.ForceUpdate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	check("unchanged", nil)
+
+	// A slow subscriber only loses the oldest events, which are counted
+	// along with the dropped snapshots.
+	dropped := func() float64 {
+		var metric dto.Metric
+		if err := dockerCacheSubscriberDrops.WithLabelValues(d.name, "test").Write(&metric); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return metric.GetCounter().GetValue()
+	}
+	before := dropped()
+	for i := 0; i < eventSubscriberBufferSize; i++ {
+		getter.Lock()
+		getter.pods = append(getter.pods, &kubecontainer.Pod{ID: types.UID(fmt.Sprintf("new-%d", i))})
+		getter.Unlock()
+		if err := d.ForceUpdate(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	getter.Lock()
+	getter.pods = getter.pods[1:]
+	getter.Unlock()
+	if err := d.ForceUpdate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	events := receive()
+	if len(events) != eventSubscriberBufferSize {
+		t.Fatalf("expected %d buffered events, got %d", eventSubscriberBufferSize, len(events))
+	}
+	if last := events[len(events)-1]; last.Type != PodRemoved || last.Pod.ID != "1" {
+		t.Errorf("expected the latest event to be the removal of pod 1, got %v", last)
+	}
+	if delta := dropped() - before; delta != 1 {
+		t.Errorf("expected 1 dropped event to be counted, got %v", delta)
+	}
+
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Errorf("expected the channel to be closed after cancelling")
+	}
+	cancel()
+}
+
+func TestIdleShutdownTimeoutIndependentFromSyncStalenessThreshold(t *testing.T) {
+	getter := &fakePodsGetter{}
+	clock := newFakeClock()
+	cache, err := NewDockerCache(getter, testDockerCacheConfig(clock).
+		WithIdleShutdownTimeout(3*time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d := cache.(*dockerCache)
+	defer d.Stop()
+
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	clock.Step(2 * time.Second)
+	d.lock.Lock()
+	idle := d.idle()
+	d.lock.Unlock()
+	if idle {
+		t.Errorf("expected the updater to outlive the sync staleness threshold")
+	}
+	clock.Step(2 * time.Second)
+	waitForUpdaterStop(t, d)
+}
+
+func TestIdleShutdownAfterClockJump(t *testing.T) {
+	getter := &fakePodsGetter{}
+	clock := newFakeClock()
+	cache, err := NewDockerCache(getter, testDockerCacheConfig(clock).
+		WithIdleShutdownTimeout(3*time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d := cache.(*dockerCache)
+	defer d.Stop()
+	idle := func() bool {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		return d.idle()
+	}
+
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	clock.Step(2 * time.Second)
+	if idle() {
+		t.Errorf("expected the cache not to be idle yet")
+	}
+	// The clock goes an hour back: only the time elapsed since counts
+	// towards the idle timeout.
+	clock.Step(-time.Hour)
+	if idle() {
+		t.Errorf("expected the cache not to be idle after the clock went back")
+	}
+	clock.Step(500 * time.Millisecond)
+	if idle() {
+		t.Errorf("expected the cache not to be idle after 2.5s")
+	}
+	clock.Step(time.Second)
+	waitForUpdaterStop(t, d)
+}
+
+func TestGetPodsReturnsDeepCopy(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{
+		{ID: "1234", Containers: []*kubecontainer.Container{{ID: "abcd", Name: "foo"}}},
+	}}
+	d := newTestDockerCache(t, getter, newFakeClock())
+	defer d.Stop()
+
+	pods, err := d.GetPods()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pods[0].Name = "bogus"
+	pods[0].Containers[0].Name = "bogus"
+	pod, _, err := d.GetPodByUID("1234")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pod.Containers[0].ID = "bogus"
+
+	pods, err = d.GetPods()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pods[0].Name != "" || pods[0].Containers[0].Name != "foo" || pods[0].Containers[0].ID != "abcd" {
+		t.Errorf("modifying the returned pods changed the cache: %+v %+v", pods[0], pods[0].Containers[0])
+	}
+}
+
+func TestGetPodsWithContextGivesUpOnHangingDocker(t *testing.T) {
+	getter := newBlockingPodsGetter()
+	getter.setBlocked(true)
+	defer close(getter.release)
+	d := newTestDockerCache(t, getter, newFakeClock())
+	defer d.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	result := make(chan error)
+	go func() {
+		_, err := d.GetPodsWithContext(ctx)
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if err != context.DeadlineExceeded {
+			t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("GetPodsWithContext did not return after the deadline")
+	}
+	if status := d.CacheStatus(); status.ConsecutiveFailures != 0 {
+		t.Errorf("expected a cancelled refresh not to count as a failure, got %+v", status)
+	}
+}
+
+func TestForceUpdateWithContextCancelled(t *testing.T) {
+	getter := newBlockingPodsGetter()
+	getter.setBlocked(true)
+	defer close(getter.release)
+	d := newTestDockerCache(t, getter, newFakeClock())
+	defer d.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() {
+		result <- d.ForceUpdateWithContext(ctx)
+	}()
+	<-getter.listings
+	cancel()
+	if err := <-result; err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestStopCancelsBackgroundRefresh(t *testing.T) {
+	getter := newBlockingPodsGetter()
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	getter.setBlocked(true)
+	defer close(getter.release)
+	clock.Step(20 * time.Millisecond)
+	select {
+	case <-getter.listings:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the background thread did not list docker")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		d.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Stop did not return while docker was hanging")
+	}
+}
+
+// newBenchmarkPods returns 100 pods with 3 containers each.
+func newBenchmarkPods() []*kubecontainer.Pod {
+	pods := make([]*kubecontainer.Pod, 100)
+	for i := range pods {
+		pods[i] = &kubecontainer.Pod{
+			ID:        types.UID(fmt.Sprintf("pod%d", i)),
+			Name:      fmt.Sprintf("pod%d", i),
+			Namespace: "default",
+		}
+		for j := 0; j < 3; j++ {
+			pods[i].Containers = append(pods[i].Containers, &kubecontainer.Container{
+				ID:    types.UID(fmt.Sprintf("container%d-%d", i, j)),
+				Name:  fmt.Sprintf("container%d", j),
+				Image: "busybox",
+			})
+		}
+	}
+	return pods
+}
+
+func BenchmarkCopyPods(b *testing.B) {
+	pods := newBenchmarkPods()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copyPods(pods)
+	}
+}
+
+// newBenchmarkDockerCache returns a cache holding the benchmark pods, which
+// never gets stale.
+func newBenchmarkDockerCache(b *testing.B) DockerCache {
+	d, err := NewDockerCache(&fakePodsGetter{pods: newBenchmarkPods()}, DockerCacheConfig{
+		SyncStalenessThreshold: time.Hour,
+		Clock:                  newFakeClock(),
+	})
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	if err := d.ForceUpdate(); err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	return d
+}
+
+// newDenseNodePods returns 200 containers in 50 pods sharing a few
+// namespaces and images, whose strings are all distinct copies as if they had
+// been decoded from docker's answer.
+func newDenseNodePods() []*kubecontainer.Pod {
+	pods := make([]*kubecontainer.Pod, 50)
+	for i := range pods {
+		pods[i] = &kubecontainer.Pod{
+			ID:        types.UID(fmt.Sprintf("pod%d", i)),
+			Name:      fmt.Sprintf("pod%d", i),
+			Namespace: fmt.Sprintf("namespace%d", i%3),
+		}
+		for j := 0; j < 4; j++ {
+			pods[i].Containers = append(pods[i].Containers, &kubecontainer.Container{
+				ID:    types.UID(fmt.Sprintf("container%d-%d", i, j)),
+				Name:  fmt.Sprintf("container%d", j),
+				Image: fmt.Sprintf("gcr.io/google_containers/image%d:latest", j),
+			})
+		}
+	}
+	return pods
+}
+
+// stringData returns the address of the bytes of s.
+func stringData(s string) uintptr {
+	return (*reflect.StringHeader)(unsafe.Pointer(&s)).Data
+}
+
+// sharedStringBytes returns the number of bytes held by the distinct copies of
+// the namespaces and images of pods.
+func sharedStringBytes(pods []*kubecontainer.Pod) int {
+	seen := make(map[uintptr]bool)
+	bytes := 0
+	add := func(s string) {
+		if !seen[stringData(s)] {
+			seen[stringData(s)] = true
+			bytes += len(s)
+		}
+	}
+	for _, pod := range pods {
+		add(pod.Namespace)
+		for _, c := range pod.Containers {
+			add(c.Image)
+		}
+	}
+	return bytes
+}
+
+func benchmarkSetPods(b *testing.B, intern bool) {
+	cache, err := NewDockerCache(&fakePodsGetter{}, DefaultDockerCacheConfig().WithInternStrings(intern))
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	d := cache.(*dockerCache)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		pods := newDenseNodePods()
+		d.lock.Lock()
+		d.pods = nil
+		b.StartTimer()
+		d.setPods(pods, time.Now(), 0)
+		d.lock.Unlock()
+	}
+	b.StopTimer()
+	b.Logf("namespaces and images of %d pods held in %d bytes", len(d.pods), sharedStringBytes(d.pods))
+}
+
+func BenchmarkSetPods(b *testing.B) {
+	benchmarkSetPods(b, false)
+}
+
+func BenchmarkSetPodsInterned(b *testing.B) {
+	benchmarkSetPods(b, true)
+}
+
+func BenchmarkGetPods(b *testing.B) {
+	d := newBenchmarkDockerCache(b)
+	defer d.Stop()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pods, _ := d.GetPods()
+		for _, pod := range pods {
+			_ = pod.ID
+		}
+	}
+}
+
+func BenchmarkRange(b *testing.B) {
+	d := newBenchmarkDockerCache(b)
+	defer d.Stop()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.Range(func(pod *kubecontainer.Pod) bool {
+			_ = pod.ID
+			return true
+		})
+	}
+}
+
+// sleepingPodsGetter is a podsGetter taking delay to answer, like a loaded
+// docker daemon.
+type sleepingPodsGetter struct {
+	fakePodsGetter
+	delay time.Duration
+}
+
+func (f *sleepingPodsGetter) GetPods(all bool) ([]*kubecontainer.Pod, error) {
+	time.Sleep(f.delay)
+	return f.fakePodsGetter.GetPods(all)
+}
+
+// BenchmarkGetPodsMaxStaleSlowDaemon measures reads happy with stale pods while
+// docker is constantly being listed and takes 20ms to answer. They used to
+// wait for the listings, as the cache stayed locked during them.
+func BenchmarkGetPodsMaxStaleSlowDaemon(b *testing.B) {
+	getter := &sleepingPodsGetter{delay: 20 * time.Millisecond}
+	getter.pods = newDenseNodePods()
+	cache, err := NewDockerCache(getter, DefaultDockerCacheConfig())
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	defer cache.Stop()
+	if _, err := cache.GetPods(); err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				cache.ForceUpdate()
+			}
+		}
+	}()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			cache.GetPodsMaxStale(time.Hour)
+		}
+	})
+}
+
+func TestFakeDockerCacheCountsCalls(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1"}}}
+	cache := NewFakeDockerCache(getter)
+
+	for i := 0; i < 2; i++ {
+		if _, err := cache.GetPods(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := cache.ForceUpdate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := cache.ForceUpdateIfOlder(time.Now()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cache.GetPodsCalls != 2 || cache.ForceUpdateCalls != 1 || cache.ForceUpdateIfOlderCalls != 1 {
+		t.Errorf("unexpected call counts: GetPods %d, ForceUpdate %d, ForceUpdateIfOlder %d",
+			cache.GetPodsCalls, cache.ForceUpdateCalls, cache.ForceUpdateIfOlderCalls)
+	}
+}
+
+func TestFakeDockerCacheSetPodsAndError(t *testing.T) {
+	cache := NewFakeDockerCache(&fakePodsGetter{})
+	expected := []*kubecontainer.Pod{{ID: "1"}, {ID: "2"}}
+	cache.SetPods(expected)
+	pods, err := cache.GetPods()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(pods, expected) {
+		t.Errorf("expected %v, got %v", expected, pods)
+	}
+
+	cacheTime := time.Unix(100, 0)
+	cache.SetCacheTime(cacheTime)
+	if got := cache.LastUpdated(); !got.Equal(cacheTime) {
+		t.Errorf("expected cache time %v, got %v", cacheTime, got)
+	}
+
+	injected := fmt.Errorf("injected")
+	cache.SetError(injected)
+	if _, err := cache.GetPods(); err != injected {
+		t.Errorf("expected %v from GetPods, got %v", injected, err)
+	}
+	if _, _, err := cache.GetPodByUID("1"); err != injected {
+		t.Errorf("expected %v from GetPodByUID, got %v", injected, err)
+	}
+	if err := cache.ForceUpdateIfOlder(time.Now()); err != injected {
+		t.Errorf("expected %v from ForceUpdateIfOlder, got %v", injected, err)
+	}
+
+	cache.SetError(nil)
+	if _, err := cache.GetPods(); err != nil {
+		t.Errorf("unexpected error after clearing: %v", err)
+	}
+}
+
+func TestFakeDockerCacheSubscriptions(t *testing.T) {
+	cache := NewFakeDockerCache(&fakePodsGetter{})
+	pods, unsubscribe := cache.Subscribe("test")
+	events, _ := cache.SubscribeEvents("test")
+
+	expected := []*kubecontainer.Pod{{ID: "1"}}
+	cache.Publish(expected)
+	if got := <-pods; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	event := PodCacheEvent{Type: PodAdded, Pod: expected[0]}
+	cache.PublishEvent(event)
+	if got := <-events; !reflect.DeepEqual(got, event) {
+		t.Errorf("expected %v, got %v", event, got)
+	}
+
+	unsubscribe()
+	if _, ok := <-pods; ok {
+		t.Errorf("expected the snapshot channel to be closed by unsubscribing")
+	}
+	cache.Publish(expected)
+
+	cache.Stop()
+	if _, ok := <-events; ok {
+		t.Errorf("expected the event channel to be closed by Stop")
+	}
+	late, _ := cache.Subscribe("late")
+	if _, ok := <-late; ok {
+		t.Errorf("expected a subscription after Stop to be closed")
+	}
+}
+
+func TestDebugGoroutineCount(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1"}}}
+	// A short idle timeout keeps the background thread stopping and
+	// restarting under the load below.
+	cache, err := NewDockerCache(getter, testDockerCacheConfig(util.RealClock{}).
+		WithSyncStalenessThreshold(20*time.Millisecond).
+		WithIdleShutdownTimeout(15*time.Millisecond))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d := cache.(*dockerCache)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if _, err := d.GetPods(); err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				time.Sleep(time.Duration((i+j)%4) * 10 * time.Millisecond)
+			}
+		}(i)
+	}
+	maxCount := make(chan int, 1)
+	go func() {
+		max := 0
+		for {
+			select {
+			case <-done:
+				maxCount <- max
+				return
+			default:
+			}
+			if count := int(atomic.LoadInt32(&d.updaterGoroutines)); count > max {
+				max = count
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	wg.Wait()
+	close(done)
+	if max := <-maxCount; max > 1 {
+		t.Errorf("expected at most one background thread, got %d", max)
+	}
+	d.Stop()
+	if count := atomic.LoadInt32(&d.updaterGoroutines); count != 0 {
+		t.Errorf("expected no background thread after Stop, got %d", count)
+	}
+	// A listing canceled by Stop returns shortly after.
+	if err := wait.Poll(time.Millisecond, time.Second, func() (bool, error) {
+		return d.DebugGoroutineCount() == 0, nil
+	}); err != nil {
+		t.Errorf("expected no goroutine left after Stop, got %d", d.DebugGoroutineCount())
+	}
+}
+
+func TestDockerCacheName(t *testing.T) {
+	getter := &fakePodsGetter{}
+	if name := newTestDockerCache(t, getter, newFakeClock()).Name(); name != defaultDockerCacheName {
+		t.Errorf("expected the default name %q, got %q", defaultDockerCacheName, name)
+	}
+	cache, err := NewDockerCache(getter, testDockerCacheConfig(newFakeClock()).WithName("secondary"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if name := cache.Name(); name != "secondary" {
+		t.Errorf("expected name %q, got %q", "secondary", name)
+	}
+}
+
+func TestSyncRefreshTimeout(t *testing.T) {
+	getter := newBlockingPodsGetter()
+	getter.pods = []*kubecontainer.Pod{{ID: "1"}}
+	clock := newFakeClock()
+	cache, err := NewDockerCache(getter, testDockerCacheConfig(clock).WithSyncRefreshTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d := cache.(*dockerCache)
+	defer d.Stop()
+
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	loaded := d.LastUpdated()
+	getter.setBlocked(true)
+	clock.Step(time.Minute)
+	pods, err := d.GetPods()
+	staleErr, ok := err.(*StaleCacheError)
+	if !ok || staleErr.Err != ErrSyncRefreshTimeout {
+		t.Fatalf("expected a *StaleCacheError for ErrSyncRefreshTimeout, got %v", err)
+	}
+	if len(pods) != 1 {
+		t.Errorf("expected the cached pods, got %v", pods)
+	}
+
+	// The stuck listing doesn't keep the cache locked.
+	readDone := make(chan struct{})
+	go func() {
+		d.Stats()
+		close(readDone)
+	}()
+	select {
+	case <-readDone:
+	case <-time.After(time.Second):
+		t.Fatalf("cache stayed locked during the listing")
+	}
+
+	// The listing is stored once docker answers.
+	getter.setBlocked(false)
+	close(getter.release)
+	err = wait.Poll(5*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return d.LastUpdated().After(loaded), nil
+	})
+	if err != nil {
+		t.Errorf("expected the late listing to refresh the cache")
+	}
+	if calls := getter.callCount(); calls != 2 {
+		t.Errorf("expected a single listing after the first load, got %d", calls-1)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1"}}}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d.Pause()
+	clock.Step(time.Minute)
+	waitForUpdaterStop(t, d)
+	calls := getter.callCount()
+
+	pods, fresh, err := d.GetPodsWithFreshness()
+	staleErr, ok := err.(*StaleCacheError)
+	if !ok || staleErr.Err != ErrCachePaused || fresh || len(pods) != 1 {
+		t.Errorf("expected the stale cached pods with ErrCachePaused, got %v, %v, %v", pods, fresh, err)
+	}
+	if pods, err := d.GetPodsMaxStale(0); !IsStaleCacheError(err) || len(pods) != 1 {
+		t.Errorf("expected the stale cached pods, got %v, %v", pods, err)
+	}
+	if _, err := d.GetAllPods(); !IsStaleCacheError(err) {
+		t.Errorf("expected a stale cache error, got %v", err)
+	}
+	getter.Lock()
+	if getter.calls != calls || getter.allCalls != 0 {
+		t.Errorf("expected no listing while paused, got %d and %d", getter.calls-calls, getter.allCalls)
+	}
+	getter.Unlock()
+	d.lock.Lock()
+	if d.updatingCache {
+		t.Errorf("expected the updating thread not to be restarted while paused")
+	}
+	d.lock.Unlock()
+
+	// Explicit refreshes still list docker.
+	if err := d.ForceUpdate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if getter.callCount() != calls+1 {
+		t.Errorf("expected ForceUpdate to list docker while paused")
+	}
+
+	clock.Step(time.Minute)
+	if err := d.Resume(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if getter.callCount() != calls+2 {
+		t.Errorf("expected Resume to refresh the cache")
+	}
+	if _, fresh, err := d.GetPodsWithFreshness(); err != nil || !fresh {
+		t.Errorf("expected fresh pods after resuming, got %v, %v", fresh, err)
+	}
+	d.lock.Lock()
+	if !d.updatingCache {
+		t.Errorf("expected Resume to restart the updating thread")
+	}
+	d.lock.Unlock()
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1"}}}
+	clock := newFakeClock()
+	cache, err := NewDockerCache(getter, testDockerCacheConfig(clock).
+		WithDisableBackgroundRefresh(true).
+		WithCircuitBreakerThreshold(2).
+		WithCircuitBreakerCooldown(10*time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d := cache.(*dockerCache)
+	defer d.Stop()
+
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	getter.Lock()
+	getter.err = fmt.Errorf("docker is down")
+	getter.Unlock()
+	for i := 0; i < 2; i++ {
+		if state := d.CacheStatus().CircuitState; state != CircuitClosed {
+			t.Errorf("expected a closed circuit after %d failures, got %s", i, state)
+		}
+		clock.Step(2 * time.Second)
+		if _, err := d.GetPods(); !IsStaleCacheError(err) {
+			t.Fatalf("expected a stale cache error, got %v", err)
+		}
+	}
+
+	// Open: docker isn't listed.
+	if state := d.CacheStatus().CircuitState; state != CircuitOpen {
+		t.Errorf("expected an open circuit, got %s", state)
+	}
+	calls := getter.callCount()
+	pods, err := d.GetPods()
+	if staleErr, ok := err.(*StaleCacheError); !ok || staleErr.Err != ErrCircuitOpen || len(pods) != 1 {
+		t.Errorf("expected the cached pods with ErrCircuitOpen, got %v, %v", pods, err)
+	}
+	if err := d.ForceUpdate(); err != ErrCircuitOpen {
+		t.Errorf("expected ErrCircuitOpen from ForceUpdate, got %v", err)
+	}
+	if getter.callCount() != calls {
+		t.Errorf("expected no listing while the circuit is open, got %d", getter.callCount()-calls)
+	}
+	if err := d.Healthy(); err == nil {
+		t.Errorf("expected an open circuit to make the cache unhealthy")
+	}
+
+	// Half-open: a failed probe opens the circuit again.
+	clock.Step(10 * time.Second)
+	if state := d.CacheStatus().CircuitState; state != CircuitHalfOpen {
+		t.Errorf("expected a half-open circuit, got %s", state)
+	}
+	if _, err := d.GetPods(); !IsStaleCacheError(err) {
+		t.Errorf("expected a stale cache error, got %v", err)
+	}
+	if getter.callCount() != calls+1 {
+		t.Errorf("expected a single probe, got %d listings", getter.callCount()-calls)
+	}
+	if state := d.CacheStatus().CircuitState; state != CircuitOpen {
+		t.Errorf("expected the failed probe to open the circuit, got %s", state)
+	}
+
+	// Half-open again: a successful probe closes the circuit.
+	clock.Step(10 * time.Second)
+	getter.Lock()
+	getter.err = nil
+	getter.Unlock()
+	if _, err := d.GetPods(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if state := d.CacheStatus().CircuitState; state != CircuitClosed {
+		t.Errorf("expected the successful probe to close the circuit, got %s", state)
+	}
+	if err := d.Healthy(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCircuitBreakerProbesWithoutReaders(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1"}}}
+	clock := newFakeClock()
+	cache, err := NewDockerCache(getter, testDockerCacheConfig(clock).
+		WithCircuitBreakerThreshold(1).
+		WithCircuitBreakerCooldown(5*time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d := cache.(*dockerCache)
+	defer d.Stop()
+
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	getter.Lock()
+	getter.err = fmt.Errorf("docker is down")
+	getter.Unlock()
+	clock.Step(2 * time.Second)
+	d.GetPods()
+	if state := d.CacheStatus().CircuitState; state != CircuitOpen {
+		t.Fatalf("expected an open circuit, got %s", state)
+	}
+
+	// Nobody reads the cache anymore: the updater outlives its idle timeout
+	// while the circuit is open.
+	clock.Step(3 * time.Second)
+	time.Sleep(100 * time.Millisecond)
+	d.lock.Lock()
+	updating := d.updatingCache
+	d.lock.Unlock()
+	if !updating {
+		t.Fatalf("expected the updater to keep running while the circuit is open")
+	}
+	calls := getter.callCount()
+	getter.Lock()
+	getter.err = nil
+	getter.Unlock()
+
+	// Once the cooldown expired, it probes docker and closes the circuit.
+	clock.Step(3 * time.Second)
+	err = wait.Poll(5*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return d.CacheStatus().CircuitState == CircuitClosed, nil
+	})
+	if err != nil {
+		t.Fatalf("expected the probe to close the circuit, got %s", d.CacheStatus().CircuitState)
+	}
+	if getter.callCount() <= calls {
+		t.Errorf("expected docker to be probed")
+	}
+	// The updater then stops, idle.
+	waitForUpdaterStop(t, d)
+}
+
+func TestEvictPod(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{
+		{ID: "1", Containers: []*kubecontainer.Container{{ID: "a"}}},
+		{ID: "2", Containers: []*kubecontainer.Container{{ID: "b"}}},
+	}}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := d.GetAllPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	events, cancel := d.SubscribeEvents("test")
+	defer cancel()
+	d.EvictPod("1")
+	d.EvictPod("unknown")
+
+	if _, found, _ := d.GetPodByUID("1"); found {
+		t.Errorf("expected pod 1 to be evicted")
+	}
+	if _, _, found, _ := d.GetContainerByID("a"); found {
+		t.Errorf("expected the containers of pod 1 to be evicted")
+	}
+	if _, found, _ := d.GetPodStatus("1"); found {
+		t.Errorf("expected the status of pod 1 to be evicted")
+	}
+	if count, _ := d.GetPodCount(); count != 1 {
+		t.Errorf("expected a single pod left, got %d", count)
+	}
+	if event := <-events; event.Type != PodRemoved || event.Pod.ID != "1" {
+		t.Errorf("expected the removal of pod 1, got %v", event)
+	}
+	if getter.callCount() != 1 {
+		t.Errorf("expected no listing, got %d", getter.callCount()-1)
+	}
+
+	// Docker still lists the pod: the next refresh adds it back.
+	clock.Step(2 * time.Second)
+	if _, found, err := d.GetPodByUID("1"); err != nil || !found {
+		t.Errorf("expected pod 1 to be added back, got %v (error %v)", found, err)
+	}
+}
+
+func TestFirstRead(t *testing.T) {
+	newCache := func(getter podsGetter, warm, nonBlocking bool) *dockerCache {
+		cache, err := NewDockerCache(getter, testDockerCacheConfig(newFakeClock()).
+			WithWarmOnStart(warm).
+			WithNonBlockingFirstRead(nonBlocking))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return cache.(*dockerCache)
+	}
+	waitForLoad := func(d *dockerCache) {
+		err := wait.Poll(5*time.Millisecond, 5*time.Second, func() (bool, error) {
+			return !d.LastUpdated().IsZero(), nil
+		})
+		if err != nil {
+			t.Fatalf("cache was not loaded: %v", err)
+		}
+	}
+
+	// Lazy and blocking: the first read lists docker.
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1"}}}
+	d := newCache(getter, false, false)
+	if getter.callCount() != 0 {
+		t.Errorf("expected no listing before the first read")
+	}
+	if pods, err := d.GetPods(); err != nil || len(pods) != 1 {
+		t.Errorf("expected pod 1, got %v (error %v)", pods, err)
+	}
+	d.Stop()
+
+	// Eager and blocking: the cache loads without any read.
+	getter = &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1"}}}
+	d = newCache(getter, true, false)
+	waitForLoad(d)
+	if pods, err := d.GetPods(); err != nil || len(pods) != 1 {
+		t.Errorf("expected pod 1, got %v (error %v)", pods, err)
+	}
+	if getter.callCount() != 1 {
+		t.Errorf("expected a single listing, got %d", getter.callCount())
+	}
+	d.Stop()
+
+	// Lazy and non-blocking: the first read starts loading the cache.
+	blocking := newBlockingPodsGetter()
+	blocking.pods = []*kubecontainer.Pod{{ID: "1"}}
+	blocking.setBlocked(true)
+	d = newCache(blocking, false, true)
+	if pods, err := d.GetPods(); !IsCacheWarming(err) || len(pods) != 0 {
+		t.Errorf("expected no pods while warming, got %v (error %v)", pods, err)
+	}
+	<-blocking.listings
+	blocking.setBlocked(false)
+	close(blocking.release)
+	waitForLoad(d)
+	if pods, err := d.GetPods(); err != nil || len(pods) != 1 {
+		t.Errorf("expected pod 1, got %v (error %v)", pods, err)
+	}
+	d.Stop()
+
+	// Eager and non-blocking: the first read doesn't wait for the listing
+	// started with the cache.
+	blocking = newBlockingPodsGetter()
+	blocking.pods = []*kubecontainer.Pod{{ID: "1"}}
+	blocking.setBlocked(true)
+	d = newCache(blocking, true, true)
+	<-blocking.listings
+	if pods, err := d.GetPods(); !IsCacheWarming(err) || len(pods) != 0 {
+		t.Errorf("expected no pods while warming, got %v (error %v)", pods, err)
+	}
+	blocking.setBlocked(false)
+	close(blocking.release)
+	waitForLoad(d)
+	if pods, err := d.GetPods(); err != nil || len(pods) != 1 {
+		t.Errorf("expected pod 1, got %v (error %v)", pods, err)
+	}
+	if blocking.callCount() != 1 {
+		t.Errorf("expected a single listing, got %d", blocking.callCount())
+	}
+	d.Stop()
+}
+
+func TestRecentErrors(t *testing.T) {
+	getter := &fakePodsGetter{}
+	clock := newFakeClock()
+	cache, err := NewDockerCache(getter, testDockerCacheConfig(clock).
+		WithDisableBackgroundRefresh(true).
+		WithUnhealthyThreshold(10*time.Second).
+		WithRecentErrorsSize(3))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer cache.Stop()
+
+	if errs := cache.RecentErrors(); len(errs) != 0 {
+		t.Errorf("expected no errors, got %v", errs)
+	}
+	var times []time.Time
+	for i := 0; i < 5; i++ {
+		getter.Lock()
+		getter.err = fmt.Errorf("error %d", i)
+		getter.Unlock()
+		clock.Step(time.Second)
+		times = append(times, clock.Now())
+		cache.ForceUpdate()
+	}
+	errs := cache.RecentErrors()
+	if len(errs) != 3 {
+		t.Fatalf("expected the 3 most recent errors, got %v", errs)
+	}
+	for i, err := range errs {
+		if !err.Time.Equal(times[i+2]) || !strings.Contains(err.Err.Error(), fmt.Sprintf("error %d", i+2)) {
+			t.Errorf("expected error %d at %v, got %v at %v", i+2, times[i+2], err.Err, err.Time)
+		}
+	}
+	// The reader gets a copy.
+	errs[0].Err = nil
+	if cache.RecentErrors()[0].Err == nil {
+		t.Errorf("expected RecentErrors to return a copy")
+	}
+
+	// A success right after the failures keeps them.
+	getter.Lock()
+	getter.err = nil
+	getter.Unlock()
+	if err := cache.ForceUpdate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if errs := cache.RecentErrors(); len(errs) != 3 {
+		t.Errorf("expected the errors to be kept, got %v", errs)
+	}
+	// Sustained success clears them.
+	clock.Step(11 * time.Second)
+	if err := cache.ForceUpdate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if errs := cache.RecentErrors(); len(errs) != 0 {
+		t.Errorf("expected the errors to be cleared, got %v", errs)
+	}
+}
+
+func TestOnRefresh(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1"}}}
+	clock := newFakeClock()
+	cache, err := NewDockerCache(getter, testDockerCacheConfig(clock).WithDisableBackgroundRefresh(true))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d := cache.(*dockerCache)
+	defer d.Stop()
+
+	// The hooks may run after ForceUpdate returned.
+	var lock sync.Mutex
+	var calls []string
+	var seen []types.UID
+	var seenAsOf time.Time
+	addCall := func(call string) {
+		lock.Lock()
+		defer lock.Unlock()
+		calls = append(calls, call)
+	}
+	waitForCalls := func(expected []string) {
+		err := wait.Poll(time.Millisecond, time.Second, func() (bool, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			return len(calls) >= len(expected), nil
+		})
+		lock.Lock()
+		defer lock.Unlock()
+		if err != nil || !reflect.DeepEqual(calls, expected) {
+			t.Errorf("expected the hooks %v to be called, got %v", expected, calls)
+		}
+		calls = nil
+	}
+	d.OnRefresh(func(pods []*kubecontainer.Pod, asOf time.Time) {
+		addCall("panicking")
+		panic("broken hook")
+	})
+	unregister := d.OnRefresh(func(pods []*kubecontainer.Pod, asOf time.Time) {
+		lock.Lock()
+		seen = nil
+		for _, pod := range pods {
+			seen = append(seen, pod.ID)
+		}
+		seenAsOf = asOf
+		lock.Unlock()
+		addCall("first")
+	})
+	d.OnRefresh(func(pods []*kubecontainer.Pod, asOf time.Time) {
+		addCall("second")
+	})
+
+	if err := d.ForceUpdate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitForCalls([]string{"panicking", "first", "second"})
+	lock.Lock()
+	if !reflect.DeepEqual(seen, []types.UID{"1"}) || !seenAsOf.Equal(clock.Now()) {
+		t.Errorf("expected pod 1 listed at %v, got %v at %v", clock.Now(), seen, seenAsOf)
+	}
+	lock.Unlock()
+
+	// Unchanged pods don't call the hooks.
+	clock.Step(2 * time.Second)
+	if err := d.ForceUpdate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitForCalls(nil)
+
+	unregister()
+	unregister()
+	getter.Lock()
+	getter.pods = append(getter.pods, &kubecontainer.Pod{ID: "2"})
+	getter.Unlock()
+	if err := d.ForceUpdate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitForCalls([]string{"panicking", "second"})
+	if pods, err := d.GetPods(); err != nil || len(pods) != 2 {
+		t.Errorf("expected the refresh to survive the panicking hook, got %d pods (error %v)", len(pods), err)
+	}
+}
+
+func TestStopDuringRefresh(t *testing.T) {
+	getter := newBlockingPodsGetter()
+	getter.pods = []*kubecontainer.Pod{{ID: "1"}}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Let the background thread list the new pods, and stop the cache
+	// while docker doesn't answer.
+	getter.Lock()
+	getter.pods = []*kubecontainer.Pod{{ID: "2"}}
+	getter.Unlock()
+	getter.setBlocked(true)
+	clock.Step(time.Second)
+	<-getter.listings
+	stopped := make(chan struct{})
+	go func() {
+		d.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected Stop not to wait for the listing in flight")
+	}
+	if count := d.DebugGoroutineCount(); count != 1 {
+		t.Errorf("expected only the listing in flight to be left, got %d goroutines", count)
+	}
+
+	close(getter.release)
+	if err := wait.Poll(time.Millisecond, time.Second, func() (bool, error) {
+		return d.DebugGoroutineCount() == 0, nil
+	}); err != nil {
+		t.Errorf("expected the listing to return once docker answered, got %d goroutines", d.DebugGoroutineCount())
+	}
+	if err := wait.Poll(time.Millisecond, 50*time.Millisecond, func() (bool, error) {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		return d.pods[0].ID != "1", nil
+	}); err == nil {
+		t.Errorf("expected the pods listed after Stop to be dropped")
+	}
+	if _, err := d.GetPods(); err != ErrCacheStopped {
+		t.Errorf("expected %v, got %v", ErrCacheStopped, err)
+	}
+}
+
+func TestStopTimeout(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1"}}}
+	clock := newFakeClock()
+	blocked := make(chan struct{})
+	defer close(blocked)
+	cache, err := NewDockerCache(getter, testDockerCacheConfig(clock).
+		WithStopTimeout(10*time.Millisecond).
+		WithOnError(func(err error) { <-blocked }))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d := cache.(*dockerCache)
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The background thread blocks in OnError after its refresh fails.
+	getter.Lock()
+	getter.err = fmt.Errorf("docker is down")
+	getter.Unlock()
+	clock.Step(time.Second)
+	if err := wait.Poll(time.Millisecond, 5*time.Second, func() (bool, error) {
+		return len(d.RecentErrors()) > 0, nil
+	}); err != nil {
+		t.Fatalf("expected the background refresh to fail")
+	}
+	stopped := make(chan struct{})
+	go func() {
+		d.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected Stop to return after its timeout")
+	}
+}
+
+func TestReadOnlyView(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1"}}}
+	clock := newFakeClock()
+	// A background refresh would make the pods fresh again.
+	cache, err := NewDockerCache(getter, testDockerCacheConfig(clock).WithDisableBackgroundRefresh(true))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d := cache.(*dockerCache)
+	view := d.ReadOnlyView()
+
+	// The view doesn't load the cache.
+	if pods, err := view.GetPods(); err != nil || len(pods) != 0 {
+		t.Errorf("expected no pods, got %v (error %v)", pods, err)
+	}
+	if updated := view.LastUpdated(); !updated.IsZero() {
+		t.Errorf("expected the pods never to have been listed, got %v", updated)
+	}
+	if getter.callCount() != 0 {
+		t.Errorf("expected no listing, got %d", getter.callCount())
+	}
+
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	clock.Step(time.Minute)
+	pods, err := view.GetPods()
+	if err != nil || len(pods) != 1 || pods[0].ID != "1" {
+		t.Errorf("expected the stale pod 1, got %v (error %v)", pods, err)
+	}
+	if updated := view.LastUpdated(); !updated.Equal(clock.Now().Add(-time.Minute)) {
+		t.Errorf("expected the pods to be a minute old, got %v", updated)
+	}
+	d.lock.Lock()
+	if !d.idle() {
+		t.Errorf("expected the view not to keep the background thread running")
+	}
+	d.lock.Unlock()
+
+	d.Stop()
+	if _, err := view.GetPods(); err != ErrCacheStopped {
+		t.Errorf("expected %v, got %v", ErrCacheStopped, err)
+	}
+}
+
+func TestDeltaReader(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{
+		{ID: "1", Containers: []*kubecontainer.Container{{ID: "a"}}},
+		{ID: "2", Containers: []*kubecontainer.Container{{ID: "b"}}},
+	}}
+	clock := newFakeClock()
+	cache, err := NewDockerCache(getter, testDockerCacheConfig(clock).WithDisableBackgroundRefresh(true))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d := cache.(*dockerCache)
+	defer d.Stop()
+	setPods := func(pods ...*kubecontainer.Pod) {
+		getter.Lock()
+		getter.pods = pods
+		getter.Unlock()
+		clock.Step(2 * time.Second)
+	}
+	ids := func(pods []*kubecontainer.Pod) []types.UID {
+		var ids []types.UID
+		for _, pod := range pods {
+			ids = append(ids, pod.ID)
+		}
+		return ids
+	}
+	expectChanged := func(reader *DeltaReader, added, removed, modified []types.UID) {
+		a, r, m, err := reader.Changed()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(ids(a), added) || !reflect.DeepEqual(ids(r), removed) || !reflect.DeepEqual(ids(m), modified) {
+			t.Errorf("expected %v added, %v removed and %v modified, got %v, %v and %v", added, removed, modified, ids(a), ids(r), ids(m))
+		}
+	}
+
+	first := d.NewDeltaReader()
+	expectChanged(first, []types.UID{"1", "2"}, nil, nil)
+	expectChanged(first, nil, nil, nil)
+
+	setPods(
+		&kubecontainer.Pod{ID: "1", Containers: []*kubecontainer.Container{{ID: "a"}, {ID: "c"}}},
+		&kubecontainer.Pod{ID: "3", Containers: []*kubecontainer.Container{{ID: "d"}}},
+	)
+	second := d.NewDeltaReader()
+	expectChanged(first, []types.UID{"3"}, []types.UID{"2"}, []types.UID{"1"})
+
+	// The second reader only starts at the current pods.
+	expectChanged(second, []types.UID{"1", "3"}, nil, nil)
+
+	setPods(&kubecontainer.Pod{ID: "3", Containers: []*kubecontainer.Container{{ID: "d"}}})
+	expectChanged(second, nil, []types.UID{"1"}, nil)
+	setPods(
+		&kubecontainer.Pod{ID: "3", Containers: []*kubecontainer.Container{{ID: "d"}}},
+		&kubecontainer.Pod{ID: "4"},
+	)
+	expectChanged(second, []types.UID{"4"}, nil, nil)
+
+	// The first reader sees the changes it missed at once.
+	_, removed, _, err := first.Changed()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(removed) != 1 || len(removed[0].Containers) != 2 {
+		t.Errorf("expected pod 1 as last seen, got %v", removed)
+	}
+
+	// The stale pods served while docker fails are unchanged.
+	getter.Lock()
+	getter.err = fmt.Errorf("docker is down")
+	getter.Unlock()
+	clock.Step(2 * time.Second)
+	if added, removed, modified, err := second.Changed(); err == nil || len(added)+len(removed)+len(modified) != 0 {
+		t.Errorf("expected no changes and an error, got %v, %v and %v (error %v)", added, removed, modified, err)
+	}
+	getter.Lock()
+	getter.err = nil
+	getter.Unlock()
+	setPods(&kubecontainer.Pod{ID: "4"})
+	expectChanged(second, nil, []types.UID{"3"}, nil)
+}
+
+func TestDeltaReaderUsesChangeDetection(t *testing.T) {
+	running := &kubecontainer.Pod{ID: "1", Containers: []*kubecontainer.Container{{ID: "a", State: kubecontainer.ContainerStateRunning}}}
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{running}}
+	clock := newFakeClock()
+	config := testDockerCacheConfig(clock).WithDisableBackgroundRefresh(true).WithChangeDetection(ChangeDetectContainerIDs)
+	cache, err := NewDockerCache(getter, config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer cache.Stop()
+	setPods := func(pods ...*kubecontainer.Pod) {
+		getter.Lock()
+		getter.pods = pods
+		getter.Unlock()
+		clock.Step(2 * time.Second)
+		if _, err := cache.GetPods(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	reader := cache.NewDeltaReader()
+	if added, _, _, err := reader.Changed(); err != nil || len(added) != 1 {
+		t.Fatalf("expected pod 1 to be added, got %v (error %v)", added, err)
+	}
+	// The pod comes back with the container the reader saw, in another state,
+	// which the cache doesn't count as a change.
+	setPods(&kubecontainer.Pod{ID: "1", Containers: []*kubecontainer.Container{{ID: "a", State: kubecontainer.ContainerStateRunning}, {ID: "b"}}})
+	setPods(&kubecontainer.Pod{ID: "1", Containers: []*kubecontainer.Container{{ID: "a", State: kubecontainer.ContainerStateExited}}})
+	if added, removed, modified, err := reader.Changed(); err != nil || len(added)+len(removed)+len(modified) != 0 {
+		t.Errorf("expected no changes, got %v, %v and %v (error %v)", added, removed, modified, err)
+	}
+}
+
+func TestMissedPods(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1"}}}
+	clock := newFakeClock()
+	d := newTestDockerCache(t, getter, clock)
+	defer d.Stop()
+
+	for i := 0; i < missWarningThreshold+1; i++ {
+		if _, found, err := d.GetPodByUID("deleted"); err != nil || found {
+			t.Fatalf("expected the deleted pod not to be found, got %v (error %v)", found, err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if found, err := d.Contains("other"); err != nil || found {
+			t.Fatalf("expected the other pod not to be found, got %v (error %v)", found, err)
+		}
+	}
+	if found, err := d.Contains("1"); err != nil || !found {
+		t.Fatalf("expected pod 1 to be found, got %v (error %v)", found, err)
+	}
+	expected := []MissedPod{
+		{UID: "deleted", Misses: missWarningThreshold + 1, LastMiss: clock.Now()},
+		{UID: "other", Misses: 3, LastMiss: clock.Now()},
+	}
+	if missed := d.DebugTopMissedPods(5); !reflect.DeepEqual(missed, expected) {
+		t.Errorf("expected %+v, got %+v", expected, missed)
+	}
+	if missed := d.DebugTopMissedPods(1); !reflect.DeepEqual(missed, expected[:1]) {
+		t.Errorf("expected %+v, got %+v", expected[:1], missed)
+	}
+	d.lock.Lock()
+	if d.misses.byUID["deleted"].lastWarning.IsZero() || !d.misses.byUID["other"].lastWarning.IsZero() {
+		t.Errorf("expected a warning about the deleted pod only")
+	}
+	d.lock.Unlock()
+
+	// A flood of distinct missing pods only keeps the most recent ones.
+	for i := 0; i < 2*maxTrackedMisses; i++ {
+		if _, err := d.Contains(types.UID(fmt.Sprintf("missing-%d", i))); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	d.lock.Lock()
+	tracked := len(d.misses.byUID)
+	d.lock.Unlock()
+	if tracked != maxTrackedMisses {
+		t.Errorf("expected %d missed pods to be tracked, got %d", maxTrackedMisses, tracked)
+	}
+	if missed := d.DebugTopMissedPods(1); len(missed) != 1 || missed[0].UID == "deleted" {
+		t.Errorf("expected the deleted pod to be forgotten, got %+v", missed)
+	}
+}
+
+func TestFileSnapshotStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker_cache_snapshot")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFileSnapshotStore(filepath.Join(dir, "snapshot.json"))
+
+	if pods, asOf, err := store.Load(); err != nil || pods != nil || !asOf.IsZero() {
+		t.Errorf("expected no snapshot, got %v at %v (error %v)", pods, asOf, err)
+	}
+	pods := []*kubecontainer.Pod{
+		{ID: "1", Name: "foo", Namespace: "ns", Labels: map[string]string{"app": "foo"}, Containers: []*kubecontainer.Container{
+			{ID: "a", Name: "bar", Image: "busybox", Hash: 42, Created: 10, State: kubecontainer.ContainerStateRunning},
+		}},
+		{ID: "2"},
+	}
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	store.Save(pods, now)
+	store.Save(pods[:1], now.Add(time.Second))
+	loaded, asOf, err := store.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, pods[:1]) || !asOf.Equal(now.Add(time.Second)) {
+		t.Errorf("expected %+v at %v, got %+v at %v", pods[:1], now.Add(time.Second), loaded, asOf)
+	}
+	if files, err := ioutil.ReadDir(dir); err != nil || len(files) != 1 {
+		t.Errorf("expected the snapshot file only, got %v (error %v)", files, err)
+	}
+}
+
+func TestSnapshotStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker_cache_snapshot")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFileSnapshotStore(filepath.Join(dir, "snapshot.json"))
+	clock := newFakeClock()
+	newCache := func(getter podsGetter) *dockerCache {
+		cache, err := NewDockerCache(getter, testDockerCacheConfig(clock).
+			WithDisableBackgroundRefresh(true).
+			WithSnapshotStore(store).
+			WithSnapshotMaxAge(time.Minute))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return cache.(*dockerCache)
+	}
+
+	// Stop saves the cached pods.
+	d := newCache(&fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1"}}})
+	if _, err := d.GetPods(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	listedAt := clock.Now()
+	d.Stop()
+
+	// The next cache starts with them.
+	clock.Step(500 * time.Millisecond)
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "2"}}}
+	d = newCache(getter)
+	pods, asOf, err := d.GetPodsSnapshot()
+	if err != nil || len(pods) != 1 || pods[0].ID != "1" || !asOf.Equal(listedAt) {
+		t.Errorf("expected pod 1 listed at %v, got %v at %v (error %v)", listedAt, pods, asOf, err)
+	}
+	if getter.callCount() != 0 {
+		t.Errorf("expected docker not to be listed, got %d listings", getter.callCount())
+	}
+	// Stale pods are refreshed as usual.
+	clock.Step(time.Second)
+	if pods, err := d.GetPods(); err != nil || len(pods) != 1 || pods[0].ID != "2" {
+		t.Errorf("expected pod 2, got %v (error %v)", pods, err)
+	}
+	d.Stop()
+
+	// A snapshot older than the max age is discarded.
+	clock.Step(2 * time.Minute)
+	d = newCache(getter)
+	defer d.Stop()
+	if updated := d.LastUpdated(); !updated.IsZero() {
+		t.Errorf("expected the stale snapshot to be discarded, got pods listed at %v", updated)
+	}
+
+	// Loading a snapshot doesn't tell whether docker answers again.
+	failing, err := NewDockerCache(&fakePodsGetter{err: fmt.Errorf("docker is down")}, testDockerCacheConfig(clock).
+		WithDisableBackgroundRefresh(true).
+		WithCircuitBreakerThreshold(1).
+		WithSnapshotStore(store))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer failing.Stop()
+	if err := failing.ForceUpdate(); err == nil {
+		t.Fatalf("expected an error")
+	}
+	store.Save([]*kubecontainer.Pod{{ID: "3"}}, clock.Now())
+	f := failing.(*dockerCache)
+	f.lock.Lock()
+	f.loadSnapshot()
+	f.lock.Unlock()
+	status := f.CacheStatus()
+	if status.ConsecutiveFailures != 1 || status.CircuitState != CircuitOpen || status.LastError == nil {
+		t.Errorf("expected the failure to be kept, got %+v", status)
+	}
+	if updated := f.LastUpdated(); !updated.Equal(clock.Now()) {
+		t.Errorf("expected the snapshot listed at %v to be loaded, got pods listed at %v", clock.Now(), updated)
+	}
+}
+
+func TestGetPodsStrict(t *testing.T) {
+	newCache := func(getter podsGetter, nonBlocking bool) *dockerCache {
+		cache, err := NewDockerCache(getter, testDockerCacheConfig(newFakeClock()).
+			WithDisableBackgroundRefresh(true).
+			WithNonBlockingFirstRead(nonBlocking))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return cache.(*dockerCache)
+	}
+	tests := []struct {
+		name        string
+		getter      *fakePodsGetter
+		nonBlocking bool
+		expected    int
+		expectedErr error
+	}{
+		{"uninitialized", &fakePodsGetter{err: fmt.Errorf("docker is down")}, false, 0, ErrCacheUninitialized},
+		{"uninitialized without blocking", &fakePodsGetter{err: fmt.Errorf("docker is down")}, true, 0, ErrCacheUninitialized},
+		{"empty", &fakePodsGetter{}, false, 0, nil},
+		{"empty without blocking", &fakePodsGetter{}, true, 0, nil},
+		{"populated", &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1"}, {ID: "2"}}}, false, 2, nil},
+	}
+	for _, test := range tests {
+		d := newCache(test.getter, test.nonBlocking)
+		pods, err := d.GetPodsStrict()
+		if err != test.expectedErr || len(pods) != test.expected {
+			t.Errorf("%s: expected %d pods (error %v), got %v (error %v)", test.name, test.expected, test.expectedErr, pods, err)
+		}
+		if test.getter.callCount() != 1 {
+			t.Errorf("%s: expected a single listing, got %d", test.name, test.getter.callCount())
+		}
+		d.Stop()
+		if _, err := d.GetPodsStrict(); err != ErrCacheStopped {
+			t.Errorf("%s: expected %v once stopped, got %v", test.name, ErrCacheStopped, err)
+		}
+	}
+}
+
+func TestGetRestartCount(t *testing.T) {
+	pod := func(uid types.UID, ids ...types.UID) *kubecontainer.Pod {
+		pod := &kubecontainer.Pod{ID: uid}
+		for i, id := range ids {
+			pod.Containers = append(pod.Containers, &kubecontainer.Container{ID: id, Name: fmt.Sprintf("c%d", i)})
+		}
+		return pod
+	}
+	getter := &fakePodsGetter{}
+	clock := newFakeClock()
+	cache, err := NewDockerCache(getter, testDockerCacheConfig(clock).WithDisableBackgroundRefresh(true))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d := cache.(*dockerCache)
+	defer d.Stop()
+
+	steps := []struct {
+		pods     []*kubecontainer.Pod
+		expected map[string]int
+	}{
+		{[]*kubecontainer.Pod{pod("1", "a", "b")}, map[string]int{"c0": 0, "c1": 0}},
+		// Listing the same containers again isn't a restart.
+		{[]*kubecontainer.Pod{pod("1", "a", "b")}, map[string]int{"c0": 0, "c1": 0}},
+		{[]*kubecontainer.Pod{pod("1", "a", "c")}, map[string]int{"c0": 0, "c1": 1}},
+		{[]*kubecontainer.Pod{pod("1", "d", "e")}, map[string]int{"c0": 1, "c1": 2}},
+		// A container which is down isn't reported, but its count is kept.
+		{[]*kubecontainer.Pod{pod("1", "d")}, map[string]int{"c0": 1}},
+		{[]*kubecontainer.Pod{pod("1", "d", "f")}, map[string]int{"c0": 1, "c1": 3}},
+		// The counts are forgotten once the pod leaves the cache.
+		{nil, nil},
+		{[]*kubecontainer.Pod{pod("1", "g", "h")}, map[string]int{"c0": 0, "c1": 0}},
+	}
+	for i, step := range steps {
+		getter.Lock()
+		getter.pods = step.pods
+		getter.Unlock()
+		clock.Step(2 * time.Second)
+		for _, name := range []string{"c0", "c1"} {
+			count, found, err := d.GetRestartCount("1", name)
+			expected, expectedFound := step.expected[name]
+			if err != nil || found != expectedFound || count != expected {
+				t.Errorf("step %d: expected %d restarts of %s (found %v), got %d (found %v, error %v)", i, expected, name, expectedFound, count, found, err)
+			}
+		}
+	}
+	if _, found, err := d.GetRestartCount("9999", "c0"); found || err != nil {
+		t.Errorf("expected pod 9999 not to be found without error, got %v, %v", found, err)
+	}
+}
+
+func TestGetRestartCountAtPodSetChangeDetection(t *testing.T) {
+	getter := &fakePodsGetter{}
+	clock := newFakeClock()
+	config := testDockerCacheConfig(clock).WithDisableBackgroundRefresh(true).WithChangeDetection(ChangeDetectPodSet)
+	cache, err := NewDockerCache(getter, config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer cache.Stop()
+
+	// The cache keeps the pods it has, but still sees the containers
+	// replaced.
+	for i, id := range []types.UID{"a", "b", "c"} {
+		getter.Lock()
+		getter.pods = []*kubecontainer.Pod{{ID: "1", Containers: []*kubecontainer.Container{{ID: id, Name: "c0"}}}}
+		getter.Unlock()
+		clock.Step(2 * time.Second)
+		if count, found, err := cache.GetRestartCount("1", "c0"); err != nil || !found || count != i {
+			t.Errorf("expected %d restarts, got %d (found %v, error %v)", i, count, found, err)
+		}
+	}
+}
+
+func TestChangeDetection(t *testing.T) {
+	running := &kubecontainer.Pod{ID: "1", Containers: []*kubecontainer.Container{{ID: "a", State: kubecontainer.ContainerStateRunning}}}
+	exited := &kubecontainer.Pod{ID: "1", Containers: []*kubecontainer.Container{{ID: "a", State: kubecontainer.ContainerStateExited}}}
+	restarted := &kubecontainer.Pod{ID: "1", Containers: []*kubecontainer.Container{{ID: "b", State: kubecontainer.ContainerStateRunning}}}
+	tests := []struct {
+		name    string
+		after   []*kubecontainer.Pod
+		changed map[ChangeDetection]bool
+	}{
+		{"unchanged", []*kubecontainer.Pod{running}, map[ChangeDetection]bool{}},
+		{"container exited", []*kubecontainer.Pod{exited}, map[ChangeDetection]bool{
+			ChangeDetectContainerState: true,
+		}},
+		{"container restarted", []*kubecontainer.Pod{restarted}, map[ChangeDetection]bool{
+			ChangeDetectContainerIDs:   true,
+			ChangeDetectContainerState: true,
+		}},
+		{"pod added", []*kubecontainer.Pod{running, {ID: "2"}}, map[ChangeDetection]bool{
+			ChangeDetectPodSet:         true,
+			ChangeDetectContainerIDs:   true,
+			ChangeDetectContainerState: true,
+		}},
+		{"pod removed", nil, map[ChangeDetection]bool{
+			ChangeDetectPodSet:         true,
+			ChangeDetectContainerIDs:   true,
+			ChangeDetectContainerState: true,
+		}},
+	}
+	for _, level := range []ChangeDetection{"", ChangeDetectPodSet, ChangeDetectContainerIDs, ChangeDetectContainerState} {
+		for _, test := range tests {
+			getter := &fakePodsGetter{pods: []*kubecontainer.Pod{running}}
+			clock := newFakeClock()
+			cache, err := NewDockerCache(getter, testDockerCacheConfig(clock).
+				WithDisableBackgroundRefresh(true).
+				WithChangeDetection(level))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			d := cache.(*dockerCache)
+			if err := d.ForceUpdate(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			ch, cancel := d.Subscribe("test")
+			events, cancelEvents := d.SubscribeEvents("test")
+			getter.Lock()
+			getter.pods = test.after
+			getter.Unlock()
+			clock.Step(time.Second)
+			if err := d.ForceUpdate(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			expected := test.changed[level]
+			if level == "" {
+				expected = test.changed[ChangeDetectContainerState]
+			}
+			var changed bool
+			select {
+			case <-ch:
+				changed = true
+			default:
+			}
+			var eventCount int
+			for done := false; !done; {
+				select {
+				case <-events:
+					eventCount++
+				default:
+					done = true
+				}
+			}
+			if changed != expected || (eventCount > 0) != expected {
+				t.Errorf("%q, %s: expected a change %v, got a snapshot %v and %d events", level, test.name, expected, changed, eventCount)
+			}
+			// Either way, the cached pods are as recent as the refresh.
+			if d.LastUpdated() != clock.Now() {
+				t.Errorf("%q, %s: expected the cache time to be bumped to %v, got %v", level, test.name, clock.Now(), d.LastUpdated())
+			}
+			cancel()
+			cancelEvents()
+			d.Stop()
+		}
+	}
+
+	if _, err := NewDockerCache(&fakePodsGetter{}, DockerCacheConfig{ChangeDetection: "containers"}); err == nil {
+		t.Errorf("expected an unknown change detection to be rejected")
+	}
+}
+
+func TestGetPodSandbox(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{
+		{ID: "1", Containers: []*kubecontainer.Container{
+			{ID: "a", Name: "foo"},
+			{ID: "b", Name: PodInfraContainerName},
+			{ID: "c", Name: "bar"},
+		}},
+		// The infra container of pod 2 is down.
+		{ID: "2", Containers: []*kubecontainer.Container{{ID: "d", Name: "foo"}}},
+		{ID: "3", Containers: []*kubecontainer.Container{{ID: "e", Name: PodInfraContainerName}}},
+	}}
+	d := newTestDockerCache(t, getter, newFakeClock())
+	defer d.Stop()
+
+	tests := []struct {
+		uid         types.UID
+		sandbox     types.UID
+		apps        []types.UID
+		podNotFound bool
+	}{
+		{uid: "1", sandbox: "b", apps: []types.UID{"a", "c"}},
+		{uid: "2", apps: []types.UID{"d"}},
+		{uid: "3", sandbox: "e"},
+		{uid: "9999", podNotFound: true},
+	}
+	for _, test := range tests {
+		sandbox, found, err := d.GetPodSandbox(test.uid)
+		if err != nil || found != (test.sandbox != "") {
+			t.Errorf("pod %s: expected a sandbox found %v, got %v (error %v)", test.uid, test.sandbox != "", found, err)
+		} else if found && sandbox.ID != test.sandbox {
+			t.Errorf("pod %s: expected sandbox %s, got %+v", test.uid, test.sandbox, sandbox)
+		}
+		apps, found, err := d.AppContainers(test.uid)
+		if err != nil || found == test.podNotFound {
+			t.Errorf("pod %s: expected the pod found %v, got %v (error %v)", test.uid, !test.podNotFound, found, err)
+		}
+		var ids []types.UID
+		for _, c := range apps {
+			ids = append(ids, c.ID)
+		}
+		if !reflect.DeepEqual(ids, test.apps) {
+			t.Errorf("pod %s: expected app containers %v, got %v", test.uid, test.apps, ids)
+		}
+	}
+	// The containers are copies.
+	sandbox, _, _ := d.GetPodSandbox("1")
+	sandbox.Name = "foo"
+	if sandbox, found, _ := d.GetPodSandbox("1"); !found || sandbox.ID != "b" {
+		t.Errorf("modifying the returned sandbox changed the cache: %+v", sandbox)
+	}
+}
+
+// recordingObserver records the notifications it gets, embedding
+// NoopCacheObserver to ignore the refresh starts.
+type recordingObserver struct {
+	NoopCacheObserver
+	cache DockerCache
+
+	sync.Mutex
+	calls []string
+}
+
+func (o *recordingObserver) record(call string) {
+	// The observers may use the cache, which isn't locked.
+	o.cache.LastUpdated()
+	o.Lock()
+	defer o.Unlock()
+	o.calls = append(o.calls, call)
+}
+
+func (o *recordingObserver) RefreshSucceeded(pods []*kubecontainer.Pod, duration time.Duration) {
+	o.record(fmt.Sprintf("succeeded %d %v", len(pods), duration))
+}
+
+func (o *recordingObserver) RefreshFailed(err error, duration time.Duration) {
+	o.record(fmt.Sprintf("failed %v %v", err, duration))
+}
+
+func (o *recordingObserver) CacheEvicted(uid types.UID) {
+	o.record(fmt.Sprintf("evicted %s", uid))
+}
+
+// panickingObserver panics on every notification.
+type panickingObserver struct{}
+
+func (panickingObserver) RefreshStarted() { panic("started") }
+func (panickingObserver) RefreshSucceeded([]*kubecontainer.Pod, time.Duration) {
+	panic("succeeded")
+}
+func (panickingObserver) RefreshFailed(error, time.Duration) { panic("failed") }
+func (panickingObserver) CacheEvicted(types.UID)             { panic("evicted") }
+
+func TestCacheObservers(t *testing.T) {
+	getter := &fakePodsGetter{pods: []*kubecontainer.Pod{{ID: "1"}, {ID: "2"}}}
+	clock := newFakeClock()
+	observer := &recordingObserver{}
+	cache, err := NewDockerCache(&slowPodsGetter{getter, clock, time.Millisecond}, testDockerCacheConfig(clock).
+		WithDisableBackgroundRefresh(true).
+		WithObservers(panickingObserver{}, observer))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer cache.Stop()
+	observer.cache = cache
+
+	if err := cache.ForceUpdate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	getter.Lock()
+	getter.err = fmt.Errorf("docker is down")
+	getter.Unlock()
+	if err := cache.ForceUpdate(); err == nil {
+		t.Fatalf("expected an error")
+	}
+	cache.EvictPod("1")
+	// Evicting a pod which isn't cached isn't notified.
+	cache.EvictPod("1")
+	cache.EvictPod("9999")
+
+	expected := []string{"succeeded 2 1ms", "failed docker is down 1ms", "evicted 1"}
+	observer.Lock()
+	defer observer.Unlock()
+	if !reflect.DeepEqual(observer.calls, expected) {
+		t.Errorf("expected notifications %v, got %v", expected, observer.calls)
+	}
+}
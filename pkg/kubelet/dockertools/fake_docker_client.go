@@ -17,6 +17,8 @@ limitations under the License.
 package dockertools
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"reflect"
@@ -25,8 +27,10 @@ import (
 	"time"
 
 	"github.com/GoogleCloudPlatform/kubernetes/pkg/kubelet/container"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/types"
 	"github.com/GoogleCloudPlatform/kubernetes/pkg/util"
 	"github.com/fsouza/go-dockerclient"
+	"golang.org/x/net/context"
 )
 
 // FakeDockerClient is a simple fake docker client, so that kubelet can be run for testing without requiring a real docker setup.
@@ -334,18 +338,622 @@ func (f *FakeDockerPuller) IsImagePresent(name string) (bool, error) {
 	return false, nil
 }
 
+// FakeDockerCache is a DockerCache for tests. It serves pods straight from
+// its getter, or from Pods when no getter is set, and records the calls made
+// to it. It lives in this package rather than a testing subpackage because
+// SetGetter takes the unexported podsGetter.
 type FakeDockerCache struct {
+	sync.Mutex
 	getter podsGetter
+	// Pods is returned in place of listing the getter, if the getter is nil.
+	Pods []*container.Pod
+	// Err, if set, is returned by every method that reads or refreshes pods.
+	Err error
+	// CacheTime is reported as the time of the last update. The zero value
+	// reports time.Now(), i.e. an always fresh cache.
+	CacheTime time.Time
+
+	GetPodsCalls            int
+	ForceUpdateCalls        int
+	ForceUpdateIfOlderCalls int
+
+	// Channels returned by Subscribe and SubscribeEvents, by subscriber ID.
+	subscribers      map[int]chan []*container.Pod
+	eventSubscribers map[int]chan PodCacheEvent
+	nextSubscriberID int
+	stopped          bool
+}
+
+var _ DockerCache = &FakeDockerCache{}
+
+func NewFakeDockerCache(getter podsGetter) *FakeDockerCache {
+	return &FakeDockerCache{
+		getter:           getter,
+		subscribers:      make(map[int]chan []*container.Pod),
+		eventSubscribers: make(map[int]chan PodCacheEvent),
+	}
+}
+
+// SetPods makes the cache serve pods instead of listing its getter.
+func (f *FakeDockerCache) SetPods(pods []*container.Pod) {
+	f.Lock()
+	defer f.Unlock()
+	f.getter = nil
+	f.Pods = pods
+}
+
+// SetError makes every subsequent read or refresh fail with err; nil clears it.
+func (f *FakeDockerCache) SetError(err error) {
+	f.Lock()
+	defer f.Unlock()
+	f.Err = err
 }
 
-func NewFakeDockerCache(getter podsGetter) DockerCache {
-	return &FakeDockerCache{getter: getter}
+// SetCacheTime sets the time reported as the last update.
+func (f *FakeDockerCache) SetCacheTime(t time.Time) {
+	f.Lock()
+	defer f.Unlock()
+	f.CacheTime = t
+}
+
+func (f *FakeDockerCache) listPods(all bool) ([]*container.Pod, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	if f.getter == nil {
+		return f.Pods, nil
+	}
+	return f.getter.GetPods(all)
+}
+
+func (f *FakeDockerCache) cacheTime() time.Time {
+	f.Lock()
+	defer f.Unlock()
+	if f.CacheTime.IsZero() {
+		return time.Now()
+	}
+	return f.CacheTime
 }
 
 func (f *FakeDockerCache) GetPods() ([]*container.Pod, error) {
-	return f.getter.GetPods(false)
+	f.Lock()
+	f.GetPodsCalls++
+	f.Unlock()
+	return f.listPods(false)
+}
+
+func (f *FakeDockerCache) GetPodsWithContext(ctx context.Context) ([]*container.Pod, error) {
+	return f.GetPods()
+}
+
+func (f *FakeDockerCache) GetPodsTimed() ([]*container.Pod, bool, time.Duration, error) {
+	pods, err := f.GetPods()
+	return pods, false, 0, err
+}
+
+func (f *FakeDockerCache) GetPodsStrict() ([]*container.Pod, error) {
+	return f.GetPods()
+}
+
+func (f *FakeDockerCache) GetPodsSnapshot() ([]*container.Pod, time.Time, error) {
+	pods, err := f.GetPods()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return pods, f.cacheTime(), nil
+}
+
+func (f *FakeDockerCache) Range(fn func(pod *container.Pod) bool) error {
+	pods, err := f.GetPods()
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods {
+		if !fn(pod) {
+			break
+		}
+	}
+	return nil
+}
+
+func (f *FakeDockerCache) GetPodsWithFreshness() ([]*container.Pod, bool, error) {
+	pods, err := f.GetPods()
+	return pods, err == nil, err
+}
+
+func (f *FakeDockerCache) GetPodsOnce() ([]*container.Pod, error) {
+	return f.GetPods()
+}
+
+func (f *FakeDockerCache) GetPodsMaxStale(maxStale time.Duration) ([]*container.Pod, error) {
+	return f.GetPods()
+}
+
+func (f *FakeDockerCache) GetAllPods() ([]*container.Pod, error) {
+	return f.listPods(true)
 }
 
 func (f *FakeDockerCache) ForceUpdateIfOlder(time.Time) error {
+	f.Lock()
+	defer f.Unlock()
+	f.ForceUpdateIfOlderCalls++
+	return f.Err
+}
+
+func (f *FakeDockerCache) AssertUpToDate() error {
+	return f.ForceUpdateIfOlder(time.Now())
+}
+
+func (f *FakeDockerCache) ForceUpdate() error {
+	f.Lock()
+	defer f.Unlock()
+	f.ForceUpdateCalls++
+	return f.Err
+}
+
+func (f *FakeDockerCache) ForceUpdatePod(uid types.UID) error {
+	return f.ForceUpdate()
+}
+
+func (f *FakeDockerCache) ForceUpdateWithContext(ctx context.Context) error {
+	return f.ForceUpdate()
+}
+
+func (f *FakeDockerCache) GetPodSandbox(uid types.UID) (*container.Container, bool, error) {
+	pod, found, err := f.GetPodByUID(uid)
+	if !found {
+		return nil, false, err
+	}
+	sandbox := podSandbox(pod)
+	return sandbox, sandbox != nil, err
+}
+
+func (f *FakeDockerCache) AppContainers(uid types.UID) ([]*container.Container, bool, error) {
+	pod, found, err := f.GetPodByUID(uid)
+	if !found {
+		return nil, false, err
+	}
+	return appContainers(pod), true, err
+}
+
+func (f *FakeDockerCache) GetPodByUID(uid types.UID) (*container.Pod, bool, error) {
+	pods, err := f.listPods(false)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, pod := range pods {
+		if pod.ID == uid {
+			return pod, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+func (f *FakeDockerCache) GetPodsFiltered(pred func(pod *container.Pod) bool) ([]*container.Pod, error) {
+	pods, err := f.listPods(true)
+	if err != nil {
+		return nil, err
+	}
+	var result []*container.Pod
+	for _, pod := range pods {
+		if pred(pod) {
+			result = append(result, pod)
+		}
+	}
+	return result, nil
+}
+
+func (f *FakeDockerCache) GetRestartCount(uid types.UID, containerName string) (int, bool, error) {
+	pods, err := f.listPods(false)
+	if err != nil {
+		return 0, false, err
+	}
+	for _, pod := range pods {
+		if pod.ID != uid {
+			continue
+		}
+		for _, c := range pod.Containers {
+			if c.Name == containerName {
+				return 0, true, nil
+			}
+		}
+	}
+	return 0, false, nil
+}
+
+func (f *FakeDockerCache) GetPodStatus(uid types.UID) (*container.PodStatus, bool, error) {
+	pods, err := f.listPods(true)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, pod := range pods {
+		if pod.ID == uid {
+			return podStatus(pod, nil), true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+func (f *FakeDockerCache) GetPodAndStatus(uid types.UID) (*container.Pod, *container.PodStatus, bool, error) {
+	pods, err := f.listPods(true)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	for _, pod := range pods {
+		if pod.ID == uid {
+			return pod, podStatus(pod, nil), true, nil
+		}
+	}
+	return nil, nil, false, nil
+}
+
+func (f *FakeDockerCache) GetRecentlyRemovedPod(uid types.UID) (*container.Pod, bool) {
+	return nil, false
+}
+
+func (f *FakeDockerCache) GetPodsByUIDs(uids []types.UID) (map[types.UID]*container.Pod, error) {
+	pods, err := f.listPods(false)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[types.UID]*container.Pod, len(uids))
+	for _, uid := range uids {
+		for _, pod := range pods {
+			if pod.ID == uid {
+				result[uid] = pod
+			}
+		}
+	}
+	return result, nil
+}
+
+func (f *FakeDockerCache) GetContainerStateAge(id types.UID) (time.Duration, bool, error) {
+	pods, err := f.listPods(true)
+	if err != nil {
+		return 0, false, err
+	}
+	for _, pod := range pods {
+		for _, c := range pod.Containers {
+			if c.ID == id {
+				return 0, true, nil
+			}
+		}
+	}
+	return 0, false, nil
+}
+
+func (f *FakeDockerCache) GetPodsModifiedSince(generation uint64) ([]*container.Pod, uint64, error) {
+	pods, err := f.listPods(false)
+	return pods, 0, err
+}
+
+func (f *FakeDockerCache) NewDeltaReader() *DeltaReader {
+	return newDeltaReader(f)
+}
+
+// podsModifiedSince returns all the pods, the reader dropping the unchanged
+// ones.
+func (f *FakeDockerCache) podsModifiedSince(generation uint64, known map[types.UID]*container.Pod) ([]*container.Pod, []types.UID, uint64, error) {
+	pods, err := f.listPods(false)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	listed := make(map[types.UID]bool, len(pods))
+	for _, pod := range pods {
+		listed[pod.ID] = true
+	}
+	var removed []types.UID
+	for uid := range known {
+		if !listed[uid] {
+			removed = append(removed, uid)
+		}
+	}
+	return pods, removed, 0, nil
+}
+
+// podChanged compares the pods down to the states of their containers, like
+// a cache with the default ChangeDetection.
+func (f *FakeDockerCache) podChanged(old, pod *container.Pod) bool {
+	return !podEqual(ChangeDetectContainerState, old, pod)
+}
+
+func (f *FakeDockerCache) GetPodCount() (int, error) {
+	pods, err := f.listPods(false)
+	return len(pods), err
+}
+
+func (f *FakeDockerCache) GetPodIDs() ([]types.UID, error) {
+	pods, err := f.listPods(false)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]types.UID, 0, len(pods))
+	for _, pod := range pods {
+		ids = append(ids, pod.ID)
+	}
+	return ids, nil
+}
+
+func (f *FakeDockerCache) GetPodContainerCount(uid types.UID) (int, bool, error) {
+	pod, found, err := f.GetPodByUID(uid)
+	if !found {
+		return 0, false, err
+	}
+	return len(pod.Containers), true, err
+}
+
+func (f *FakeDockerCache) Contains(uid types.UID) (bool, error) {
+	_, found, err := f.GetPodByUID(uid)
+	return found, err
+}
+
+func (f *FakeDockerCache) GetPodsInNamespace(namespace string) ([]*container.Pod, error) {
+	pods, err := f.listPods(false)
+	if err != nil {
+		return nil, err
+	}
+	var result []*container.Pod
+	for _, pod := range pods {
+		if pod.Namespace == namespace {
+			result = append(result, pod)
+		}
+	}
+	return result, nil
+}
+
+func (f *FakeDockerCache) GetImagesInUse() ([]container.ImageID, error) {
+	pods, err := f.listPods(false)
+	if err != nil {
+		return nil, err
+	}
+	inUse := util.NewStringSet()
+	for _, pod := range pods {
+		for _, c := range pod.Containers {
+			inUse.Insert(c.Image)
+		}
+	}
+	var images []container.ImageID
+	for _, image := range inUse.List() {
+		images = append(images, container.ImageID(image))
+	}
+	return images, nil
+}
+
+func (f *FakeDockerCache) GetContainersForImage(image string) ([]*container.Container, error) {
+	pods, err := f.listPods(false)
+	if err != nil {
+		return nil, err
+	}
+	var containers []*container.Container
+	for _, pod := range pods {
+		for _, c := range pod.Containers {
+			if c.Image == image {
+				containers = append(containers, c)
+			}
+		}
+	}
+	return containers, nil
+}
+
+func (f *FakeDockerCache) GetContainerByID(id types.UID) (*container.Pod, *container.Container, bool, error) {
+	pods, err := f.listPods(false)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	for _, pod := range pods {
+		for _, c := range pod.Containers {
+			if c.ID == id {
+				return pod, c, true, nil
+			}
+		}
+	}
+	return nil, nil, false, nil
+}
+
+func (f *FakeDockerCache) LastUpdated() time.Time {
+	return f.cacheTime()
+}
+
+func (f *FakeDockerCache) CacheStatus() DockerCacheStatus {
+	return DockerCacheStatus{LastUpdated: f.cacheTime(), CircuitState: CircuitClosed}
+}
+
+func (f *FakeDockerCache) Stats() DockerCacheStats {
+	pods, _ := f.listPods(false)
+	stats := DockerCacheStats{PodCount: len(pods), LastRefreshTime: f.cacheTime()}
+	for _, pod := range pods {
+		stats.ContainerCount += len(pod.Containers)
+	}
+	return stats
+}
+
+func (f *FakeDockerCache) DumpJSON() ([]byte, error) {
+	pods, err := f.listPods(false)
+	if err != nil {
+		return nil, err
+	}
+	dump := DockerCacheDump{CacheTime: f.cacheTime(), PodCount: len(pods), Pods: make([]PodDump, 0, len(pods))}
+	for _, pod := range pods {
+		dump.Pods = append(dump.Pods, newPodDump(pod))
+	}
+	return json.Marshal(dump)
+}
+
+func (f *FakeDockerCache) Subscribe(name string) (<-chan []*container.Pod, func()) {
+	f.Lock()
+	defer f.Unlock()
+	ch := make(chan []*container.Pod, subscriberBufferSize)
+	if f.stopped {
+		close(ch)
+		return ch, func() {}
+	}
+	id := f.nextSubscriberID
+	f.nextSubscriberID++
+	f.subscribers[id] = ch
+	return ch, func() {
+		f.Lock()
+		defer f.Unlock()
+		if ch, found := f.subscribers[id]; found {
+			delete(f.subscribers, id)
+			close(ch)
+		}
+	}
+}
+
+// Publish sends pods to the subscribers, dropping their oldest snapshot if
+// their buffer is full, as the cache does after a refresh changed its pods.
+func (f *FakeDockerCache) Publish(pods []*container.Pod) {
+	f.Lock()
+	defer f.Unlock()
+	for _, ch := range f.subscribers {
+		for sent := false; !sent; {
+			select {
+			case ch <- pods:
+				sent = true
+			default:
+				select {
+				case <-ch:
+				default:
+				}
+			}
+		}
+	}
+}
+
+func (f *FakeDockerCache) OnRefresh(fn func(pods []*container.Pod, asOf time.Time)) func() {
+	return func() {}
+}
+
+func (f *FakeDockerCache) SubscribeEvents(name string) (<-chan PodCacheEvent, func()) {
+	f.Lock()
+	defer f.Unlock()
+	ch := make(chan PodCacheEvent, eventSubscriberBufferSize)
+	if f.stopped {
+		close(ch)
+		return ch, func() {}
+	}
+	id := f.nextSubscriberID
+	f.nextSubscriberID++
+	f.eventSubscribers[id] = ch
+	return ch, func() {
+		f.Lock()
+		defer f.Unlock()
+		if ch, found := f.eventSubscribers[id]; found {
+			delete(f.eventSubscribers, id)
+			close(ch)
+		}
+	}
+}
+
+// PublishEvent sends event to the event subscribers, dropping their oldest
+// event if their buffer is full, as the cache does.
+func (f *FakeDockerCache) PublishEvent(event PodCacheEvent) {
+	f.Lock()
+	defer f.Unlock()
+	for _, ch := range f.eventSubscribers {
+		for sent := false; !sent; {
+			select {
+			case ch <- event:
+				sent = true
+			default:
+				select {
+				case <-ch:
+				default:
+				}
+			}
+		}
+	}
+}
+
+func (f *FakeDockerCache) Prime(pods []*container.Pod, asOf time.Time) {
+}
+
+func (f *FakeDockerCache) WaitForInitialSync(timeout time.Duration) error {
 	return nil
 }
+
+func (f *FakeDockerCache) RecentErrors() []TimestampedError {
+	return nil
+}
+
+func (f *FakeDockerCache) Healthy() error {
+	f.Lock()
+	defer f.Unlock()
+	return f.Err
+}
+
+func (f *FakeDockerCache) SetGetter(getter podsGetter) error {
+	if getter == nil {
+		return errors.New("dockerCache: getter must not be nil")
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.getter = getter
+	return nil
+}
+
+func (f *FakeDockerCache) Reset() {
+}
+
+func (f *FakeDockerCache) EvictPod(uid types.UID) {
+}
+
+func (f *FakeDockerCache) Pause() {
+}
+
+func (f *FakeDockerCache) Resume() error {
+	f.Lock()
+	defer f.Unlock()
+	return f.Err
+}
+
+func (f *FakeDockerCache) DebugGoroutineCount() int {
+	return 0
+}
+
+func (f *FakeDockerCache) Name() string {
+	return defaultDockerCacheName
+}
+
+func (f *FakeDockerCache) ReadOnlyView() DockerCacheView {
+	return fakeDockerCacheView{f}
+}
+
+func (f *FakeDockerCache) DebugTopMissedPods(n int) []MissedPod {
+	return nil
+}
+
+// Stop closes the channels of all the subscribers.
+func (f *FakeDockerCache) Stop() {
+	ageCollector.remove(f)
+	f.Lock()
+	defer f.Unlock()
+	if f.stopped {
+		return
+	}
+	f.stopped = true
+	for id, ch := range f.subscribers {
+		delete(f.subscribers, id)
+		close(ch)
+	}
+	for id, ch := range f.eventSubscribers {
+		delete(f.eventSubscribers, id)
+		close(ch)
+	}
+}
+
+// fakeDockerCacheView serves the pods of a FakeDockerCache without counting
+// the calls.
+type fakeDockerCacheView struct {
+	f *FakeDockerCache
+}
+
+func (v fakeDockerCacheView) GetPods() ([]*container.Pod, error) {
+	return v.f.listPods(false)
+}
+
+func (v fakeDockerCacheView) LastUpdated() time.Time {
+	return v.f.cacheTime()
+}
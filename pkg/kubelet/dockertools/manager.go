@@ -565,8 +565,10 @@ func (self *DockerManager) GetPods(all bool) ([]*kubecontainer.Pod, error) {
 		pod.Containers = append(pod.Containers, &kubecontainer.Container{
 			ID:      types.UID(c.ID),
 			Name:    dockerName.ContainerName,
+			Image:   c.Image,
 			Hash:    hash,
 			Created: c.Created,
+			State:   toContainerState(c.Status),
 		})
 	}
 
@@ -577,6 +579,19 @@ func (self *DockerManager) GetPods(all bool) ([]*kubecontainer.Pod, error) {
 	return result, nil
 }
 
+// toContainerState converts the status of a listed docker container, e.g.
+// "Up 5 minutes" or "Exited (0) 2 hours ago", to a ContainerState.
+func toContainerState(status string) kubecontainer.ContainerState {
+	switch {
+	case strings.HasPrefix(status, "Up"):
+		return kubecontainer.ContainerStateRunning
+	case strings.HasPrefix(status, "Exited"):
+		return kubecontainer.ContainerStateExited
+	default:
+		return kubecontainer.ContainerStateUnknown
+	}
+}
+
 func (self *DockerManager) Pull(image string) error {
 	return self.Puller.Pull(image)
 }
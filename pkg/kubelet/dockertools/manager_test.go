@@ -20,6 +20,7 @@ import (
 	"testing"
 
 	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
+	kubecontainer "github.com/GoogleCloudPlatform/kubernetes/pkg/kubelet/container"
 	"github.com/fsouza/go-dockerclient"
 )
 
@@ -87,3 +88,20 @@ func TestSetEntrypointAndCommand(t *testing.T) {
 		}
 	}
 }
+
+func TestToContainerState(t *testing.T) {
+	tests := []struct {
+		status   string
+		expected kubecontainer.ContainerState
+	}{
+		{"Up 5 minutes", kubecontainer.ContainerStateRunning},
+		{"Up 2 hours (Paused)", kubecontainer.ContainerStateRunning},
+		{"Exited (0) 2 hours ago", kubecontainer.ContainerStateExited},
+		{"", kubecontainer.ContainerStateUnknown},
+	}
+	for _, test := range tests {
+		if state := toContainerState(test.status); state != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.status, test.expected, state)
+		}
+	}
+}
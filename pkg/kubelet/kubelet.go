@@ -232,7 +232,9 @@ func NewMainKubelet(
 
 	klet.podManager = newBasicPodManager(klet.kubeClient)
 
-	dockerCache, err := dockertools.NewDockerCache(containerManager)
+	// Name the cache after the node, so that the kubelets sharing a process
+	// report their caches apart.
+	dockerCache, err := dockertools.NewDockerCache(containerManager, dockertools.DefaultDockerCacheConfig().WithName(hostname))
 	if err != nil {
 		return nil, err
 	}
@@ -240,6 +242,9 @@ func NewMainKubelet(
 	klet.podWorkers = newPodWorkers(dockerCache, klet.syncPod, recorder)
 
 	metrics.Register(dockerCache)
+	if err := dockertools.RegisterMetrics(dockerCache); err != nil {
+		glog.Warningf("Not reporting the docker cache age: %v", err)
+	}
 
 	if err = klet.setupDataDirs(); err != nil {
 		return nil, err